@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+	A table with Audit set keeps a history of its rows: each Insert, Update, Delete, & Restore writes an AuditEntry with the row
+	before & after the change and who made it (see WithActor) to the audit table (Config.AuditTable) in the same tx as the write.
+	The row before is selected with the table's primary query FOR UPDATE so it can't change in between. History reads a row's
+	entries through a list query of the audit table so it's cached like any other.
+
+	The audit table is e.g.
+		create table storage_audit (
+			audit_id   bigserial primary key,
+			table_name text not null,
+			row_key    text not null,
+			action     text not null,
+			actor      text not null,
+			old_row    jsonb not null,
+			new_row    jsonb not null,
+			created_at timestamptz not null default now()
+		);
+		create index on storage_audit (table_name, row_key, audit_id);
+*/
+
+// DefaultAuditTable is the table audit entries are written to if Config.AuditTable isn't set
+const DefaultAuditTable = "storage_audit"
+
+// the AuditEntry.Action of each write
+const (
+	AuditInsert  = "insert"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+)
+
+// the queries of the audit table
+const (
+	auditGetByID = "storage.AuditGetByID"
+	auditByRow   = "storage.AuditByRow"
+)
+
+// AuditEntry is a row of the audit table i.e. a change to a row of a table with Audit set
+type AuditEntry struct {
+	AuditID   int64           `json:"audit_id"`
+	TableName string          `json:"table_name"` // the name of the Table.Struct e.g. Leads
+	RowKey    string          `json:"row_key"`    // the row's primary key as it's stored in a cached list e.g. `12` or `["4","12"]`
+	Action    string          `json:"action"`     // AuditInsert, AuditUpdate, AuditDelete, or AuditRestore
+	Actor     string          `json:"actor"`      // see WithActor; empty if the ctx didn't have one
+	OldRow    json.RawMessage `json:"old_row"`    // the row as json before the change; `null` for an insert
+	NewRow    json.RawMessage `json:"new_row"`    // the row as json after the change; `null` for a (hard) delete
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type actorKey struct{}
+
+// WithActor returns a ctx whose writes to audited tables are recorded as made by actor e.g. the user_id of the request
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// newAuditTable is the table of the AuditEntries in the audit table name; it's added to the tables if any of them have Audit set
+func newAuditTable(name string) *Table {
+	if name == "" {
+		name = DefaultAuditTable
+	}
+
+	return &Table{
+		Struct:           AuditEntry{},
+		PrimaryKeyField:  "audit_id",
+		PrimaryQueryName: auditGetByID,
+		InsertQuery: fmt.Sprintf(`insert into %s (table_name, row_key, action, actor, old_row, new_row)
+values (:table_name, :row_key, :action, :actor, :old_row, :new_row) returning *`, name),
+		Queries: []*Query{
+			{
+				Name:     auditGetByID,
+				CacheKey: "audit_id=%v",
+				Query:    fmt.Sprintf("select * from %s where audit_id=:audit_id", name),
+
+				InsertAction: CacheSet,
+				UpdateAction: CacheNoAction, // entries are never updated
+				SelectAction: CacheSet,
+			},
+			{
+				Name:                    auditByRow,
+				CacheKey:                "table_name=%v|row_key=%v",
+				CachePrimaryQueryStored: auditGetByID,
+				Query:                   fmt.Sprintf("select * from %s where table_name=:table_name and row_key=:row_key order by audit_id", name),
+
+				InsertAction: CacheRPush,
+				UpdateAction: CacheNoAction,
+				SelectAction: CacheRPush,
+			},
+		},
+	}
+}
+
+var (
+	// singleTableSelectRegex matches a select of one table (with an optional alias) e.g. `select * from leads where lead_id=:lead_id`
+	singleTableSelectRegex = regexp.MustCompile(`(?is)^select\s.+?\sfrom\s+[\w."]+(\s+(as\s+)?\w+)?\s+where\s`)
+	// notLockableRegex matches what can't be in a query that's selected FOR UPDATE or would lock more than the row
+	notLockableRegex = regexp.MustCompile(`(?is);|\b(join|union|intersect|except|distinct|group\s+by|having|for\s+(update|share|no\s+key\s+update|key\s+share))\b|\(\s*select\b`)
+)
+
+// lockQuery returns query FOR UPDATE; query has to be a plain select of a single table so only its row is locked
+func lockQuery(query string) (string, error) {
+	query = strings.TrimSpace(query)
+	if !singleTableSelectRegex.MatchString(query) || notLockableRegex.MatchString(query) {
+		return "", errors.New("must be a plain select from a single table with a WHERE (no joins, unions, subqueries, or `;`) so it can be selected FOR UPDATE")
+	}
+	return query + " for update", nil
+}
+
+// validateAudit makes sure each audited table's row can be selected FOR UPDATE with its primary query
+func (s *storage) validateAudit() error {
+	for _, t := range s.structToTable {
+		if !t.Audit {
+			continue
+		}
+
+		if len(t.pkFields) == 0 {
+			return fmt.Errorf("Table: %s Err: Audit needs a PrimaryKeyField", t.tableName)
+		}
+
+		q, ok := s.queries[t.PrimaryQueryName]
+		if !ok || s.queryToTable[q.Name] != t || q.Bucket != BucketNone || len(q.slicesInQuery) > 0 {
+			return fmt.Errorf("Table: %s Err: Audit needs a PrimaryQueryName of a query of the table that selects a row by its primary key", t.tableName)
+		}
+
+		query, err := lockQuery(q.Query)
+		if err != nil {
+			return fmt.Errorf("Table: %s Err: Audit: the PrimaryQueryName's query %s", t.tableName, err)
+		}
+		t.lockQuery = query
+	}
+	return nil
+}
+
+// auditedTable returns the table of objMap's row if it has Audit set
+func (s *storage) auditedTable(objMap map[string]interface{}) *Table {
+	structName, _ := objMap[objMapStructNameKey].(string)
+	table, ok := s.structToTable[structName]
+	if !ok || !table.Audit {
+		return nil
+	}
+	return table
+}
+
+// writeFunc is one of the writes of a row e.g. s.update
+type writeFunc func(ctx context.Context, objMap map[string]interface{}, conn InsertInterface) (map[string]interface{}, error)
+
+/*
+	writeAudited runs write on conn. If the row's table has Audit set then the row's AuditEntry is inserted on conn too, which has
+	to be a tx so they're committed together; its objMap is returned so the cache actions can be taken on it after the commit.
+*/
+func (s *storage) writeAudited(ctx context.Context, objMap map[string]interface{}, action string, write writeFunc, conn InsertInterface) (res map[string]interface{}, entry map[string]interface{}, err error) {
+	table := s.auditedTable(objMap)
+	if table == nil {
+		res, err = write(ctx, objMap, conn)
+		return res, nil, err
+	}
+
+	var oldRow interface{}
+	if action != AuditInsert {
+		oldRow, err = s.selectForUpdate(ctx, table, objMap, conn)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, nil, err
+		}
+	}
+
+	res, err = write(ctx, objMap, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var newRow interface{}
+	if action != AuditDelete || table.SoftDeleteField != "" {
+		// a soft delete's row is still there
+		newRow, err = table.rowFromMap(res)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	entry, err = s.insertAuditEntry(ctx, table, res, action, oldRow, newRow, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, entry, nil
+}
+
+// writePrimary is writeAudited on the primary; if the table has Audit set then the write & its entry are in a tx of their own
+func (s *storage) writePrimary(ctx context.Context, objMap map[string]interface{}, action string, write writeFunc) (map[string]interface{}, error) {
+	if s.auditedTable(objMap) == nil {
+		return write(ctx, objMap, s.db.writeConn())
+	}
+
+	tx, err := s.db.writeConn().BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, entry, err := s.writeAudited(ctx, objMap, action, write, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.actionNonSelect(ctx, entry, nil, actionInsert)
+	if err != nil {
+		// the write's committed so don't fail it because the history's cache couldn't be updated
+		logError(ctx, "error taking the cache actions of an audit entry", err)
+	}
+	return res, nil
+}
+
+// selectForUpdate selects the row of objMap with its table's primary query & locks it until the tx that conn is ends
+func (s *storage) selectForUpdate(ctx context.Context, table *Table, objMap map[string]interface{}, conn InsertInterface) (interface{}, error) {
+	res, err := s.db.queryStructs(ctx, objMap, table.lockQuery, conn, table.structType)
+	if err != nil {
+		return nil, err
+	}
+	return res[0], nil
+}
+
+// insertAuditEntry inserts the AuditEntry of the write of row (the objMap returned by the write) & returns its objMap
+func (s *storage) insertAuditEntry(ctx context.Context, table *Table, row map[string]interface{}, action string, oldRow interface{}, newRow interface{}, conn InsertInterface) (map[string]interface{}, error) {
+	rowKey, err := table.listMember(row)
+	if err != nil {
+		return nil, err
+	}
+
+	oldJSON, err := json.Marshal(oldRow)
+	if err != nil {
+		return nil, err
+	}
+	newJSON, err := json.Marshal(newRow)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := structToMap(&AuditEntry{
+		TableName: table.tableName,
+		RowKey:    rowKey,
+		Action:    action,
+		Actor:     actorFrom(ctx),
+		OldRow:    oldJSON,
+		NewRow:    newJSON,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	d(ctx, "inserting the audit entry of %s %s: %s", table.tableName, rowKey, action)
+	return s.insert(ctx, entry, conn)
+}
+
+func (s *storage) History(ctx context.Context, obj interface{}, dest *[]AuditEntry, opts *SelectOptions) error {
+	ctx, end := s.startCall(ctx, "History", auditByRow)
+	d(ctx, "History() with obj: %+v", obj)
+
+	objMap, err := structToMap(obj)
+	if err != nil {
+		return end(err)
+	}
+
+	table := s.auditedTable(objMap)
+	if table == nil {
+		return end(errors.New("no Table with Audit set for " + getStructName(obj)))
+	}
+
+	rowKey, err := table.listMember(objMap)
+	if err != nil {
+		return end(err)
+	}
+
+	if opts == nil {
+		opts = &SelectOptions{FetchAllData: true}
+	}
+
+	row := &AuditEntry{TableName: table.tableName, RowKey: rowKey}
+	return end(s.selectAll(ctx, row, dest, auditByRow, opts, s.db.consistentReadConn(ctx)))
+}
+
+// queueAuditEntry takes the cache actions of the entry (if there is one) once the tx is committed
+func (t *Tx) queueAuditEntry(entry map[string]interface{}) {
+	if entry == nil {
+		return
+	}
+
+	t.actions = append(t.actions, txAction{
+		action: actionInsert,
+		obj:    entry,
+	})
+}
@@ -0,0 +1,34 @@
+package storage
+
+import "testing"
+
+func TestLockQuery(t *testing.T) {
+	cases := []struct {
+		query string
+		ok    bool
+	}{
+		{query: "select * from leads where lead_id=:lead_id", ok: true},
+		{query: "SELECT l.* FROM leads AS l WHERE l.lead_id = :lead_id", ok: true},
+		{query: "select * from public.leads l where lead_id=:lead_id limit 1", ok: true},
+		{query: "  select * from leads where lead_id=:lead_id\n", ok: true},
+		{query: "select * from leads where lead_id=:lead_id;"},
+		{query: "select * from leads where lead_id=:lead_id for update"},
+		{query: "select * from leads where lead_id=:lead_id for share"},
+		{query: "select l.* from leads l join users u on u.user_id=l.user_id where l.lead_id=:lead_id"},
+		{query: "select * from leads, users where lead_id=:lead_id"},
+		{query: "select distinct * from leads where lead_id=:lead_id"},
+		{query: "select * from leads where lead_id in (select lead_id from notes where note_id=:note_id)"},
+		{query: "select * from leads where lead_id=:lead_id union select * from old_leads where lead_id=:lead_id"},
+		{query: "select * from leads"},
+	}
+
+	for _, c := range cases {
+		got, err := lockQuery(c.query)
+		if c.ok && err != nil {
+			t.Errorf("lockQuery(%q): %s", c.query, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("lockQuery(%q) = %q, want an error", c.query, got)
+		}
+	}
+}
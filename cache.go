@@ -2,7 +2,7 @@ package storage
 
 import (
 	"context"
-	"encoding/json"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -18,31 +18,233 @@ func newCache(conn *redis.ClusterClient) *cache {
 	}
 }
 
-func (c *cache) get(ctx context.Context, key string, value interface{}) error {
-	str, err := c.Get(ctx, key).Result()
+func (c *cache) get(ctx context.Context, key string, value interface{}, enc *encoder) error {
+	b, err := c.Get(ctx, key).Bytes()
 	if err != nil {
 		// returns err redis.Nil if key does not exist
 		return err
 	}
 
-	return json.Unmarshal([]byte(str), value)
+	return enc.decode(b, value)
 }
 
-func (c *cache) set(ctx context.Context, key string, value interface{}, expiration int) error {
-	str, err := json.Marshal(value)
-	d("set() key: %s\n value: %+v\n", key, string(str))
+func (c *cache) set(ctx context.Context, key string, value interface{}, expiration time.Duration, enc *encoder) error {
+	b, err := enc.encode(value)
+	d(ctx, "set() key: %s\n value: %+v\n", key, value)
 	if err != nil {
 		return err
 	}
 
-	return c.Set(ctx, key, str, time.Duration(expiration)*time.Second).Err()
+	// a negative expiration (i.e. a CacheTTL of -1) is never expired
+	return c.Set(ctx, key, b, expiration).Err()
 }
 
-func (c *cache) getList(ctx context.Context, q *Query, objMap map[string]interface{}, dest interface{}, opts *SelectOptions) error {
-	d("getList")
+// hget gets the fields of a hash and unmarshals them into value. If any of the fields are missing then it's a redis.Nil
+func (c *cache) hget(ctx context.Context, key string, fields []string, value interface{}, enc *encoder) error {
+	res, err := c.HMGet(ctx, key, fields...).Result()
+	if err != nil {
+		return err
+	}
+
+	m := map[string]interface{}{}
+	for i, field := range fields {
+		str, ok := res[i].(string)
+		if !ok {
+			// either the key doesn't exist or the hash is missing a field so treat it as a miss
+			return redis.Nil
+		}
+
+		var v interface{}
+		err = enc.decode([]byte(str), &v)
+		if err != nil {
+			return err
+		}
+		m[field] = v
+	}
+
+	return mapToStruct(m, value)
+}
+
+// hset sets only the fields of objMap into the hash at key; fields not passed in are left alone
+func (c *cache) hset(ctx context.Context, key string, objMap map[string]interface{}, fields []string, expiration time.Duration, enc *encoder) error {
+	values := []interface{}{}
+	for _, field := range fields {
+		v, ok := objMap[field]
+		if !ok {
+			continue
+		}
+
+		str, err := enc.encode(v)
+		if err != nil {
+			return err
+		}
+		values = append(values, field, str)
+	}
+	d(ctx, "hset() key: %s\n values: %+v\n", key, values)
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	_, err := c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, values...)
+		if expiration > 0 {
+			pipe.Expire(ctx, key, expiration)
+		}
+		return nil
+	})
+	return err
+}
+
+// markFresh sets the marker that the key isn't stale for the query's SoftTTL; it's set whenever the key is filled
+func (c *cache) markFresh(ctx context.Context, q *Query, key string) error {
+	if q.SoftTTL <= 0 {
+		return nil
+	}
+	return c.Set(ctx, key+cacheKeyFreshModifier, 1, time.Duration(q.SoftTTL)*time.Second).Err()
+}
+
+/*
+	claimStale returns true if the key is past the query's SoftTTL i.e. its fresh marker has expired. The marker is set again
+	at the same time (SETNX) so only one caller gets true & refreshes the key while everyone else keeps using the stale value
+*/
+func (c *cache) claimStale(ctx context.Context, q *Query, key string) (bool, error) {
+	return c.SetNX(ctx, key+cacheKeyFreshModifier, 1, time.Duration(q.SoftTTL)*time.Second).Result()
+}
+
+// push LPushes (or RPushes if !left) values onto the list at key & sets the list's expiration
+func (c *cache) push(ctx context.Context, key string, left bool, values []interface{}, expiration time.Duration) error {
+	_, err := c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if left {
+			pipe.LPush(ctx, key, values...)
+		} else {
+			pipe.RPush(ctx, key, values...)
+		}
+		// note: an Expire with a negative expiration deletes the key
+		if expiration > 0 {
+			pipe.Expire(ctx, key, expiration)
+		}
+		return nil
+	})
+	return err
+}
+
+// fillList replaces the list at key with values so filling it again (e.g. a refresh of a SoftTTL query) doesn't push them twice
+func (c *cache) fillList(ctx context.Context, key string, left bool, values []interface{}, expiration time.Duration) error {
+	_, err := c.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		if left {
+			pipe.LPush(ctx, key, values...)
+		} else {
+			pipe.RPush(ctx, key, values...)
+		}
+		if expiration > 0 {
+			pipe.Expire(ctx, key, expiration)
+		}
+		return nil
+	})
+	return err
+}
+
+/*
+	A counter is filled by count() with SET NX after it's been counted in the db. A write that happens while it's being counted
+	would be lost: the counter doesn't exist yet so the write doesn't change it & the count from before the write is then set. So
+	every write to a counter bumps its fill generation (see counterGenKey) & the fill is only set if the generation is the same as
+	it was before the count was queried; otherwise the next count fills it.
+*/
+
+// counterGenKey is where the fill generation of the counter in key is kept; like versionKey it's in the same slot as key
+func counterGenKey(key string) string {
+	return "{" + key + "}" + cacheKeyCounterGenModifier
+}
+
+// counterKeys returns the keys of the counter's scripts; keys with a `{` or `}` in them don't have a generation
+func counterKeys(key string) []string {
+	if strings.ContainsAny(key, "{}") {
+		return []string{key}
+	}
+	return []string{key, counterGenKey(key)}
+}
+
+// incrXScript increments a key only if it exists (like RPushX) so a count never drifts from an empty base & bumps the generation (KEYS[2])
+var incrXScript = redis.NewScript(`
+if KEYS[2] then
+	redis.call("INCR", KEYS[2])
+	redis.call("PEXPIRE", KEYS[2], ARGV[2])
+end
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("INCRBY", KEYS[1], ARGV[1])
+end
+return false
+`)
+
+// incrX increments the key by value only if the key exists; expiration is the counter's TTL
+func (c *cache) incrX(ctx context.Context, key string, value int64, expiration time.Duration) error {
+	d(ctx, "incrX() key: %s value: %d", key, value)
+	err := incrXScript.Run(ctx, c, counterKeys(key), value, versionTTL(expiration).Milliseconds()).Err()
+	if err == redis.Nil {
+		// key doesn't exist; nothing to increment
+		return nil
+	}
+	return err
+}
+
+// delCounterScript deletes the counter & bumps its generation (KEYS[2]) so a count from before the delete isn't filled
+var delCounterScript = redis.NewScript(`
+if KEYS[2] then
+	redis.call("INCR", KEYS[2])
+	redis.call("PEXPIRE", KEYS[2], ARGV[1])
+end
+return redis.call("DEL", KEYS[1])
+`)
+
+// delCounter deletes the counter in key; expiration is the counter's TTL
+func (c *cache) delCounter(ctx context.Context, key string, expiration time.Duration) error {
+	d(ctx, "delCounter() key: %s", key)
+	return delCounterScript.Run(ctx, c, counterKeys(key), versionTTL(expiration).Milliseconds()).Err()
+}
+
+// counterGen returns the fill generation of the counter in key; "" if it's never been written
+func (c *cache) counterGen(ctx context.Context, key string) (string, error) {
+	if strings.ContainsAny(key, "{}") {
+		return "", nil
+	}
+
+	gen, err := c.Get(ctx, counterGenKey(key)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return gen, err
+}
+
+// fillCounterScript sets KEYS[1] to ARGV[2] if it doesn't exist & the generation (KEYS[2]) is still ARGV[1]
+var fillCounterScript = redis.NewScript(`
+if KEYS[2] and (redis.call("GET", KEYS[2]) or "") ~= ARGV[1] then
+	return 0
+end
+local ttl = tonumber(ARGV[3])
+if ttl > 0 then
+	return redis.call("SET", KEYS[1], ARGV[2], "NX", "PX", ttl) and 1 or 0
+end
+return redis.call("SET", KEYS[1], ARGV[2], "NX") and 1 or 0
+`)
+
+// fillCounter sets the counter in key to count unless it already exists or was written since gen (see counterGen)
+func (c *cache) fillCounter(ctx context.Context, key string, gen string, count int64, expiration time.Duration) (bool, error) {
+	filled, err := fillCounterScript.Run(ctx, c, counterKeys(key), gen, count, expiration.Milliseconds()).Int()
+	return filled == 1, err
+}
+
+func (c *cache) getList(ctx context.Context, q *Query, objMap map[string]interface{}, dest interface{}, opts *SelectOptions) (err error) {
+	d(ctx, "getList")
 	keyName := q.getKeyNameSelectOpts(objMap, opts)
 	keyNameMetadata := q.getKeyNameMetadata(objMap)
 
+	ctx, span := startSpan(ctx, "storage.cache.getList", Field{Key: FieldCacheKey, Value: keyName})
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	/*
 		There's an invalidation issue where if the metadata key gets deleted (expired) then this key might be out of date as well.
 		Check to see if the metadata key exists first and if not then throw a redis.Nil
@@ -55,66 +257,87 @@ func (c *cache) getList(ctx context.Context, q *Query, objMap map[string]interfa
 		return redis.Nil
 	}
 
-	err = c.get(ctx, keyName, dest)
+	err = c.get(ctx, keyName, dest, q.encoder)
 	if err != nil {
 		return err // most likely a redis.Nil
 	}
 
-	d("getList() doing setList check")
+	if q.SoftTTL > 0 {
+		// setting the page again would make it fresh & extend its hard TTL; it's refreshed from the db instead (see revalidate)
+		return nil
+	}
+
+	d(ctx, "getList() doing setList check")
 	go func() {
-		// new ctx so we don't have any cancellations
-		c.setList(q, objMap, dest, opts)
+		// detached so we don't have any cancellations
+		c.setList(detach(ctx), q, objMap, dest, opts)
 	}()
 	return nil
 }
 
 // setList updates the list's metadata to make sure it's up to date. This is idempotent
-func (c *cache) setList(q *Query, objMap map[string]interface{}, dest interface{}, opts *SelectOptions) error {
-	ctx := context.Background()
-
-	d("setList")
+func (c *cache) setList(ctx context.Context, q *Query, objMap map[string]interface{}, dest interface{}, opts *SelectOptions) (err error) {
+	d(ctx, "setList")
 	keyNameMetadata := q.getKeyNameMetadata(objMap)
 	keyName := q.getKeyNameSelectOpts(objMap, opts)
-	d("setList() keyNameMetadata: %s\n keyName: %s\n", keyNameMetadata, keyName)
+
+	ctx, span := startSpan(ctx, "storage.cache.setList", Field{Key: FieldCacheKey, Value: keyName})
+	defer func() {
+		endSpan(span, err)
+	}()
+	d(ctx, "setList() keyNameMetadata: %s\n keyName: %s\n", keyNameMetadata, keyName)
 
 	// first and foremost, set the key. Note: if this is being called from getLists then setting this is ok because we update the TTL
-	c.set(ctx, keyName, dest, q.CacheTTL)
+	if c.set(ctx, keyName, dest, q.ttl(), q.encoder) == nil {
+		observe(ctx, Event{Type: EventCacheSet, Action: CacheSet})
+	}
+	c.markFresh(ctx, q, keyName)
 
-	d("setList() checking if exists")
+	d(ctx, "setList() checking if exists")
 	exists, err := c.Exists(ctx, keyNameMetadata).Result()
 	if err != nil {
-		d("setList() error: %+v", err)
+		d(ctx, "setList() error: %+v", err)
 		return err
 	}
 
 	// if the key doesn't exist, we need to create it & just push
 	if exists == 0 {
-		d("setList() key doesn't exist, so we're going to create it and push")
-		return c.RPush(ctx, keyNameMetadata, keyName).Err()
+		d(ctx, "setList() key doesn't exist, so we're going to create it and push")
+		return c.push(ctx, keyNameMetadata, false, []interface{}{keyName}, q.ttl())
 	}
 
-	d("setList() key exists, so we're going to update it")
+	d(ctx, "setList() key exists, so we're going to update it")
 	_, err = c.LPos(ctx, keyNameMetadata, keyName, redis.LPosArgs{}).Result()
 	if err != nil {
 		if err == redis.Nil {
-			d("setList() key doesn't exist in the metadata, so we're going to create it and push")
-			return c.RPush(ctx, keyNameMetadata, keyName).Err()
+			d(ctx, "setList() key doesn't exist in the metadata, so we're going to create it and push")
+			return c.push(ctx, keyNameMetadata, false, []interface{}{keyName}, q.ttl())
 		}
 	}
 	return err
 }
 
-func (c *cache) updateList(q *Query, objMap map[string]interface{}) error {
-	d("updateList")
+func (c *cache) updateList(ctx context.Context, q *Query, objMap map[string]interface{}) (err error) {
+	d(ctx, "updateList")
 	// As Logan says: deleting the key is never the wrong move.
-	ctx := context.Background()
 	keyNameMeta := q.getKeyNameMetadata(objMap)
+
+	ctx, span := startSpan(ctx, "storage.cache.updateList", Field{Key: FieldCacheKey, Value: keyNameMeta})
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	res, err := c.LRange(ctx, keyNameMeta, 0, -1).Result()
 	if err != nil {
 		return err
 	}
 
 	res = append(res, keyNameMeta)
-	d("updateList() deleting: %+v", res)
-	return c.Del(ctx, res...).Err()
+	d(ctx, "updateList() deleting: %+v", res)
+	deleted, err := c.Del(ctx, res...).Result()
+	if err != nil {
+		return err
+	}
+	observe(ctx, Event{Type: EventInvalidation, Count: int(deleted)})
+	return nil
 }
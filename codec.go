@@ -0,0 +1,369 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+/*
+	Codec encodes & decodes the values that are stored in the cache. It's set per Table (see Table.Codec) and defaults to JSONCodec.
+
+	Every value in the cache that isn't json is prefixed with the Marker of the codec that wrote it. This way a value can always be
+	read, even if it was written with a different codec (e.g. during a rolling deploy that switches a table from JSONCodec to
+	MsgpackCodec). json is written as is so the values of the default codec are the same as before there were markers & can still
+	be read by an older version of the library (or redis-cli) during a deploy.
+*/
+type Codec interface {
+	// Marker is the byte that prefixes every value encoded by this codec; it must be unique to the codec
+	Marker() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// markers for the codecs in this package. Note: these can never be the first byte of a json value. JSONCodec's isn't written but
+// values that were written with it are still read
+const (
+	codecMarkerJSON    byte = 0x01
+	codecMarkerMsgpack byte = 0x02
+	codecMarkerProto   byte = 0x03
+)
+
+var (
+	// JSONCodec encodes values with encoding/json
+	JSONCodec Codec = jsonCodec{}
+
+	// MsgpackCodec encodes values with msgpack using the json tags of the struct
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marker() byte {
+	return codecMarkerJSON
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes numbers in maps & interface{}s as json.Number so big ints (e.g. an id > 2^53) don't lose precision
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marker() byte {
+	return codecMarkerMsgpack
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+
+	err := enc.Encode(v)
+	return buf.Bytes(), err
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+
+	return dec.Decode(v)
+}
+
+/*
+	NewProtoCodec returns a codec that stores values as the proto message returned by newMessage e.g.
+
+		storage.NewProtoCodec(func() proto.Message { return &pb.Lead{} })
+
+	The message's field names (not json names) must match the json tags of the Table.Struct e.g. `lead_id`. Values that aren't a
+	proto.Message are converted to the message through protojson, and lists of rows (e.g. cached SelectAll pages) are stored as
+	repeated bytes of messages.
+*/
+func NewProtoCodec(newMessage func() proto.Message) Codec {
+	return &protoCodec{
+		newMessage: newMessage,
+	}
+}
+
+type protoCodec struct {
+	newMessage func() proto.Message
+}
+
+// protoCodecListField is the field number of the repeated bytes that a list of rows is stored as
+const protoCodecListField protowire.Number = 1
+
+// protoCodecListPrefix prefixes a list of rows so it isn't mistaken for a single message
+const protoCodecListPrefix byte = 0x00
+
+func (c *protoCodec) Marker() byte {
+	return codecMarkerProto
+}
+
+func (c *protoCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Marshal(m)
+	}
+
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() == reflect.Slice {
+		b := []byte{protoCodecListPrefix}
+		for i := 0; i < rv.Len(); i++ {
+			item, err := c.marshalMessage(rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			b = protowire.AppendTag(b, protoCodecListField, protowire.BytesType)
+			b = protowire.AppendBytes(b, item)
+		}
+		return b, nil
+	}
+
+	return c.marshalMessage(v)
+}
+
+func (c *protoCodec) marshalMessage(v interface{}) ([]byte, error) {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Marshal(m)
+	}
+
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	m := c.newMessage()
+	err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(j, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(m)
+}
+
+func (c *protoCodec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+
+	if len(data) != 0 && data[0] == protoCodecListPrefix {
+		items := []interface{}{}
+		b := data[1:]
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 || num != protoCodecListField || typ != protowire.BytesType {
+				return errors.New("proto codec: malformed list")
+			}
+			b = b[n:]
+
+			item, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return errors.New("proto codec: malformed list")
+			}
+			b = b[n:]
+
+			m, err := c.unmarshalMap(item)
+			if err != nil {
+				return err
+			}
+			items = append(items, m)
+		}
+
+		j, err := json.Marshal(items)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(j, v)
+	}
+
+	m, err := c.unmarshalMap(data)
+	if err != nil {
+		return err
+	}
+
+	j, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
+
+// unmarshalMap unmarshals a message into a map keyed by the message's field names
+func (c *protoCodec) unmarshalMap(data []byte) (map[string]interface{}, error) {
+	msg := c.newMessage()
+	err := proto.Unmarshal(data, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	m := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+	err = dec.Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+
+	// protojson writes 64 bit ints as strings; turn them back into numbers so they unmarshal into the struct's ints
+	fields := msg.ProtoReflect().Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.IsList() || fd.IsMap() {
+			continue
+		}
+
+		switch fd.Kind() {
+		case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+			protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+			if str, ok := m[string(fd.Name())].(string); ok {
+				m[string(fd.Name())] = json.Number(str)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+/*
+	encoder encodes & decodes the cached values of a query with its table's codec. If the query has a CompressAbove then
+	encoded values larger than it are compressed as well.
+*/
+type encoder struct {
+	codec Codec
+
+	compressor    Compressor
+	compressAbove int
+	stats         *compressionStats
+}
+
+func newEncoder(codec Codec) *encoder {
+	if codec == nil {
+		codec = JSONCodec
+	}
+
+	return &encoder{
+		codec: codec,
+	}
+}
+
+// encode marshals v with the codec & prefixes it with the codec's marker unless it's json. It's then compressed if it's over compressAbove
+func (e *encoder) encode(v interface{}) ([]byte, error) {
+	b, err := e.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.codec.Marker() != codecMarkerJSON {
+		b = append([]byte{e.codec.Marker()}, b...)
+	}
+
+	if e.compressor == nil || e.compressAbove <= 0 || len(b) <= e.compressAbove {
+		return b, nil
+	}
+
+	compressed, err := e.compressor.Compress(b)
+	if err != nil {
+		return nil, err
+	}
+
+	compressed = append([]byte{e.compressor.Marker()}, compressed...)
+	if e.stats != nil {
+		e.stats.add(len(b), len(compressed))
+	}
+
+	if len(compressed) >= len(b) {
+		// compressing didn't help so don't make reads pay for it
+		return b, nil
+	}
+	return compressed, nil
+}
+
+/*
+	decode looks at the marker of data to figure out which codec wrote it & unmarshals it into v. Compressed values are decompressed
+	first. A value this encoder can't read (e.g. it was written with a proto codec or by a newer version during a rolling deploy) is a
+	redis.Nil so it's read from the db & overwritten like any other miss.
+*/
+func (e *encoder) decode(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return errors.New("cannot decode an empty value")
+	}
+
+	if isCompressorMarker(data[0]) {
+		var err error
+		data, err = e.decompress(data)
+		if err != nil {
+			return err
+		}
+
+		if len(data) == 0 {
+			return errors.New("cannot decode an empty value")
+		}
+	}
+
+	switch data[0] {
+	case e.codec.Marker():
+		return e.codec.Unmarshal(data[1:], v)
+	case codecMarkerJSON:
+		return JSONCodec.Unmarshal(data[1:], v)
+	case codecMarkerMsgpack:
+		return MsgpackCodec.Unmarshal(data[1:], v)
+	case codecMarkerProto:
+		// only the table's own proto codec can read it
+		return redis.Nil
+	}
+
+	if isUnknownMarker(data[0]) {
+		return redis.Nil
+	}
+
+	// json isn't marked
+	return JSONCodec.Unmarshal(data, v)
+}
+
+// decompress finds the compressor of data by its marker & decompresses it
+func (e *encoder) decompress(data []byte) ([]byte, error) {
+	switch {
+	case e.compressor != nil && data[0] == e.compressor.Marker():
+		return e.compressor.Decompress(data[1:])
+	case data[0] == compressorMarkerGzip:
+		return GzipCompressor.Decompress(data[1:])
+	case data[0] == compressorMarkerFlate:
+		return FlateCompressor.Decompress(data[1:])
+	}
+	// e.g. a compressor registered by a newer version
+	return nil, redis.Nil
+}
+
+// isUnknownMarker returns whether b is a marker that isn't one of ours; a json value (from before markers) can't start with a control character
+func isUnknownMarker(b byte) bool {
+	switch b {
+	case ' ', '\t', '\n', '\r':
+		return false
+	}
+	return b < 0x20
+}
+
+// isProtoCodec returns true if the codec can only store rows of a table
+func isProtoCodec(codec Codec) bool {
+	_, ok := codec.(*protoCodec)
+	return ok
+}
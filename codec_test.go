@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+type codecLead struct {
+	LeadID int64             `json:"lead_id"`
+	Name   string            `json:"name"`
+	Tags   []string          `json:"tags"`
+	Meta   map[string]string `json:"meta"`
+}
+
+var codecLeadRow = codecLead{LeadID: 1<<53 + 1, Name: "Jane Doe", Tags: []string{"OPEN"}, Meta: map[string]string{"stage": "demo"}}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec, MsgpackCodec} {
+		enc := newEncoder(codec)
+
+		b, err := enc.encode(codecLeadRow)
+		if err != nil {
+			t.Fatalf("%T: encode: %s", codec, err)
+		}
+		if want := codec.Marker(); codec == JSONCodec && b[0] != '{' || codec != JSONCodec && b[0] != want {
+			t.Errorf("%T: the value starts with %#x, want %#x", codec, b[0], want)
+		}
+
+		var got codecLead
+		err = enc.decode(b, &got)
+		if err != nil {
+			t.Fatalf("%T: decode: %s", codec, err)
+		}
+		if !reflect.DeepEqual(got, codecLeadRow) {
+			t.Errorf("%T: decode = %+v, want %+v", codec, got, codecLeadRow)
+		}
+	}
+}
+
+// json is cached as is so it's the same as before there were markers; a value marked as json is still read
+func TestCodecJSONIsUnmarked(t *testing.T) {
+	b, err := newEncoder(nil).encode(codecLeadRow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"lead_id":9007199254740993,"name":"Jane Doe","tags":["OPEN"],"meta":{"stage":"demo"}}`; string(b) != want {
+		t.Errorf("encode = %s, want %s", b, want)
+	}
+
+	for _, data := range [][]byte{b, append([]byte{codecMarkerJSON}, b...)} {
+		for _, codec := range []Codec{JSONCodec, MsgpackCodec} {
+			var got codecLead
+			err = newEncoder(codec).decode(data, &got)
+			if err != nil || !reflect.DeepEqual(got, codecLeadRow) {
+				t.Errorf("%T decode(%q) = %+v, %v", codec, data, got, err)
+			}
+		}
+	}
+}
+
+// a value written by one codec is read by a table using the other e.g. during a rolling deploy that switches codecs
+func TestCodecReadsOtherMarkers(t *testing.T) {
+	codecs := []Codec{JSONCodec, MsgpackCodec}
+	for _, writer := range codecs {
+		for _, reader := range codecs {
+			b, err := newEncoder(writer).encode(codecLeadRow)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got codecLead
+			err = newEncoder(reader).decode(b, &got)
+			if err != nil {
+				t.Fatalf("%T reading %T: %s", reader, writer, err)
+			}
+			if !reflect.DeepEqual(got, codecLeadRow) {
+				t.Errorf("%T reading %T = %+v, want %+v", reader, writer, got, codecLeadRow)
+			}
+		}
+	}
+}
+
+// values cached before there were markers are plain json
+func TestCodecReadsUnmarkedJSON(t *testing.T) {
+	for _, data := range []string{
+		`{"lead_id":9007199254740993,"name":"Jane Doe","tags":["OPEN"],"meta":{"stage":"demo"}}`,
+		` {"lead_id":9007199254740993,"name":"Jane Doe","tags":["OPEN"],"meta":{"stage":"demo"}}`,
+		"\n{\"lead_id\":9007199254740993,\"name\":\"Jane Doe\",\"tags\":[\"OPEN\"],\"meta\":{\"stage\":\"demo\"}}",
+	} {
+		var got codecLead
+		err := newEncoder(MsgpackCodec).decode([]byte(data), &got)
+		if err != nil {
+			t.Fatalf("decode(%q): %s", data, err)
+		}
+		if !reflect.DeepEqual(got, codecLeadRow) {
+			t.Errorf("decode(%q) = %+v, want %+v", data, got, codecLeadRow)
+		}
+	}
+}
+
+// a value this encoder can't read is a miss so it's read from the db & overwritten
+func TestCodecUnknownMarkerIsMiss(t *testing.T) {
+	cases := map[string][]byte{
+		"proto":                    append([]byte{codecMarkerProto}, 0x08, 0x01),
+		"unknown codec":            {0x07, '{', '}'},
+		"unknown compressor":       {0x1f, 0x00, 0x01},
+		"compressed unknown codec": gzipped(t, []byte{0x07, '{', '}'}),
+	}
+
+	for name, data := range cases {
+		var got codecLead
+		err := newEncoder(JSONCodec).decode(data, &got)
+		if err != redis.Nil {
+			t.Errorf("%s: decode = %v, want redis.Nil", name, err)
+		}
+	}
+}
+
+func TestCodecEmptyValue(t *testing.T) {
+	var got codecLead
+	err := newEncoder(JSONCodec).decode(nil, &got)
+	if err == nil || err == redis.Nil {
+		t.Errorf("decode of an empty value = %v, want an error", err)
+	}
+}
+
+func TestIsUnknownMarker(t *testing.T) {
+	for b := 0; b < 256; b++ {
+		want := b < 0x20 && b != ' ' && b != '\t' && b != '\n' && b != '\r'
+		if got := isUnknownMarker(byte(b)); got != want {
+			t.Errorf("isUnknownMarker(%#x) = %v, want %v", b, got, want)
+		}
+	}
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	compressed, err := GzipCompressor.Compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte{GzipCompressor.Marker()}, compressed...)
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+/*
+	Compressor compresses cached values that are larger than a query's CompressAbove; see Query.Compressor.
+
+	A compressed value is prefixed with the compressor's Marker so it's detected & decompressed automatically when it's read,
+	regardless of the query's current settings. Markers must be between 0x10 and 0x1f so they don't collide with a Codec's marker.
+*/
+type Compressor interface {
+	Marker() byte
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// markers for the compressors in this package
+const (
+	compressorMarkerMin   byte = 0x10
+	compressorMarkerGzip  byte = 0x10
+	compressorMarkerFlate byte = 0x11
+	compressorMarkerMax   byte = 0x1f
+)
+
+var (
+	// GzipCompressor compresses values with compress/gzip
+	GzipCompressor Compressor = gzipCompressor{}
+
+	// FlateCompressor compresses values with compress/flate; it's gzip without the header & checksum
+	FlateCompressor Compressor = flateCompressor{}
+)
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Marker() byte {
+	return compressorMarkerGzip
+}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	return buf.Bytes(), err
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+type flateCompressor struct{}
+
+func (flateCompressor) Marker() byte {
+	return compressorMarkerFlate
+}
+
+func (flateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	return buf.Bytes(), err
+}
+
+func (flateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// CompressionStats are the totals for the values that were over their query's CompressAbove
+type CompressionStats struct {
+	Compressed   int64 // number of values that were compressed
+	Uncompressed int64 // number of values that were left uncompressed because compressing didn't make them smaller
+	BytesIn      int64 // bytes of the compressed values before compression
+	BytesOut     int64 // bytes of the compressed values after compression
+}
+
+// BytesSaved is the number of bytes that compression kept out of the cache
+func (c CompressionStats) BytesSaved() int64 {
+	return c.BytesIn - c.BytesOut
+}
+
+// compressionStats is the CompressionStats that's updated concurrently
+type compressionStats struct {
+	compressed   int64
+	uncompressed int64
+	bytesIn      int64
+	bytesOut     int64
+}
+
+func (c *compressionStats) add(in int, out int) {
+	if out >= in {
+		atomic.AddInt64(&c.uncompressed, 1)
+		return
+	}
+
+	atomic.AddInt64(&c.compressed, 1)
+	atomic.AddInt64(&c.bytesIn, int64(in))
+	atomic.AddInt64(&c.bytesOut, int64(out))
+}
+
+func (c *compressionStats) snapshot() CompressionStats {
+	return CompressionStats{
+		Compressed:   atomic.LoadInt64(&c.compressed),
+		Uncompressed: atomic.LoadInt64(&c.uncompressed),
+		BytesIn:      atomic.LoadInt64(&c.bytesIn),
+		BytesOut:     atomic.LoadInt64(&c.bytesOut),
+	}
+}
+
+// isCompressorMarker returns true if b is in the range of bytes reserved for compressors
+func isCompressorMarker(b byte) bool {
+	return b >= compressorMarkerMin && b <= compressorMarkerMax
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompressorRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("called about the renewal; follow up next week. ", 20))
+
+	for _, c := range []Compressor{GzipCompressor, FlateCompressor} {
+		compressed, err := c.Compress(data)
+		if err != nil {
+			t.Fatalf("%T: Compress: %s", c, err)
+		}
+		if len(compressed) >= len(data) {
+			t.Errorf("%T: compressed %d bytes to %d", c, len(data), len(compressed))
+		}
+
+		got, err := c.Decompress(compressed)
+		if err != nil {
+			t.Fatalf("%T: Decompress: %s", c, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%T: Decompress = %q, want %q", c, got, data)
+		}
+	}
+}
+
+func TestEncoderCompressAbove(t *testing.T) {
+	small := codecLead{LeadID: 1, Name: "Jane Doe"}
+	big := codecLead{LeadID: 1, Name: strings.Repeat("Jane Doe ", 100)}
+
+	cases := []struct {
+		name       string
+		compressor Compressor
+		row        codecLead
+		compressed bool
+	}{
+		{name: "gzip over", compressor: GzipCompressor, row: big, compressed: true},
+		{name: "flate over", compressor: FlateCompressor, row: big, compressed: true},
+		{name: "gzip under", compressor: GzipCompressor, row: small},
+		{name: "flate under", compressor: FlateCompressor, row: small},
+	}
+
+	for _, codec := range []Codec{JSONCodec, MsgpackCodec} {
+		for _, c := range cases {
+			stats := &compressionStats{}
+			enc := newEncoder(codec)
+			enc.compressor = c.compressor
+			enc.compressAbove = 64
+			enc.stats = stats
+
+			b, err := enc.encode(c.row)
+			if err != nil {
+				t.Fatalf("%T %s: encode: %s", codec, c.name, err)
+			}
+
+			wantMarker := codec.Marker()
+			if codec == JSONCodec {
+				wantMarker = '{'
+			}
+			if c.compressed {
+				wantMarker = c.compressor.Marker()
+			}
+			if b[0] != wantMarker {
+				t.Errorf("%T %s: the value starts with %#x, want %#x", codec, c.name, b[0], wantMarker)
+			}
+
+			// any encoder reads it no matter its compressor since it's found by the marker
+			for _, reader := range []*encoder{enc, newEncoder(JSONCodec)} {
+				var got codecLead
+				err = reader.decode(b, &got)
+				if err != nil {
+					t.Fatalf("%T %s: decode: %s", codec, c.name, err)
+				}
+				if !reflect.DeepEqual(got, c.row) {
+					t.Errorf("%T %s: decode = %+v, want %+v", codec, c.name, got, c.row)
+				}
+			}
+
+			if snapshot := stats.snapshot(); c.compressed && (snapshot.Compressed != 1 || snapshot.BytesSaved() <= 0) {
+				t.Errorf("%T %s: stats = %+v, want a compressed value", codec, c.name, snapshot)
+			}
+		}
+	}
+}
+
+// a value that doesn't get smaller is cached uncompressed so reads don't pay for decompressing it
+func TestEncoderSkipsCompressionThatDoesntHelp(t *testing.T) {
+	stats := &compressionStats{}
+	enc := newEncoder(JSONCodec)
+	enc.compressor = GzipCompressor
+	enc.compressAbove = 1
+	enc.stats = stats
+
+	b, err := enc.encode("x9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `"x9"` {
+		t.Errorf("encode = %q, want the json as is", b)
+	}
+
+	if snapshot := stats.snapshot(); snapshot.Uncompressed != 1 || snapshot.Compressed != 0 || snapshot.BytesSaved() != 0 {
+		t.Errorf("stats = %+v, want 1 uncompressed", snapshot)
+	}
+}
+
+func TestIsCompressorMarker(t *testing.T) {
+	for b := 0; b < 256; b++ {
+		want := b >= 0x10 && b <= 0x1f
+		if got := isCompressorMarker(byte(b)); got != want {
+			t.Errorf("isCompressorMarker(%#x) = %v, want %v", b, got, want)
+		}
+	}
+
+	for _, c := range []Compressor{GzipCompressor, FlateCompressor} {
+		if !isCompressorMarker(c.Marker()) {
+			t.Errorf("%T's marker %#x isn't a compressor marker", c, c.Marker())
+		}
+	}
+	for _, c := range []Codec{JSONCodec, MsgpackCodec} {
+		if isCompressorMarker(c.Marker()) {
+			t.Errorf("%T's marker %#x collides with the compressors'", c, c.Marker())
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+	Read-your-writes: with a read replica, a cache miss right after a write can be read from a replica that hasn't replayed the
+	write yet and then that stale row is cached. With Config.Consistency set, every write records the primary's WAL position (LSN)
+	and a cache miss only reads from the replica once it has replayed the latest write. Otherwise the miss either goes to the
+	primary (ConsistencyPrimary) or waits up to Config.ReplicaWaitTimeout for the replica (ConsistencyWaitForReplica) and then
+	goes to the primary. Either way nothing read from a lagging replica is cached.
+
+	The latest write is known per Storage (i.e. per instance of the service). To be consistent with writes made by another
+	instance (e.g. the previous request of the same user went to another pod), use WithConsistency for the request's ctx & pass
+	ConsistencyToken along to the next request which resumes it with WithConsistencyToken.
+*/
+
+type ConsistencyMode int32
+
+const (
+	ConsistencyOff            ConsistencyMode = iota // reads always go to a read replica
+	ConsistencyPrimary                               // misses go to the primary while the replica is behind
+	ConsistencyWaitForReplica                        // misses wait for the replica to catch up & then go to the primary
+)
+
+const (
+	// defaultReplicaWaitTimeout is how long ConsistencyWaitForReplica waits for the replica if Config.ReplicaWaitTimeout isn't set
+	defaultReplicaWaitTimeout = 500 * time.Millisecond
+	// replicaPollInterval is how often the replica's replay LSN is checked while waiting for it
+	replicaPollInterval = 10 * time.Millisecond
+
+	// replicaNotReplaying is the LSN of a read connection that isn't a replica (e.g. the primary in development); it's always caught up
+	replicaNotReplaying = math.MaxUint64
+)
+
+type consistencyKey struct{}
+
+// consistencyToken is the LSN of the latest write made with a ctx
+type consistencyToken struct {
+	mu  sync.Mutex
+	lsn uint64
+}
+
+func (t *consistencyToken) get() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lsn
+}
+
+func (t *consistencyToken) set(lsn uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if lsn > t.lsn {
+		t.lsn = lsn
+	}
+}
+
+// WithConsistency returns a ctx whose writes are recorded so reads made with it afterwards are consistent with them
+func WithConsistency(ctx context.Context) context.Context {
+	if tokenFromContext(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, consistencyKey{}, &consistencyToken{})
+}
+
+// WithConsistencyToken is WithConsistency resumed from a ConsistencyToken e.g. one from a previous request
+func WithConsistencyToken(ctx context.Context, token string) (context.Context, error) {
+	ctx = WithConsistency(ctx)
+	if token == "" {
+		return ctx, nil
+	}
+
+	lsn, err := parseLSN(token)
+	if err != nil {
+		return ctx, err
+	}
+	tokenFromContext(ctx).set(lsn)
+	return ctx, nil
+}
+
+// ConsistencyToken returns the position of the latest write made with the ctx (see WithConsistency); "" if there isn't one
+func ConsistencyToken(ctx context.Context) string {
+	t := tokenFromContext(ctx)
+	if t == nil || t.get() == 0 {
+		return ""
+	}
+	return formatLSN(t.get())
+}
+
+func tokenFromContext(ctx context.Context) *consistencyToken {
+	t, _ := ctx.Value(consistencyKey{}).(*consistencyToken)
+	return t
+}
+
+// parseLSN parses a postgres pg_lsn e.g. `16/B374D848`
+func parseLSN(s string) (uint64, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid lsn %s", s)
+	}
+	hi, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lsn %s: %s", s, err)
+	}
+	lo, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid lsn %s: %s", s, err)
+	}
+	return hi<<32 | lo, nil
+}
+
+func formatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", lsn>>32, lsn&0xFFFFFFFF)
+}
+
+// storeMax sets addr to value if it's larger
+func storeMax(addr *uint64, value uint64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if value <= old || atomic.CompareAndSwapUint64(addr, old, value) {
+			return
+		}
+	}
+}
+
+// recordWrite records the primary's current LSN after a write (for the Storage & the ctx's token)
+func (db *db) recordWrite(ctx context.Context) {
+	if db.consistency == ConsistencyOff {
+		return
+	}
+
+	var lsn string
+	err := db.writeConnection.QueryRowContext(ctx, "select pg_current_wal_lsn()::text").Scan(&lsn)
+	if err != nil {
+		logError(ctx, "error getting the lsn of a write", err)
+		return
+	}
+
+	position, err := parseLSN(lsn)
+	if err != nil {
+		logError(ctx, "error getting the lsn of a write", err)
+		return
+	}
+
+	storeMax(&db.lastWriteLSN, position)
+	if t := tokenFromContext(ctx); t != nil {
+		t.set(position)
+	}
+}
+
+// consistentReadConn returns the connection for reading on a cache miss; it's only picked once it's used so cache hits don't wait
+func (db *db) consistentReadConn(ctx context.Context) InsertInterface {
+	if db.consistency == ConsistencyOff {
+		return db.readConn(ctx)
+	}
+	return &consistentConn{db: db, ctx: ctx}
+}
+
+type consistentConn struct {
+	db   *db
+	ctx  context.Context
+	once sync.Once
+	conn InsertInterface
+}
+
+func (c *consistentConn) NamedQuery(query string, arg interface{}) (*sqlx.Rows, error) {
+	c.once.Do(func() {
+		c.conn = c.db.readConnAfterWrites(c.ctx)
+	})
+	return c.conn.NamedQuery(query, arg)
+}
+
+// readConnAfterWrites returns a replica if it has replayed the latest write (of the Storage or the ctx) & otherwise the primary
+func (db *db) readConnAfterWrites(ctx context.Context) InsertInterface {
+	r := db.replicas.pick()
+	if r == nil {
+		d(ctx, "no healthy read replicas; reading from the primary")
+		return db.writeConn()
+	}
+
+	need := atomic.LoadUint64(&db.lastWriteLSN)
+	if t := tokenFromContext(ctx); t != nil && t.get() > need {
+		need = t.get()
+	}
+
+	if need == 0 || r.caughtUp(ctx, need) {
+		return r.conn
+	}
+
+	if db.consistency == ConsistencyWaitForReplica && db.waitForReplica(ctx, r, need) {
+		return r.conn
+	}
+
+	d(ctx, "replica is behind %s; reading from the primary", formatLSN(need))
+	return db.writeConn()
+}
+
+// caughtUp returns whether the replica has replayed lsn; the replica is only asked if it wasn't caught up the last time
+func (r *replica) caughtUp(ctx context.Context, lsn uint64) bool {
+	if atomic.LoadUint64(&r.replayLSN) >= lsn {
+		return true
+	}
+
+	replayed, err := r.replayedLSN(ctx)
+	if err != nil {
+		logError(ctx, "error getting the replica's replay lsn", err)
+		return false
+	}
+	storeMax(&r.replayLSN, replayed)
+	return replayed >= lsn
+}
+
+// waitForReplica polls the replica until it has replayed lsn; false if it hasn't by the ReplicaWaitTimeout
+func (db *db) waitForReplica(ctx context.Context, r *replica, lsn uint64) bool {
+	ctx, cancel := context.WithTimeout(ctx, db.replicaWaitTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(replicaPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+			if r.caughtUp(ctx, lsn) {
+				return true
+			}
+		}
+	}
+}
+
+// replayedLSN returns the LSN the replica has replayed up to
+func (r *replica) replayedLSN(ctx context.Context) (uint64, error) {
+	var lsn sql.NullString
+	err := r.conn.QueryRowContext(ctx, "select pg_last_wal_replay_lsn()::text").Scan(&lsn)
+	if err != nil {
+		return 0, err
+	}
+	if !lsn.Valid {
+		// NULL means it isn't a replica
+		return replicaNotReplaying, nil
+	}
+	if lsn.String == "" {
+		return 0, errors.New("replica returned an empty lsn")
+	}
+	return parseLSN(lsn.String)
+}
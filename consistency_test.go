@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseLSN(t *testing.T) {
+	cases := []struct {
+		lsn  string
+		want uint64
+		err  bool
+	}{
+		{lsn: "0/0", want: 0},
+		{lsn: "0/16B3748", want: 0x16B3748},
+		{lsn: "16/B374D848", want: 0x16_B374D848},
+		{lsn: "16/b374d848", want: 0x16_B374D848},
+		{lsn: "FFFFFFFF/FFFFFFFF", want: 1<<64 - 1},
+		{lsn: "", err: true},
+		{lsn: "16B374D848", err: true},
+		{lsn: "16/B374D848/1", err: true},
+		{lsn: "1G/0", err: true},
+		{lsn: "0/100000000", err: true},
+		{lsn: "-1/0", err: true},
+	}
+
+	for _, c := range cases {
+		got, err := parseLSN(c.lsn)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseLSN(%q) = %d, want an error", c.lsn, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLSN(%q): %s", c.lsn, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parseLSN(%q) = %#x, want %#x", c.lsn, got, c.want)
+		}
+
+		if c.lsn == "16/b374d848" {
+			continue
+		}
+		if formatted := formatLSN(got); formatted != c.lsn {
+			t.Errorf("formatLSN(parseLSN(%q)) = %q", c.lsn, formatted)
+		}
+	}
+}
+
+// LSNs are compared as positions; comparing them as strings gets e.g. `9/0` > `10/0` wrong
+func TestLSNOrder(t *testing.T) {
+	ordered := []string{"0/0", "0/FF", "0/100", "0/FFFFFFFF", "1/0", "9/FFFFFFFF", "10/0", "16/B374D848", "A0/0"}
+
+	for i := 1; i < len(ordered); i++ {
+		a, err := parseLSN(ordered[i-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := parseLSN(ordered[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a >= b {
+			t.Errorf("%s (%d) should be before %s (%d)", ordered[i-1], a, ordered[i], b)
+		}
+	}
+}
+
+func TestStoreMax(t *testing.T) {
+	var lsn uint64
+	for _, v := range []uint64{5, 3, 9, 9, 1} {
+		storeMax(&lsn, v)
+	}
+	if lsn != 9 {
+		t.Errorf("storeMax = %d, want 9", lsn)
+	}
+
+	var wg sync.WaitGroup
+	for i := uint64(0); i < 100; i++ {
+		wg.Add(1)
+		go func(v uint64) {
+			defer wg.Done()
+			storeMax(&lsn, v)
+		}(i)
+	}
+	wg.Wait()
+	if lsn != 99 {
+		t.Errorf("storeMax concurrently = %d, want 99", lsn)
+	}
+}
+
+func TestConsistencyToken(t *testing.T) {
+	ctx := context.Background()
+	if got := ConsistencyToken(ctx); got != "" {
+		t.Errorf("ConsistencyToken without WithConsistency = %q", got)
+	}
+
+	ctx = WithConsistency(ctx)
+	if got := ConsistencyToken(ctx); got != "" {
+		t.Errorf("ConsistencyToken before a write = %q", got)
+	}
+
+	ctx, err := WithConsistencyToken(ctx, "16/B374D848")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ConsistencyToken(ctx); got != "16/B374D848" {
+		t.Errorf("ConsistencyToken = %q, want 16/B374D848", got)
+	}
+
+	// an older token (e.g. from a request that raced this one) doesn't move it back
+	ctx, err = WithConsistencyToken(ctx, "9/FFFFFFFF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ConsistencyToken(ctx); got != "16/B374D848" {
+		t.Errorf("ConsistencyToken after an older token = %q, want 16/B374D848", got)
+	}
+
+	_, err = WithConsistencyToken(context.Background(), "not an lsn")
+	if err == nil {
+		t.Error("WithConsistencyToken of an invalid token should be an error")
+	}
+}
+
+func TestReadConnAfterWrites(t *testing.T) {
+	primary := stubConn(t, "primary", stubRow([]byte("0/0")))
+
+	cases := []struct {
+		name     string
+		mode     ConsistencyMode
+		replayed driver.Value // the replica's pg_last_wal_replay_lsn()
+		written  uint64       // the Storage's latest write
+		token    string       // the ctx's latest write
+		primary  bool
+	}{
+		{name: "no writes", mode: ConsistencyPrimary, replayed: []byte("0/10")},
+		{name: "caught up", mode: ConsistencyPrimary, replayed: []byte("1/0"), written: 0xFFFFFFFF},
+		{name: "behind", mode: ConsistencyPrimary, replayed: []byte("0/FFFFFFFF"), written: 1 << 32, primary: true},
+		{name: "behind the token", mode: ConsistencyPrimary, replayed: []byte("1/0"), written: 1, token: "9/0", primary: true},
+		{name: "caught up to the token", mode: ConsistencyPrimary, replayed: []byte("A/0"), written: 1, token: "9/0"},
+		{name: "not a replica", mode: ConsistencyPrimary, replayed: nil, written: 1 << 40},
+		{name: "wait times out", mode: ConsistencyWaitForReplica, replayed: []byte("0/1"), written: 2, primary: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := &replica{conn: stubConn(t, "replica "+c.name, stubRow(c.replayed)), healthy: 1}
+			db := &db{
+				lastWriteLSN:       c.written,
+				writeConnection:    primary,
+				replicas:           &replicaPool{replicas: []*replica{r}},
+				consistency:        c.mode,
+				replicaWaitTimeout: 30 * time.Millisecond,
+			}
+
+			ctx, err := WithConsistencyToken(context.Background(), c.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := db.readConnAfterWrites(ctx)
+			if c.primary && got != primary {
+				t.Errorf("read from the replica, want the primary")
+			}
+			if !c.primary && got != r.conn {
+				t.Errorf("read from the primary, want the replica")
+			}
+		})
+	}
+}
+
+func TestWaitForReplica(t *testing.T) {
+	conn := stubConn(t, "lagging replica", stubRow([]byte("0/1")))
+	r := &replica{conn: conn, healthy: 1}
+	db := &db{consistency: ConsistencyWaitForReplica, replicaWaitTimeout: time.Second}
+
+	go func() {
+		time.Sleep(3 * replicaPollInterval)
+		stubQuery("lagging replica", stubRow([]byte("0/20")))
+	}()
+
+	if !db.waitForReplica(context.Background(), r, 0x20) {
+		t.Fatal("waitForReplica gave up on a replica that caught up")
+	}
+	if r.replayLSN != 0x20 {
+		t.Errorf("replayLSN = %#x, want 0x20", r.replayLSN)
+	}
+
+	// it's caught up now so the replica isn't asked again
+	stubQuery("lagging replica", stubRow())
+	if !r.caughtUp(context.Background(), 0x10) {
+		t.Error("caughtUp asked the replica for an lsn it had already replayed")
+	}
+}
@@ -3,8 +3,11 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"reflect"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
 )
 
 type InsertInterface interface {
@@ -12,28 +15,49 @@ type InsertInterface interface {
 }
 
 type db struct {
+	// first so it's 64-bit aligned for atomics
+	lastWriteLSN uint64 // the primary's LSN after the latest write; see recordWrite
+
 	writeConnection *sqlx.DB
-	readConnection  *sqlx.DB
+	replicas        *replicaPool
+
+	consistency        ConsistencyMode
+	replicaWaitTimeout time.Duration
 }
 
 func newDB(conf *Config) *db {
+	replicaWaitTimeout := conf.ReplicaWaitTimeout
+	if replicaWaitTimeout == 0 {
+		replicaWaitTimeout = defaultReplicaWaitTimeout
+	}
+
 	return &db{
-		writeConnection: conf.WriteOnlyDbConn,
-		readConnection:  conf.ReadOnlyDbConn,
+		writeConnection:    conf.WriteOnlyDbConn,
+		replicas:           newReplicaPool(conf),
+		consistency:        conf.Consistency,
+		replicaWaitTimeout: replicaWaitTimeout,
 	}
 }
 
-func (db *db) query(ctx context.Context, objMap map[string]interface{}, queryName string, conn InsertInterface) ([]map[string]interface{}, error) {
-	d("queryName: %s\nobjs: %+v\n", queryName, objMap)
+func (db *db) query(ctx context.Context, objMap map[string]interface{}, queryName string, conn InsertInterface) (objs []map[string]interface{}, err error) {
+	d(ctx, "queryName: %s\nobjs: %+v\n", queryName, objMap)
+	ctx, span := startSpan(ctx, "storage.db.query", Field{Key: AttributeDBStatement, Value: queryName})
+	started := time.Now()
+	defer func() {
+		observe(ctx, Event{Type: EventDBQuery, Duration: time.Since(started)})
+		span.SetAttributes(Field{Key: AttributeRows, Value: len(objs)})
+		endSpan(span, err)
+	}()
+
 	// let's now execute the query
-	rows, err := conn.NamedQuery(queryName, objMap)
+	rows, err := conn.NamedQuery(queryName, namedArgs(objMap))
 	if err != nil {
 		return nil, err
 	}
 	// Let's make sure we don't have a memory leak!! :)
 	defer rows.Close()
 
-	objs := []map[string]interface{}{}
+	objs = []map[string]interface{}{}
 
 	for rows.Next() {
 		row := map[string]interface{}{}
@@ -54,10 +78,99 @@ func (db *db) query(ctx context.Context, objMap map[string]interface{}, queryNam
 	return objs, nil
 }
 
+/*
+	queryStructs runs the query & scans each row directly into a new struct of typ (e.g. the Table.Struct) rather than a
+	map[string]interface{}. This keeps the types of the struct's fields so the rows returned from the db are exactly the same as
+	the rows returned from the cache. Columns that aren't in the struct (e.g. from a join) are ignored.
+*/
+func (db *db) queryStructs(ctx context.Context, objMap map[string]interface{}, queryName string, conn InsertInterface, typ reflect.Type) (objs []interface{}, err error) {
+	d(ctx, "queryName: %s\nobjs: %+v\n", queryName, objMap)
+	ctx, span := startSpan(ctx, "storage.db.query", Field{Key: AttributeDBStatement, Value: queryName})
+	started := time.Now()
+	defer func() {
+		observe(ctx, Event{Type: EventDBQuery, Duration: time.Since(started)})
+		span.SetAttributes(Field{Key: AttributeRows, Value: len(objs)})
+		endSpan(span, err)
+	}()
+
+	rows, err := conn.NamedQuery(queryName, namedArgs(objMap))
+	if err != nil {
+		return nil, err
+	}
+	// Let's make sure we don't have a memory leak!! :)
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	traversals := fieldMapper.TraversalsByName(typ, columns)
+
+	objs = []interface{}{}
+	for rows.Next() {
+		v := reflect.New(typ)
+
+		values := make([]interface{}, len(columns))
+		for i, traversal := range traversals {
+			if len(traversal) == 0 {
+				// the column isn't in the struct
+				values[i] = new(interface{})
+				continue
+			}
+
+			field := reflectx.FieldByIndexes(v.Elem(), traversal)
+			if scanner, ok := field.Addr().Interface().(sql.Scanner); ok {
+				values[i] = scanner
+				continue
+			}
+			values[i] = &fieldScanner{field: field}
+		}
+
+		err = rows.Scan(values...)
+		if err != nil {
+			return nil, err
+		}
+
+		objs = append(objs, v.Interface())
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(objs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return objs, nil
+}
+
+// fieldScanner scans a column into a struct field with the same conversions as an objMap e.g. NULL is the zero value
+type fieldScanner struct {
+	field reflect.Value
+}
+
+func (f *fieldScanner) Scan(src interface{}) error {
+	if b, ok := src.([]byte); ok {
+		// the driver can reuse b after the next call to rows.Next() so copy it
+		src = append([]byte(nil), b...)
+	}
+
+	return setValue(f.field, src)
+}
+
 func (db *db) writeConn() *sqlx.DB {
 	return db.writeConnection
 }
 
-func (db *db) readConn() *sqlx.DB {
-	return db.readConnection
+// readConn returns a healthy read replica or the primary if there aren't any
+func (db *db) readConn(ctx context.Context) *sqlx.DB {
+	r := db.replicas.pick()
+	if r == nil {
+		d(ctx, "no healthy read replicas; reading from the primary")
+		return db.writeConnection
+	}
+	return r.conn
 }
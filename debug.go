@@ -3,50 +3,136 @@ package storage
 import (
 	"context"
 	"fmt"
-
-	"github.com/sirupsen/logrus"
+	"time"
 )
 
-var debug *logger
+/*
+	Every public call of a Storage puts its own logger in the ctx (see logger.withContext) and d(ctx, ...) logs with the one in
+	the ctx it's given. Nothing is global so concurrent calls (& Storages with different loggers) don't clobber each other.
+*/
 
-func d(s string, args ...interface{}) {
-	if debug == nil {
-		fmt.Println("debugger not initialized")
-		return
-	}
-	//fmt.Printf(s, args...)
-	debug.debug(s, args...)
+// loggerKey is the ctx key of the logger of the call
+type loggerKey struct{}
+
+// logFieldsKey is the ctx key of the fields set by WithLogFields
+type logFieldsKey struct{}
+
+// WithLogFields adds fields (e.g. the request id) to every line logged by the Storage calls made with ctx
+func WithLogFields(ctx context.Context, fields ...Field) context.Context {
+	merged := append(append([]Field{}, logFields(ctx)...), fields...)
+	return context.WithValue(ctx, logFieldsKey{}, merged)
 }
 
+func logFields(ctx context.Context) []Field {
+	fields, _ := ctx.Value(logFieldsKey{}).([]Field)
+	return fields
+}
+
+// logger is the Config.Logger of a Storage & whether the debugger is on; each call gets a copy with the call's fields (see withContext)
 type logger struct {
-	entry           *logrus.Entry
-	debuggerEnabled bool
+	log   Logger
+	debug bool
+}
+
+func newLogger(conf *Config) *logger {
+	log := conf.Logger
+	if log == nil {
+		log = NopLogger{}
+	}
+	return &logger{
+		log:   log.With(Field{Key: FieldService, Value: conf.ServiceName}),
+		debug: conf.Debugger,
+	}
+}
+
+// withContext returns ctx with the logger of the call; it's this logger with the fields of ctx (see WithLogFields)
+func (l *logger) withContext(ctx context.Context) context.Context {
+	call := &logger{log: l.log, debug: l.debug}
+	if fields := logFields(ctx); len(fields) > 0 {
+		call.log = l.log.With(fields...)
+	}
+	return context.WithValue(ctx, loggerKey{}, call)
+}
+
+// loggerFrom returns the logger of the call; it discards everything if there isn't one
+func loggerFrom(ctx context.Context) *logger {
+	if l, ok := ctx.Value(loggerKey{}).(*logger); ok {
+		return l
+	}
+	return &logger{log: NopLogger{}}
 }
 
-func (l *logger) debug(s string, args ...interface{}) {
-	if l.debuggerEnabled && l.entry != nil {
-		l.entry.Debugf(s, args...)
+// logging returns whether anything logged with ctx goes anywhere so fields that cost something to build (e.g. a key name) can be skipped
+func logging(ctx context.Context) bool {
+	l := loggerFrom(ctx)
+	if l.debug {
+		return true
 	}
+	_, nop := l.log.(NopLogger)
+	return !nop
 }
 
-func (l *logger) WithField(key string, value interface{}) {
-	if l.debuggerEnabled && l.entry != nil {
-		l.entry = l.entry.WithField(key, value)
+// logWith returns ctx with fields (e.g. the query name) added to the logger of the call
+func logWith(ctx context.Context, fields ...Field) context.Context {
+	if !logging(ctx) {
+		// they'd be discarded anyway
+		return ctx
 	}
+
+	l := loggerFrom(ctx)
+	return context.WithValue(ctx, loggerKey{}, &logger{log: l.log.With(fields...), debug: l.debug})
 }
 
-func (l *logger) WithFields(fields logrus.Fields) {
-	if l.debuggerEnabled && l.entry != nil {
-		l.entry = l.entry.WithFields(fields)
+func d(ctx context.Context, s string, args ...interface{}) {
+	l := loggerFrom(ctx)
+	if l.debug {
+		l.log.Debug(fmt.Sprintf(s, args...))
 	}
 }
 
-func (l *logger) clean() {
-	l.entry = nil
+func logInfo(ctx context.Context, msg string, fields ...Field) {
+	loggerFrom(ctx).log.Info(msg, fields...)
+}
+
+// logError is for errors that are logged rather than returned e.g. a failed cache write after the db write succeeded
+func logError(ctx context.Context, msg string, err error, fields ...Field) {
+	loggerFrom(ctx).log.Error(msg, append(fields, Field{Key: FieldError, Value: err})...)
+	observe(ctx, Event{Type: EventError, Err: err})
+}
+
+/*
+	detach returns a ctx that has the values of ctx (e.g. the logger) but isn't canceled when ctx is. It's for the cache
+	writes that should finish even if the caller has gone away
+*/
+func detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
 }
 
-func (l *logger) init(ctx context.Context) {
-	if l.debuggerEnabled {
-		l.entry = logrus.WithContext(ctx)
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+/*
+	withValuesOf returns a ctx that's canceled with ctx but has the values of values e.g. a background refresh is stopped by
+	the refresher but logs with the logger of the read that scheduled it
+*/
+func withValuesOf(ctx context.Context, values context.Context) context.Context {
+	if values == nil {
+		return ctx
 	}
+	return valuesContext{Context: ctx, values: values}
+}
+
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c valuesContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
 }
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testLogger is a Logger that records each line as `level msg key=value...`
+type testLogger struct {
+	mu     *sync.Mutex
+	lines  *[]string
+	fields []Field
+}
+
+func newTestLogger() testLogger {
+	return testLogger{mu: &sync.Mutex{}, lines: &[]string{}}
+}
+
+func (l testLogger) log(level, msg string, fields []Field) {
+	line := level + " " + msg
+	for _, f := range append(append([]Field{}, l.fields...), fields...) {
+		line += fmt.Sprintf(" %s=%v", f.Key, f.Value)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	*l.lines = append(*l.lines, line)
+}
+
+func (l testLogger) Debug(msg string, fields ...Field) { l.log("debug", msg, fields) }
+func (l testLogger) Info(msg string, fields ...Field)  { l.log("info", msg, fields) }
+func (l testLogger) Error(msg string, fields ...Field) { l.log("error", msg, fields) }
+func (l testLogger) With(fields ...Field) Logger {
+	l.fields = append(append([]Field{}, l.fields...), fields...)
+	return l
+}
+
+func (l testLogger) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string{}, *l.lines...)
+}
+
+func TestDebugLoggerPerCall(t *testing.T) {
+	on, off := newTestLogger(), newTestLogger()
+	debugger := newLogger(&Config{Logger: on, Debugger: true, ServiceName: "crm"})
+	quiet := newLogger(&Config{Logger: off, ServiceName: "billing"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			ctx := debugger.withContext(WithLogFields(context.Background(), Field{Key: "request_id", Value: i}))
+			d(ctx, "from the debugger %d", i)
+		}(i)
+		go func() {
+			defer wg.Done()
+			ctx := quiet.withContext(WithLogFields(context.Background(), Field{Key: "request_id", Value: "off"}))
+			d(ctx, "from a Storage without the debugger")
+		}()
+	}
+	wg.Wait()
+
+	lines := on.Lines()
+	if len(lines) != 10 {
+		t.Fatalf("logged %d lines, want 10: %v", len(lines), lines)
+	}
+	for _, line := range lines {
+		var i int
+		_, err := fmt.Sscanf(line, "debug from the debugger %d service=crm request_id=", &i)
+		if err != nil || !strings.HasSuffix(line, fmt.Sprintf("request_id=%d", i)) {
+			t.Errorf("line = %s", line)
+		}
+	}
+	if lines := off.Lines(); len(lines) != 0 {
+		t.Errorf("logged debug lines without the debugger: %v", lines)
+	}
+
+	// a ctx without a logger (e.g. not from a public call) doesn't log or panic
+	d(context.Background(), "nothing")
+	logError(context.Background(), "nothing", errors.New("nothing"))
+}
+
+func TestLogWith(t *testing.T) {
+	log := newTestLogger()
+	ctx := newLogger(&Config{Logger: log, ServiceName: "crm"}).withContext(context.Background())
+
+	ctx = logWith(ctx, Field{Key: FieldQuery, Value: "LeadsGetByID"})
+	logError(ctx, "cache write failed", errors.New("timeout"), Field{Key: FieldCacheKey, Value: "lead_id=4"})
+	logInfo(ctx, "filled")
+
+	want := []string{
+		"error cache write failed service=crm query=LeadsGetByID cache_key=lead_id=4 error=timeout",
+		"info filled service=crm query=LeadsGetByID",
+	}
+	if got := log.Lines(); !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+}
+
+func TestWithLogFields(t *testing.T) {
+	ctx := WithLogFields(context.Background(), Field{Key: "request_id", Value: "1"})
+	child := WithLogFields(ctx, Field{Key: "user_id", Value: 2})
+
+	want := []Field{{Key: "request_id", Value: "1"}, {Key: "user_id", Value: 2}}
+	if got := logFields(child); !reflect.DeepEqual(got, want) {
+		t.Errorf("logFields = %v, want %v", got, want)
+	}
+	// the parent's fields aren't changed
+	if got := logFields(ctx); len(got) != 1 {
+		t.Errorf("logFields of the parent = %v", got)
+	}
+	if got := logFields(context.Background()); got != nil {
+		t.Errorf("logFields of a ctx without any = %v", got)
+	}
+}
+
+type testCtxKey struct{}
+
+func TestDetach(t *testing.T) {
+	parent, cancel := context.WithCancel(context.WithValue(context.Background(), testCtxKey{}, "value"))
+	ctx := detach(parent)
+	cancel()
+
+	if ctx.Err() != nil || ctx.Done() != nil {
+		t.Error("a detached ctx was canceled with its parent")
+	}
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("a detached ctx has a deadline")
+	}
+	if ctx.Value(testCtxKey{}) != "value" {
+		t.Error("a detached ctx doesn't have the values of its parent")
+	}
+}
+
+func TestWithValuesOf(t *testing.T) {
+	values := context.WithValue(context.Background(), testCtxKey{}, "value")
+	stop, cancel := context.WithCancel(context.Background())
+
+	ctx := withValuesOf(stop, values)
+	if ctx.Value(testCtxKey{}) != "value" {
+		t.Error("doesn't have the values")
+	}
+
+	cancel()
+	select {
+	case <-ctx.Done():
+	default:
+		t.Error("wasn't canceled with its ctx")
+	}
+
+	if withValuesOf(stop, nil) != stop {
+		t.Error("withValuesOf without values should be the ctx")
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 type Store interface {
 	SetLead(ctx context.Context, lead *Leads) error
+	DeleteLead(ctx context.Context, id int32) error
 	GetLeadByID(ctx context.Context, id int32) (*Leads, error)
 	GetLeadsByUserID(ctx context.Context, id int32) ([]Leads, error)
 	UpdateLeadsNotes(ctx context.Context, id int32, note string) (*Leads, error)
@@ -19,6 +20,7 @@ type store struct {
 	redis *redis.ClusterClient // note: it's completely acceptable to have a redis client in the store
 	db    *sqlx.DB
 	store storage.Storage
+	leads *storage.Repo[Leads]
 }
 
 type Config struct {
@@ -30,7 +32,7 @@ type Config struct {
 
 func New(conf *Config) Store {
 	tables := []*storage.Table{
-		leadsTable,
+		leadsTable.Table,
 	}
 
 	// instantiate the storage
@@ -40,6 +42,7 @@ func New(conf *Config) Store {
 		Redis:           conf.Redis,
 		Tables:          tables,
 		Debugger:        true,
+		Logger:          storage.NewLogrusLogger(nil),
 		ServiceName:     "basic_service",
 	}
 
@@ -51,6 +54,7 @@ func New(conf *Config) Store {
 	return &store{
 		redis: conf.Redis,
 		store: s,
+		leads: storage.NewRepo[Leads](s),
 		db:    conf.WriteConn,
 	}
 }
@@ -7,30 +7,28 @@ import (
 )
 
 func (s *store) SetLead(ctx context.Context, lead *Leads) error {
-	return s.store.Insert(ctx, lead)
+	return s.leads.Insert(ctx, lead)
+}
+
+func (s *store) DeleteLead(ctx context.Context, id int32) error {
+	return s.leads.Delete(ctx, &Leads{LeadID: id})
 }
 
 func (s *store) GetLeadByID(ctx context.Context, id int32) (*Leads, error) {
-	l := &Leads{
+	return s.leads.Get(ctx, leadsGetByID, Leads{
 		LeadID: id,
-	}
-	return l, s.store.Select(ctx, l, LeadsGetByID)
+	})
 }
 
 func (s *store) GetLeadsByUserID(ctx context.Context, id int32) ([]Leads, error) {
-	l := &Leads{
+	return s.leads.List(ctx, leadsGetByUserID, Leads{
 		UserID: id,
 		Email:  "ssss@asdf.com",
-	}
-
-	leads := []Leads{}
-	err := s.store.SelectAll(ctx, l, &leads, LeadsGetByUserID, &storage.SelectOptions{
+	}, &storage.SelectOptions{
 		Limit:        0,
 		Offset:       0,
 		FetchAllData: true,
 	})
-
-	return leads, err
 }
 
 func (s *store) UpdateLeadsNotes(ctx context.Context, id int32, note string) (*Leads, error) {
@@ -41,5 +39,5 @@ func (s *store) UpdateLeadsNotes(ctx context.Context, id int32, note string) (*L
 
 	lead.Notes = note
 
-	return lead, s.store.Update(ctx, lead)
+	return lead, s.leads.Update(ctx, lead)
 }
@@ -19,15 +19,12 @@ const (
 	DefaultTTL = (3600 * 24 * 7) // 7 days
 )
 
-var leadsTable = &storage.Table{
-	Struct:           Leads{},
-	PrimaryQueryName: LeadsGetByID,
-	PrimaryKeyField:  "lead_id",
-	InsertQuery:      leadsInsert,
-	UpdateQuery:      leadsUpdate,
-	Queries: []*storage.Query{
-		leadsGetByID,
-		leadsGetByUserID,
-	},
+// NewTable sets the Struct to Leads{}; the queries are added to it with leadsTable.Query (see queries_leads.go)
+var leadsTable = storage.NewTable[Leads](&storage.Table{
+	PrimaryQueryName:  LeadsGetByID,
+	PrimaryKeyField:   "lead_id",
+	InsertQuery:       leadsInsert,
+	UpdateQuery:       leadsUpdate,
+	DeleteQuery:       leadsDelete,
 	ReferencedQueries: []*storage.Query{},
-}
+})
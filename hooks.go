@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+/*
+	HookFunc is a hook of a Table (e.g. Table.BeforeInsert) called with a pointer to the table's Struct. Before hooks can change
+	the struct (e.g. set defaults or normalise an email) and returning an error aborts the write. After hooks see the row as it
+	was written or selected; their error is returned to the caller but the write has already happened. Use Hook for a typed one
+*/
+type HookFunc func(ctx context.Context, obj interface{}) error
+
+// Hook returns a HookFunc that calls fn with the struct as a *T e.g. storage.Hook(func(ctx context.Context, l *Leads) error {...})
+func Hook[T any](fn func(ctx context.Context, obj *T) error) HookFunc {
+	return func(ctx context.Context, obj interface{}) error {
+		row, ok := obj.(*T)
+		if !ok {
+			return fmt.Errorf("hook expects a %T; got %T", (*T)(nil), obj)
+		}
+		return fn(ctx, row)
+	}
+}
+
+type hookType int32
+
+const (
+	hookBeforeInsert hookType = iota
+	hookAfterInsert
+	hookBeforeUpdate
+	hookAfterUpdate
+	hookAfterSelect
+)
+
+func (t *Table) hook(h hookType) HookFunc {
+	switch h {
+	case hookBeforeInsert:
+		return t.BeforeInsert
+	case hookAfterInsert:
+		return t.AfterInsert
+	case hookBeforeUpdate:
+		return t.BeforeUpdate
+	case hookAfterUpdate:
+		return t.AfterUpdate
+	case hookAfterSelect:
+		return t.AfterSelect
+	}
+	return nil
+}
+
+/*
+	copyForHook returns a copy of the row obj points to; a Tx's after hooks get a copy since they're run on End and the caller
+	could have reused obj by then
+*/
+func copyForHook(obj interface{}) interface{} {
+	v := reflect.ValueOf(obj)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return obj
+	}
+	c := reflect.New(v.Elem().Type())
+	c.Elem().Set(v.Elem())
+	return c.Interface()
+}
+
+// runHook calls the hook of obj's table if it has one
+func (s *storage) runHook(ctx context.Context, h hookType, obj interface{}) error {
+	table, ok := s.structToTable[getStructName(obj)]
+	if !ok {
+		// the write itself returns the error
+		return nil
+	}
+
+	hook := table.hook(h)
+	if hook == nil {
+		return nil
+	}
+	return hook(ctx, obj)
+}
+
+// afterSelect calls the AfterSelect hook of queryName's table on each row of dest; dest is a pointer to a row or to a slice of rows
+func (s *storage) afterSelect(ctx context.Context, queryName string, dest interface{}) error {
+	table, ok := s.queryToTable[queryName]
+	if !ok || table.AfterSelect == nil {
+		return nil
+	}
+
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return table.AfterSelect(ctx, dest)
+	}
+
+	rows := v.Elem()
+	for i := 0; i < rows.Len(); i++ {
+		row := rows.Index(i)
+		if row.Kind() != reflect.Ptr {
+			row = row.Addr()
+		}
+		err := table.AfterSelect(ctx, row.Interface())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
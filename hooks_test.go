@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHook(t *testing.T) {
+	ctx := context.Background()
+	hook := Hook(func(ctx context.Context, l *benchLead) error {
+		l.Email = strings.ToLower(l.Email)
+		return nil
+	})
+
+	lead := &benchLead{Email: "Jane@Example.com"}
+	if err := hook(ctx, lead); err != nil || lead.Email != "jane@example.com" {
+		t.Errorf("hook = %+v, %v", lead, err)
+	}
+	if err := hook(ctx, benchLead{}); err == nil {
+		t.Error("a hook of a *benchLead got a benchLead without an error")
+	}
+}
+
+func TestCopyForHook(t *testing.T) {
+	lead := &benchLead{LeadID: 4}
+	c := copyForHook(lead).(*benchLead)
+	lead.LeadID = 5
+	if c.LeadID != 4 {
+		t.Errorf("the copy changed with the row; LeadID = %d", c.LeadID)
+	}
+
+	if got := copyForHook(benchLead{LeadID: 4}); !reflect.DeepEqual(got, benchLead{LeadID: 4}) {
+		t.Errorf("copyForHook of a struct = %+v", got)
+	}
+}
+
+// hookRecorder records the calls of the hooks it makes
+type hookRecorder struct {
+	calls []string
+}
+
+func (r *hookRecorder) hook(name string, err error) HookFunc {
+	return Hook(func(ctx context.Context, l *benchLead) error {
+		r.calls = append(r.calls, name+" "+l.Email)
+		return err
+	})
+}
+
+// countQueries counts the queries run with fn
+func countQueries(fn stubFunc, count *int) stubFunc {
+	return func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		*count++
+		return fn(query, args)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	ctx := context.Background()
+	r := &hookRecorder{}
+
+	table := benchLeadsTable()
+	table.BeforeInsert = Hook(func(ctx context.Context, l *benchLead) error {
+		r.calls = append(r.calls, "before insert")
+		l.Name = strings.TrimSpace(l.Name)
+		return nil
+	})
+	table.AfterInsert = r.hook("after insert", nil)
+	table.BeforeUpdate = r.hook("before update", errors.New("not allowed"))
+	table.AfterUpdate = r.hook("after update", nil)
+	table.AfterSelect = r.hook("after select", nil)
+
+	queries := 0
+	s, _ := stubStorage(t, countQueries(benchLeads(1), &queries), table)
+
+	lead := &benchLead{Name: " Jane Doe "}
+	err := s.Insert(ctx, lead)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queries = 0
+	err = s.Update(ctx, lead)
+	if err == nil || err.Error() != "not allowed" {
+		t.Errorf("Update = %v, want the BeforeUpdate error", err)
+	}
+	if queries != 0 {
+		t.Errorf("Update ran %d queries after BeforeUpdate failed", queries)
+	}
+
+	err = s.Select(ctx, &benchLead{LeadID: 1}, "LeadsGetByID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leads := []*benchLead{}
+	err = s.SelectAll(ctx, &benchLead{UserID: 2}, &leads, "LeadsByUser", &SelectOptions{Limit: 10, FetchAllData: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"before insert", "after insert jane@example.com",
+		"before update jane@example.com",
+		"after select jane@example.com", // Select
+		"after select jane@example.com", // SelectAll
+	}
+	if !reflect.DeepEqual(r.calls, want) {
+		t.Errorf("calls = %q, want %q", r.calls, want)
+	}
+}
+
+func TestTxAfterHooks(t *testing.T) {
+	ctx := context.Background()
+	r := &hookRecorder{}
+
+	table := benchLeadsTable()
+	table.AfterInsert = r.hook("after insert", nil)
+
+	commitErr := error(nil)
+	leads := benchLeads(1)
+	s, _ := stubStorage(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if query == "commit" && commitErr != nil {
+			return nil, nil, commitErr
+		}
+		return leads(query, args)
+	}, table)
+
+	tx, err := s.TXBegin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lead := &benchLead{}
+	err = tx.Insert(ctx, lead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.calls) != 0 {
+		t.Fatalf("the after hook ran before End: %q", r.calls)
+	}
+
+	// the hook gets the row as it was written even if the caller reuses it
+	lead.Email = "someone@else.com"
+	err = tx.End(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"after insert jane@example.com"}; !reflect.DeepEqual(r.calls, want) {
+		t.Errorf("calls = %q, want %q", r.calls, want)
+	}
+
+	// nothing was committed so there's nothing for the hooks
+	r.calls = nil
+	commitErr = errors.New("serialization failure")
+	tx, err = s.TXBegin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Insert(ctx, &benchLead{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.End(ctx); err != commitErr {
+		t.Errorf("End = %v, want the commit's error", err)
+	}
+	if len(r.calls) != 0 {
+		t.Errorf("the after hooks ran for a tx that failed to commit: %q", r.calls)
+	}
+}
+
+// once the tx is committed every cache action & after hook is run even if some fail & End returns all their errors
+func TestTxEndRunsEverything(t *testing.T) {
+	ctx := context.Background()
+	r := &hookRecorder{}
+
+	table := benchLeadsTable()
+	table.AfterInsert = r.hook("after insert", errors.New("couldn't publish"))
+
+	s, m := stubStorage(t, benchLeads(1), table)
+
+	tx, err := s.TXBegin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err = tx.Insert(ctx, &benchLead{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.SetError("LOADING redis is loading the dataset in memory")
+	err = tx.End(ctx)
+	m.SetError("")
+	if err == nil {
+		t.Fatal("End didn't return the errors")
+	}
+	if want := []string{"after insert jane@example.com", "after insert jane@example.com"}; !reflect.DeepEqual(r.calls, want) {
+		t.Errorf("calls = %q, want %q", r.calls, want)
+	}
+	errs, ok := err.(txErrors)
+	if !ok || len(errs) != 4 {
+		t.Fatalf("End = %v, want the errors of both cache actions & both hooks", err)
+	}
+	if !strings.Contains(err.Error(), "LOADING") || !strings.Contains(err.Error(), "couldn't publish") {
+		t.Errorf("End = %v", err)
+	}
+}
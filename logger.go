@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// Field is a structured field of a log line e.g. the query name
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// the fields the library logs with
+const (
+	FieldService  = "service"
+	FieldTable    = "table"
+	FieldQuery    = "query"
+	FieldCacheKey = "cache_key"
+	FieldAction   = "action"
+	FieldError    = "error"
+)
+
+/*
+	Logger is what the library logs with (Config.Logger). It's small on purpose so it's easy to adapt zap, zerolog, slog, etc.
+	Debug is only called when Config.Debugger is on. With returns a Logger that adds the fields to every line
+*/
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+	With(fields ...Field) Logger
+}
+
+// NopLogger discards everything; it's the default Config.Logger
+type NopLogger struct{}
+
+func (NopLogger) Debug(msg string, fields ...Field) {}
+func (NopLogger) Info(msg string, fields ...Field)  {}
+func (NopLogger) Error(msg string, fields ...Field) {}
+func (l NopLogger) With(fields ...Field) Logger     { return l }
+
+// LogrusLogger adapts a logrus entry to a Logger
+type LogrusLogger struct {
+	entry *logrus.Entry
+}
+
+// NewLogrusLogger returns a Logger that logs to entry; if entry is nil then it's the standard logrus logger
+func NewLogrusLogger(entry *logrus.Entry) *LogrusLogger {
+	if entry == nil {
+		entry = logrus.NewEntry(logrus.StandardLogger())
+	}
+	return &LogrusLogger{entry: entry}
+}
+
+func (l *LogrusLogger) Debug(msg string, fields ...Field) {
+	l.entry.WithFields(logrusFields(fields)).Debug(msg)
+}
+
+func (l *LogrusLogger) Info(msg string, fields ...Field) {
+	l.entry.WithFields(logrusFields(fields)).Info(msg)
+}
+
+func (l *LogrusLogger) Error(msg string, fields ...Field) {
+	l.entry.WithFields(logrusFields(fields)).Error(msg)
+}
+
+func (l *LogrusLogger) With(fields ...Field) Logger {
+	return &LogrusLogger{entry: l.entry.WithFields(logrusFields(fields))}
+}
+
+func logrusFields(fields []Field) logrus.Fields {
+	f := make(logrus.Fields, len(fields))
+	for _, field := range fields {
+		f[field.Key] = field.Value
+	}
+	return f
+}
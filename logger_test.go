@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogrusLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&buf)
+	l.SetLevel(logrus.InfoLevel)
+	l.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true, DisableQuote: true})
+
+	log := NewLogrusLogger(logrus.NewEntry(l)).With(Field{Key: FieldService, Value: "crm"})
+	log.Info("filled", Field{Key: FieldQuery, Value: "LeadsByUser"})
+	log.Error("cache write failed", Field{Key: FieldError, Value: "timeout"})
+	// below the logger's level
+	log.Debug("not logged")
+
+	want := "level=info msg=filled query=LeadsByUser service=crm\n" +
+		"level=error msg=cache write failed error=timeout service=crm\n"
+	if buf.String() != want {
+		t.Errorf("logged:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	if NewLogrusLogger(nil).entry.Logger != logrus.StandardLogger() {
+		t.Error("NewLogrusLogger(nil) isn't the standard logger")
+	}
+}
+
+func TestNewLoggerDefaultsToNop(t *testing.T) {
+	l := newLogger(&Config{Debugger: true})
+	if _, ok := l.log.(NopLogger); !ok {
+		t.Errorf("Logger = %T, want a NopLogger", l.log)
+	}
+}
+
+func TestLogging(t *testing.T) {
+	ctx := context.Background()
+	if logging(ctx) || logging(newLogger(&Config{}).withContext(ctx)) {
+		t.Error("logging = true without a Logger or the debugger")
+	}
+	if !logging(newLogger(&Config{Debugger: true}).withContext(ctx)) || !logging(newLogger(&Config{Logger: newTestLogger()}).withContext(ctx)) {
+		t.Error("logging = false with a Logger or the debugger")
+	}
+
+	// fields aren't added to a logger that discards them
+	quiet := newLogger(&Config{}).withContext(ctx)
+	if logWith(quiet, Field{Key: FieldQuery, Value: "LeadsGetByID"}) != quiet {
+		t.Error("logWith added fields to a NopLogger")
+	}
+}
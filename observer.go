@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// EventType is what happened in an Event
+type EventType int32
+
+const (
+	EventCacheHit     EventType = iota // the value was found in the cache
+	EventCacheMiss                     // the value wasn't in the cache so it's read from the db
+	EventCacheSet                      // a key was set (or pushed to, incremented, etc.); see Event.Action
+	EventCacheDel                      // a key was deleted by a CacheDel
+	EventDBQuery                       // a query was run against the db; see Event.Duration
+	EventListFill                      // a list was filled from the db; Event.Count is the number of members
+	EventInvalidation                  // keys were deleted because of a write; Event.Count is the number of keys
+	EventError                         // something went wrong; see Event.Err
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventCacheHit:
+		return "cache_hit"
+	case EventCacheMiss:
+		return "cache_miss"
+	case EventCacheSet:
+		return "cache_set"
+	case EventCacheDel:
+		return "cache_del"
+	case EventDBQuery:
+		return "db_query"
+	case EventListFill:
+		return "list_fill"
+	case EventInvalidation:
+		return "invalidation"
+	case EventError:
+		return "error"
+	}
+	return fmt.Sprintf("EventType(%d)", int32(e))
+}
+
+// Event is sent to the Config.Observer. Table & Query are empty if they don't apply e.g. a failed replica probe
+type Event struct {
+	Type    EventType
+	Service string
+	Table   string
+	Query   string
+	Action  CacheAction // the action taken on the key; CacheDefault if there isn't one
+
+	Duration time.Duration // how long the db query took
+	Count    int           // the members of a filled list or the number of invalidated keys
+	Err      error
+}
+
+/*
+	Observer receives an Event for everything the library does with the cache & db (Config.Observer) e.g. to count cache hits
+	per query. Observe is called inline so it must be fast & safe for concurrent use. See ExpvarObserver
+*/
+type Observer interface {
+	Observe(ctx context.Context, e Event)
+}
+
+// NopObserver ignores every event; it's the default Config.Observer
+type NopObserver struct{}
+
+func (NopObserver) Observe(ctx context.Context, e Event) {}
+
+// observerKey is the ctx key of the observation of the call
+type observerKey struct{}
+
+// observation is the Observer of the call with the tags (service, table & query) its events get
+type observation struct {
+	observer Observer
+	tags     Event
+}
+
+// withContext returns ctx with the logger, observer & tracer of the call; every public call starts with it
+func (s *storage) withContext(ctx context.Context) context.Context {
+	return withTracer(withObserver(s.log.withContext(ctx), s.observer, s.serviceName), s.tracer)
+}
+
+func withObserver(ctx context.Context, observer Observer, service string) context.Context {
+	if observer == nil {
+		observer = NopObserver{}
+	}
+	return context.WithValue(ctx, observerKey{}, &observation{observer: observer, tags: Event{Service: service}})
+}
+
+// withTable returns ctx with the table tagged in its events & log lines
+func withTable(ctx context.Context, t *Table) context.Context {
+	ctx = logWith(ctx, Field{Key: FieldTable, Value: t.tableName})
+	if o, ok := ctx.Value(observerKey{}).(*observation); ok {
+		tagged := *o
+		tagged.tags.Table = t.tableName
+		tagged.tags.Query = ""
+		ctx = context.WithValue(ctx, observerKey{}, &tagged)
+	}
+	return ctx
+}
+
+// withQuery returns ctx with the query (& its table) tagged in its events & log lines
+func withQuery(ctx context.Context, q *Query) context.Context {
+	ctx = logWith(ctx, Field{Key: FieldTable, Value: q.tableName}, Field{Key: FieldQuery, Value: q.Name})
+	if o, ok := ctx.Value(observerKey{}).(*observation); ok {
+		tagged := *o
+		tagged.tags.Table = q.tableName
+		tagged.tags.Query = q.Name
+		ctx = context.WithValue(ctx, observerKey{}, &tagged)
+	}
+	return ctx
+}
+
+// observe sends e to the Observer of the call with the call's tags
+func observe(ctx context.Context, e Event) {
+	o, ok := ctx.Value(observerKey{}).(*observation)
+	if !ok {
+		return
+	}
+	e.Service = o.tags.Service
+	if e.Table == "" {
+		e.Table = o.tags.Table
+	}
+	if e.Query == "" {
+		e.Query = o.tags.Query
+	}
+	o.observer.Observe(ctx, e)
+}
+
+// observeErr observes the error returned by a public call (of queryName if it's a select); a row that isn't found isn't an error
+func (s *storage) observeErr(ctx context.Context, queryName string, err error) error {
+	if err == nil || err == sql.ErrNoRows {
+		return err
+	}
+	if q, ok := s.queries[queryName]; ok {
+		ctx = withQuery(ctx, q)
+	}
+	observe(ctx, Event{Type: EventError, Err: err})
+	return err
+}
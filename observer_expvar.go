@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+	ExpvarObserver is an Observer that counts the events per service, table, query & action. The counts are published with
+	expvar (see NewExpvarObserver) and can be written in the Prometheus text format (see WritePrometheus & PrometheusHandler)
+	so they can be scraped without a Prometheus client.
+*/
+type ExpvarObserver struct {
+	mu      sync.Mutex
+	metrics map[metricKey]*metricValue
+}
+
+type metricKey struct {
+	event   EventType
+	service string
+	table   string
+	query   string
+	action  string
+}
+
+type metricValue struct {
+	count int64
+	sum   float64 // seconds for EventDBQuery; Event.Count for EventListFill & EventInvalidation
+}
+
+/*
+	NewExpvarObserver returns an ExpvarObserver published as the expvar name (e.g. at /debug/vars). If name is empty or is
+	already published (e.g. a second Storage) then it isn't published
+*/
+func NewExpvarObserver(name string) *ExpvarObserver {
+	o := &ExpvarObserver{
+		metrics: map[metricKey]*metricValue{},
+	}
+	if name != "" && expvar.Get(name) == nil {
+		expvar.Publish(name, expvar.Func(o.snapshot))
+	}
+	return o
+}
+
+func (o *ExpvarObserver) Observe(ctx context.Context, e Event) {
+	key := metricKey{
+		event:   e.Type,
+		service: e.Service,
+		table:   e.Table,
+		query:   e.Query,
+	}
+	if e.Action != CacheDefault {
+		key.action = e.Action.String()
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	v, ok := o.metrics[key]
+	if !ok {
+		v = &metricValue{}
+		o.metrics[key] = v
+	}
+	v.count++
+	switch e.Type {
+	case EventDBQuery:
+		v.sum += e.Duration.Seconds()
+	case EventListFill, EventInvalidation:
+		v.sum += float64(e.Count)
+	}
+}
+
+// snapshot returns the metrics for expvar as event -> "service|table|query|action" -> {count, sum}
+func (o *ExpvarObserver) snapshot() interface{} {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	res := map[string]map[string]map[string]interface{}{}
+	for key, v := range o.metrics {
+		event := key.event.String()
+		if res[event] == nil {
+			res[event] = map[string]map[string]interface{}{}
+		}
+		res[event][strings.Join([]string{key.service, key.table, key.query, key.action}, "|")] = map[string]interface{}{
+			"count": v.count,
+			"sum":   v.sum,
+		}
+	}
+	return res
+}
+
+// prometheusMetric is how an event is exposed to Prometheus; sumName is empty if the event has no sum
+type prometheusMetric struct {
+	name    string
+	help    string
+	sumName string
+	sumHelp string
+}
+
+var prometheusMetrics = map[EventType]prometheusMetric{
+	EventCacheHit:     {name: "storage_cache_hits_total", help: "Cache hits."},
+	EventCacheMiss:    {name: "storage_cache_misses_total", help: "Cache misses."},
+	EventCacheSet:     {name: "storage_cache_sets_total", help: "Keys set, pushed to, or incremented."},
+	EventCacheDel:     {name: "storage_cache_dels_total", help: "Keys deleted by CacheDel."},
+	EventDBQuery:      {name: "storage_db_queries_total", help: "Queries run against the db.", sumName: "storage_db_query_seconds_total", sumHelp: "Time spent running queries against the db."},
+	EventListFill:     {name: "storage_list_fills_total", help: "Lists filled from the db.", sumName: "storage_list_fill_members_total", sumHelp: "Members pushed when filling lists."},
+	EventInvalidation: {name: "storage_invalidations_total", help: "Invalidations caused by writes.", sumName: "storage_invalidated_keys_total", sumHelp: "Keys deleted by invalidations."},
+	EventError:        {name: "storage_errors_total", help: "Errors."},
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format
+func (o *ExpvarObserver) WritePrometheus(w io.Writer) error {
+	o.mu.Lock()
+	type sample struct {
+		key   metricKey
+		value metricValue
+	}
+	samples := make([]sample, 0, len(o.metrics))
+	for key, v := range o.metrics {
+		samples = append(samples, sample{key: key, value: *v})
+	}
+	o.mu.Unlock()
+
+	// sorted so the output is the same every time
+	sort.Slice(samples, func(i, j int) bool {
+		a, b := samples[i].key, samples[j].key
+		if a.event != b.event {
+			return a.event < b.event
+		}
+		return strings.Join([]string{a.service, a.table, a.query, a.action}, "\x00") < strings.Join([]string{b.service, b.table, b.query, b.action}, "\x00")
+	})
+
+	bw := bufio.NewWriter(w)
+	for i := 0; i < len(samples); {
+		event := samples[i].key.event
+		j := i
+		for j < len(samples) && samples[j].key.event == event {
+			j++
+		}
+
+		metric, ok := prometheusMetrics[event]
+		if ok {
+			fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name)
+			for _, s := range samples[i:j] {
+				fmt.Fprintf(bw, "%s{%s} %d\n", metric.name, prometheusLabels(s.key), s.value.count)
+			}
+			if metric.sumName != "" {
+				fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", metric.sumName, metric.sumHelp, metric.sumName)
+				for _, s := range samples[i:j] {
+					fmt.Fprintf(bw, "%s{%s} %g\n", metric.sumName, prometheusLabels(s.key), s.value.sum)
+				}
+			}
+		}
+		i = j
+	}
+	return bw.Flush()
+}
+
+// PrometheusHandler serves the metrics in the Prometheus text exposition format e.g. at /metrics
+func (o *ExpvarObserver) PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		o.WritePrometheus(w)
+	})
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func prometheusLabels(key metricKey) string {
+	return fmt.Sprintf(`service="%s",table="%s",query="%s",action="%s"`,
+		prometheusLabelEscaper.Replace(key.service),
+		prometheusLabelEscaper.Replace(key.table),
+		prometheusLabelEscaper.Replace(key.query),
+		prometheusLabelEscaper.Replace(key.action),
+	)
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testExpvarObserver() *ExpvarObserver {
+	ctx := context.Background()
+	o := NewExpvarObserver("")
+
+	leads := Event{Service: "crm", Table: "Leads", Query: "LeadsGetByID"}
+	byUser := Event{Service: "crm", Table: "Leads", Query: "LeadsByUser"}
+
+	for _, e := range []Event{
+		{Type: EventCacheHit}, {Type: EventCacheHit}, {Type: EventCacheMiss},
+		{Type: EventCacheSet, Action: CacheSet},
+		{Type: EventDBQuery, Duration: 250 * time.Millisecond}, {Type: EventDBQuery, Duration: 500 * time.Millisecond},
+	} {
+		e.Service, e.Table, e.Query = leads.Service, leads.Table, leads.Query
+		o.Observe(ctx, e)
+	}
+	for _, e := range []Event{
+		{Type: EventCacheMiss},
+		{Type: EventListFill, Action: CacheRPush, Count: 12},
+		{Type: EventInvalidation, Action: CacheRPush, Count: 3}, {Type: EventInvalidation, Action: CacheRPush, Count: 2},
+	} {
+		e.Service, e.Table, e.Query = byUser.Service, byUser.Table, byUser.Query
+		o.Observe(ctx, e)
+	}
+
+	// e.g. a failed replica probe isn't for a table or query
+	o.Observe(ctx, Event{Type: EventError, Service: "crm", Err: errors.New("probe failed")})
+	return o
+}
+
+const testPrometheusOutput = `# HELP storage_cache_hits_total Cache hits.
+# TYPE storage_cache_hits_total counter
+storage_cache_hits_total{service="crm",table="Leads",query="LeadsGetByID",action=""} 2
+# HELP storage_cache_misses_total Cache misses.
+# TYPE storage_cache_misses_total counter
+storage_cache_misses_total{service="crm",table="Leads",query="LeadsByUser",action=""} 1
+storage_cache_misses_total{service="crm",table="Leads",query="LeadsGetByID",action=""} 1
+# HELP storage_cache_sets_total Keys set, pushed to, or incremented.
+# TYPE storage_cache_sets_total counter
+storage_cache_sets_total{service="crm",table="Leads",query="LeadsGetByID",action="set"} 1
+# HELP storage_db_queries_total Queries run against the db.
+# TYPE storage_db_queries_total counter
+storage_db_queries_total{service="crm",table="Leads",query="LeadsGetByID",action=""} 2
+# HELP storage_db_query_seconds_total Time spent running queries against the db.
+# TYPE storage_db_query_seconds_total counter
+storage_db_query_seconds_total{service="crm",table="Leads",query="LeadsGetByID",action=""} 0.75
+# HELP storage_list_fills_total Lists filled from the db.
+# TYPE storage_list_fills_total counter
+storage_list_fills_total{service="crm",table="Leads",query="LeadsByUser",action="rpush"} 1
+# HELP storage_list_fill_members_total Members pushed when filling lists.
+# TYPE storage_list_fill_members_total counter
+storage_list_fill_members_total{service="crm",table="Leads",query="LeadsByUser",action="rpush"} 12
+# HELP storage_invalidations_total Invalidations caused by writes.
+# TYPE storage_invalidations_total counter
+storage_invalidations_total{service="crm",table="Leads",query="LeadsByUser",action="rpush"} 2
+# HELP storage_invalidated_keys_total Keys deleted by invalidations.
+# TYPE storage_invalidated_keys_total counter
+storage_invalidated_keys_total{service="crm",table="Leads",query="LeadsByUser",action="rpush"} 5
+# HELP storage_errors_total Errors.
+# TYPE storage_errors_total counter
+storage_errors_total{service="crm",table="",query="",action=""} 1
+`
+
+func TestWritePrometheus(t *testing.T) {
+	o := testExpvarObserver()
+
+	var buf bytes.Buffer
+	err := o.WritePrometheus(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != testPrometheusOutput {
+		t.Errorf("WritePrometheus =\n%s\nwant\n%s", buf.String(), testPrometheusOutput)
+	}
+
+	// the output is sorted so scrapes can be diffed
+	var again bytes.Buffer
+	o.WritePrometheus(&again)
+	if again.String() != buf.String() {
+		t.Error("WritePrometheus isn't the same every time")
+	}
+}
+
+func TestWritePrometheusEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	err := NewExpvarObserver("").WritePrometheus(&buf)
+	if err != nil || buf.Len() != 0 {
+		t.Errorf("WritePrometheus of no events = %q, %v; want nothing", buf.String(), err)
+	}
+}
+
+func TestPrometheusLabelsEscaped(t *testing.T) {
+	o := NewExpvarObserver("")
+	o.Observe(context.Background(), Event{Type: EventCacheHit, Service: `a"b`, Table: `c\d`, Query: "e\nf"})
+
+	var buf bytes.Buffer
+	o.WritePrometheus(&buf)
+	want := `storage_cache_hits_total{service="a\"b",table="c\\d",query="e\nf",action=""} 1` + "\n"
+	if !bytes.HasSuffix(buf.Bytes(), []byte(want)) {
+		t.Errorf("WritePrometheus =\n%s\nwant it to end with\n%s", buf.String(), want)
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	o := testExpvarObserver()
+
+	w := httptest.NewRecorder()
+	o.PrometheusHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	res := w.Result()
+	if res.StatusCode != 200 {
+		t.Errorf("status = %d, want 200", res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != testPrometheusOutput {
+		t.Errorf("body =\n%s\nwant\n%s", body, testPrometheusOutput)
+	}
+}
+
+func TestExpvarObserverPublished(t *testing.T) {
+	o := NewExpvarObserver("storage_test_metrics")
+	o.Observe(context.Background(), Event{Type: EventCacheHit, Service: "crm", Table: "Leads", Query: "LeadsGetByID"})
+
+	v := expvar.Get("storage_test_metrics")
+	if v == nil {
+		t.Fatal("the observer wasn't published")
+	}
+	want := `{"cache_hit":{"crm|Leads|LeadsGetByID|":{"count":1,"sum":0}}}`
+	if v.String() != want {
+		t.Errorf("expvar = %s, want %s", v.String(), want)
+	}
+
+	// a second Storage with the same name isn't published over the first
+	NewExpvarObserver("storage_test_metrics")
+	if expvar.Get("storage_test_metrics").String() != want {
+		t.Error("a second observer with the same name replaced the first")
+	}
+}
@@ -0,0 +1,75 @@
+// Package otel adapts an OpenTelemetry tracer to a storage.Tracer
+package otel
+
+import (
+	"context"
+	"fmt"
+
+	storage "github.com/osr-alliance/backend-lib-storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the tracer when one isn't given to NewTracer
+const instrumentationName = "github.com/osr-alliance/backend-lib-storage"
+
+// Tracer is a storage.Tracer that starts OpenTelemetry spans
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer returns a storage.Tracer that starts its spans with tracer; if tracer is nil then it's the global provider's
+func NewTracer(tracer trace.Tracer) *Tracer {
+	if tracer == nil {
+		tracer = otel.Tracer(instrumentationName)
+	}
+	return &Tracer{tracer: tracer}
+}
+
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...storage.Field) (context.Context, storage.Span) {
+	ctx, span := t.tracer.Start(ctx, name, trace.WithAttributes(attributes(attrs)...))
+	return ctx, &Span{span: span}
+}
+
+// Span is a storage.Span of an OpenTelemetry span
+type Span struct {
+	span trace.Span
+}
+
+func (s *Span) SetAttributes(attrs ...storage.Field) {
+	s.span.SetAttributes(attributes(attrs)...)
+}
+
+func (s *Span) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *Span) End() {
+	s.span.End()
+}
+
+func attributes(fields []storage.Field) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(fields))
+	for _, f := range fields {
+		switch v := f.Value.(type) {
+		case string:
+			attrs = append(attrs, attribute.String(f.Key, v))
+		case int:
+			attrs = append(attrs, attribute.Int(f.Key, v))
+		case int64:
+			attrs = append(attrs, attribute.Int64(f.Key, v))
+		case float64:
+			attrs = append(attrs, attribute.Float64(f.Key, v))
+		case bool:
+			attrs = append(attrs, attribute.Bool(f.Key, v))
+		case fmt.Stringer:
+			attrs = append(attrs, attribute.String(f.Key, v.String()))
+		default:
+			attrs = append(attrs, attribute.String(f.Key, fmt.Sprintf("%v", v)))
+		}
+	}
+	return attrs
+}
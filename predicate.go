@@ -0,0 +1,350 @@
+package storage
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+	Each segment of a CacheKey (split on `|`) is either a `%v` of the key, a predicate on a column, or just text:
+	- `lead_id=%v`                  the value of lead_id is in the key name
+	- `role=OWNER` / `role!=OWNER`  the column equals / doesn't equal the value
+	- `amount>100` (also >=, <, <=) the column compared to the value; numbers, strings, & times
+	- `status in(OPEN,WON)`         the column is one of the values (or `not in(...)`)
+	- `deleted_at is null`          the column is NULL (or `is not null`)
+	- `active is true`              a boolean column is true (or `is false`)
+
+	A predicate is part of the key name as is. On an insert or update, the row is evaluated against each predicate and only affects
+	the key if it matches all of them. The values are converted to the column's type when New is called (see parseValues).
+*/
+
+type cacheKeyFieldOperator int32
+
+const (
+	operatorDefault      cacheKeyFieldOperator = iota
+	operatorEqual                              // e.g. lead_id=%v
+	operatorNotEqual                           // e.g. email!=asdf@asdf.com
+	operatorEqualValue                         // e.g. role=OWNER or active is true
+	operatorGreater                            // e.g. amount>100
+	operatorGreaterEqual                       // e.g. amount>=100
+	operatorLess                               // e.g. amount<100
+	operatorLessEqual                          // e.g. amount<=100
+	operatorIn                                 // e.g. status in(OPEN,WON)
+	operatorNotIn                              // e.g. status not in(LOST)
+	operatorIsNull                             // e.g. deleted_at is null
+	operatorIsNotNull                          // e.g. deleted_at is not null
+)
+
+type cacheKeyField struct {
+	segment    string // the segment of the CacheKey this is e.g. `role=OWNER`; used for errors
+	columnName string
+	operator   cacheKeyFieldOperator
+
+	values      []string      // the values compared to e.g. `OWNER` in `role=OWNER` or `OPEN` & `WON` in `status in(OPEN,WON)`
+	typedValues []interface{} // values converted to the column's type; see parseValues
+}
+
+var (
+	// e.g. `deleted_at is null`, `deleted_at is not null`, `active is true`
+	predicateIsRegex = regexp.MustCompile(`(?i)^(\w+)\s+is\s+(not\s+)?(null|true|false)$`)
+	// e.g. `status in(OPEN,WON)`, `status not in (LOST)`
+	predicateInRegex = regexp.MustCompile(`(?i)^(\w+)\s+(not\s+)?in\s*\((.*)\)$`)
+	// e.g. `lead_id=%v`, `role!=OWNER`, `amount>=100`
+	predicateCompareRegex = regexp.MustCompile(`^(\w+)(!=|>=|<=|=|>|<)(.*)$`)
+)
+
+var compareOperators = map[string]cacheKeyFieldOperator{
+	"=":  operatorEqualValue,
+	"!=": operatorNotEqual,
+	">":  operatorGreater,
+	">=": operatorGreaterEqual,
+	"<":  operatorLess,
+	"<=": operatorLessEqual,
+}
+
+// parseCacheKeyField parses a segment of a CacheKey; ok is false if the segment is just text e.g. the `leads` in `leads|user_id=%v`
+func parseCacheKeyField(segment string) (field cacheKeyField, ok bool, err error) {
+	field.segment = segment
+	trimmed := strings.TrimSpace(segment)
+
+	if m := predicateIsRegex.FindStringSubmatch(trimmed); m != nil {
+		field.columnName = m[1]
+		switch strings.ToLower(m[3]) {
+		case "null":
+			field.operator = operatorIsNull
+			if m[2] != "" {
+				field.operator = operatorIsNotNull
+			}
+		case "true", "false":
+			if m[2] != "" {
+				return field, false, errors.New("use `is true` or `is false` instead of `is not`")
+			}
+			field.operator = operatorEqualValue
+			field.values = []string{strings.ToLower(m[3])}
+		}
+		return field, true, nil
+	}
+
+	if m := predicateInRegex.FindStringSubmatch(trimmed); m != nil {
+		field.columnName = m[1]
+		field.operator = operatorIn
+		if m[2] != "" {
+			field.operator = operatorNotIn
+		}
+		for _, value := range strings.Split(m[3], ",") {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				return field, false, errors.New("in() must be a comma separated list of values e.g. `status in(OPEN,WON)`")
+			}
+			field.values = append(field.values, value)
+		}
+		return field, true, checkPredicateValues(field.values)
+	}
+
+	if m := predicateCompareRegex.FindStringSubmatch(trimmed); m != nil {
+		field.columnName = m[1]
+		if m[3] == "%v" {
+			if m[2] != "=" {
+				return field, false, fmt.Errorf("`%s` must be compared to a value instead of `%%v`; only `=%%v` is a placeholder", m[2])
+			}
+			field.operator = operatorEqual
+			return field, true, nil
+		}
+		if m[3] == "" {
+			return field, false, fmt.Errorf("missing a value after `%s`", m[2])
+		}
+
+		field.operator = compareOperators[m[2]]
+		field.values = []string{m[3]}
+		return field, true, checkPredicateValues(field.values)
+	}
+
+	// text that looks like it was supposed to be a predicate shouldn't silently be ignored
+	if strings.ContainsAny(trimmed, "=<>!()% ") {
+		return field, false, errors.New("must be e.g. `lead_id=%v`, `role=OWNER`, `amount>100`, `status in(OPEN,WON)`, or `deleted_at is null`")
+	}
+
+	return field, false, nil
+}
+
+// checkPredicateValues makes sure the values can be in the key name as is
+func checkPredicateValues(values []string) error {
+	for _, value := range values {
+		if strings.Contains(value, "%") {
+			return fmt.Errorf("the value %s cannot contain a %%", value)
+		}
+	}
+	return nil
+}
+
+// isParameter returns whether the field is a `%v` of the key (vs. a predicate)
+func (f cacheKeyField) isParameter() bool {
+	return f.operator == operatorEqual
+}
+
+// parseValues converts the values to the type of column (the column's zero value from the table's objMap)
+func (f *cacheKeyField) parseValues(column interface{}) error {
+	f.typedValues = make([]interface{}, len(f.values))
+	for i, value := range f.values {
+		if column == nil {
+			// e.g. an interface{} field; compare the value as is
+			f.typedValues[i] = value
+			continue
+		}
+
+		typedValue := reflect.New(reflect.TypeOf(column)).Elem()
+		err := setValue(typedValue, value)
+		if err != nil {
+			return fmt.Errorf("%s is not a valid value for %s (%T): %s", value, f.columnName, column, err)
+		}
+		f.typedValues[i] = typedValue.Interface()
+	}
+
+	switch f.operator {
+	case operatorGreater, operatorGreaterEqual, operatorLess, operatorLessEqual:
+		if _, ok := compareValues(f.typedValues[0], f.typedValues[0]); !ok {
+			return fmt.Errorf("%s (%T) cannot be compared with >, >=, <, or <=", f.columnName, column)
+		}
+	}
+	return nil
+}
+
+// eval returns whether the column's value of a row matches the predicate
+func (f cacheKeyField) eval(value interface{}) bool {
+	switch f.operator {
+	case operatorIsNull:
+		return orderedValue(value) == nil
+	case operatorIsNotNull:
+		return orderedValue(value) != nil
+	case operatorEqualValue, operatorIn:
+		return f.equalsAny(value)
+	case operatorNotEqual, operatorNotIn:
+		// a NULL doesn't match != or not in either, just like in sql
+		return orderedValue(value) != nil && !f.equalsAny(value)
+	}
+
+	// a NULL is never greater or less than anything, just like in sql
+	c, ok := compareValues(value, f.typedValue(0))
+	if !ok {
+		return false
+	}
+	switch f.operator {
+	case operatorGreater:
+		return c > 0
+	case operatorGreaterEqual:
+		return c >= 0
+	case operatorLess:
+		return c < 0
+	case operatorLessEqual:
+		return c <= 0
+	}
+	return false
+}
+
+// equalsAny compares value to each of the values as the column's type so e.g. `5` matches an int32 of 5 and `true` a bool
+func (f cacheKeyField) equalsAny(value interface{}) bool {
+	v := keyValue(value)
+	for i := range f.values {
+		if v == keyValue(f.typedValue(i)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f cacheKeyField) typedValue(i int) interface{} {
+	if len(f.typedValues) == len(f.values) {
+		return f.typedValues[i]
+	}
+	return f.values[i]
+}
+
+/*
+	compareValues returns -1, 0, or 1 if a is less than, equal to, or greater than b. ok is false if they can't be compared
+	e.g. one of them is NULL or they're different kinds of values
+*/
+func compareValues(a, b interface{}) (c int, ok bool) {
+	a, b = orderedValue(a), orderedValue(b)
+	if a == nil || b == nil {
+		return 0, false
+	}
+
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return compareOrdered(x, y), true
+		case float64:
+			return compareOrdered(float64(x), y), true
+		}
+	case uint64:
+		if y, ok := b.(uint64); ok {
+			return compareOrdered(x, y), true
+		}
+	case float64:
+		switch y := b.(type) {
+		case float64:
+			return compareOrdered(x, y), true
+		case int64:
+			return compareOrdered(x, float64(y)), true
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1, true
+			case x.After(y):
+				return 1, true
+			}
+			return 0, true
+		}
+	case *big.Int:
+		if y, ok := b.(*big.Int); ok {
+			return x.Cmp(y), true
+		}
+	}
+	return 0, false
+}
+
+func compareOrdered[T int64 | uint64 | float64](x, y T) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+/*
+	orderedValue returns the value as an int64, uint64, float64, string, time.Time, or *big.Int if it's one of those & nil if it's
+	NULL (nil, a nil pointer, an invalid sql.Null*, or a json null). Anything else (e.g. a bool or a struct) is returned as is
+*/
+func orderedValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case json.RawMessage:
+		if len(v) == 0 || string(v) == "null" {
+			return nil
+		}
+		return v
+	case time.Time:
+		return v
+	case big.Int:
+		return &v
+	case *big.Int:
+		if v == nil {
+			return nil
+		}
+		return v
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		return orderedValue(rv.Elem().Interface())
+	}
+
+	// e.g. sql.NullInt64 or sql.NullTime; an invalid one is a NULL
+	if valuer, ok := value.(driver.Valuer); ok {
+		dv, err := valuer.Value()
+		if err != nil {
+			return nil
+		}
+		if _, ok := dv.(driver.Valuer); ok {
+			// don't loop forever on a Valuer that returns itself
+			return nil
+		}
+		return orderedValue(dv)
+	}
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint()
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Slice, reflect.Map:
+		if rv.IsNil() {
+			return nil
+		}
+	}
+	return value
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCacheKeyField(t *testing.T) {
+	cases := []struct {
+		segment  string
+		ok       bool
+		err      bool
+		column   string
+		operator cacheKeyFieldOperator
+		values   []string
+	}{
+		{segment: "leads"},
+		{segment: "lead_id=%v", ok: true, column: "lead_id", operator: operatorEqual},
+		{segment: "role=OWNER", ok: true, column: "role", operator: operatorEqualValue, values: []string{"OWNER"}},
+		{segment: "role!=OWNER", ok: true, column: "role", operator: operatorNotEqual, values: []string{"OWNER"}},
+		{segment: "amount>100", ok: true, column: "amount", operator: operatorGreater, values: []string{"100"}},
+		{segment: "amount>=100", ok: true, column: "amount", operator: operatorGreaterEqual, values: []string{"100"}},
+		{segment: "amount<100", ok: true, column: "amount", operator: operatorLess, values: []string{"100"}},
+		{segment: "amount<=100", ok: true, column: "amount", operator: operatorLessEqual, values: []string{"100"}},
+		{segment: "status in(OPEN,WON)", ok: true, column: "status", operator: operatorIn, values: []string{"OPEN", "WON"}},
+		{segment: "status NOT IN ( LOST , CLOSED )", ok: true, column: "status", operator: operatorNotIn, values: []string{"LOST", "CLOSED"}},
+		{segment: "deleted_at is null", ok: true, column: "deleted_at", operator: operatorIsNull},
+		{segment: "deleted_at IS NOT NULL", ok: true, column: "deleted_at", operator: operatorIsNotNull},
+		{segment: "active is true", ok: true, column: "active", operator: operatorEqualValue, values: []string{"true"}},
+		{segment: "active is FALSE", ok: true, column: "active", operator: operatorEqualValue, values: []string{"false"}},
+		{segment: "active is not true", err: true},
+		{segment: "amount>%v", err: true},
+		{segment: "role=", err: true},
+		{segment: "status in(OPEN,)", err: true},
+		{segment: "role=100%", err: true},
+		{segment: "lead id=%v", err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.segment, func(t *testing.T) {
+			field, ok, err := parseCacheKeyField(c.segment)
+			if c.err {
+				if err == nil {
+					t.Errorf("parseCacheKeyField(%q) = %+v, want an error", c.segment, field)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCacheKeyField(%q): %s", c.segment, err)
+			}
+			if ok != c.ok {
+				t.Fatalf("parseCacheKeyField(%q) ok = %v, want %v", c.segment, ok, c.ok)
+			}
+			if !ok {
+				return
+			}
+
+			if field.columnName != c.column || field.operator != c.operator || !reflect.DeepEqual(field.values, c.values) {
+				t.Errorf("parseCacheKeyField(%q) = %s %d %q, want %s %d %q", c.segment, field.columnName, field.operator, field.values, c.column, c.operator, c.values)
+			}
+		})
+	}
+}
+
+func TestPredicateEval(t *testing.T) {
+	created := time.Date(2021, 11, 19, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name    string
+		segment string
+		column  interface{} // the column's zero value i.e. its type
+		value   interface{} // the row's value
+		want    bool
+	}{
+		{name: "equal string", segment: "role=OWNER", column: "", value: "OWNER", want: true},
+		{name: "equal string mismatch", segment: "role=OWNER", column: "", value: "MEMBER"},
+		{name: "not equal", segment: "role!=OWNER", column: "", value: "MEMBER", want: true},
+		{name: "not equal NULL", segment: "role!=OWNER", column: sql.NullString{}, value: sql.NullString{}},
+		{name: "not equal nil pointer", segment: "role!=OWNER", column: (*string)(nil), value: (*string)(nil)},
+		{name: "equal int32", segment: "stage=5", column: int32(0), value: int32(5), want: true},
+		{name: "equal pointer", segment: "stage=5", column: (*int64)(nil), value: newInt64(5), want: true},
+		{name: "equal nil pointer", segment: "stage=5", column: (*int64)(nil), value: (*int64)(nil)},
+		{name: "is true", segment: "active is true", column: false, value: true, want: true},
+		{name: "is false", segment: "active is false", column: false, value: true},
+		{name: "in", segment: "status in(OPEN,WON)", column: "", value: "WON", want: true},
+		{name: "in mismatch", segment: "status in(OPEN,WON)", column: "", value: "LOST"},
+		{name: "not in", segment: "status not in(LOST)", column: "", value: "OPEN", want: true},
+		{name: "not in mismatch", segment: "status not in(LOST)", column: "", value: "LOST"},
+		{name: "not in NULL", segment: "status not in(LOST)", column: sql.NullString{}, value: sql.NullString{}},
+		{name: "is null nil pointer", segment: "deleted_at is null", column: (*time.Time)(nil), value: (*time.Time)(nil), want: true},
+		{name: "is null set", segment: "deleted_at is null", column: (*time.Time)(nil), value: &created},
+		{name: "is null sql.NullTime", segment: "deleted_at is null", column: sql.NullTime{}, value: sql.NullTime{}, want: true},
+		{name: "is not null", segment: "deleted_at is not null", column: sql.NullTime{}, value: sql.NullTime{Time: created, Valid: true}, want: true},
+		{name: "is not null nil pointer", segment: "deleted_at is not null", column: (*time.Time)(nil), value: (*time.Time)(nil)},
+		{name: "is null false", segment: "active is null", column: false, value: false},
+		{name: "is null sql.NullBool", segment: "active is null", column: sql.NullBool{}, value: sql.NullBool{}, want: true},
+		{name: "is not null sql.NullBool", segment: "active is not null", column: sql.NullBool{}, value: sql.NullBool{Valid: true}, want: true},
+		{name: "is null json null", segment: "meta is null", column: json.RawMessage(nil), value: json.RawMessage("null"), want: true},
+		{name: "is null json", segment: "meta is null", column: json.RawMessage(nil), value: json.RawMessage(`{"stage":"demo"}`)},
+		{name: "greater int", segment: "amount>100", column: int64(0), value: int64(101), want: true},
+		{name: "greater int equal", segment: "amount>100", column: int64(0), value: int64(100)},
+		{name: "greater equal int", segment: "amount>=100", column: int64(0), value: int64(100), want: true},
+		{name: "less float", segment: "score<0.5", column: float64(0), value: 0.25, want: true},
+		{name: "less equal uint", segment: "seats<=10", column: uint32(0), value: uint32(11)},
+		{name: "greater NULL", segment: "amount>100", column: sql.NullInt64{}, value: sql.NullInt64{}},
+		{name: "greater sql.NullInt64", segment: "amount>100", column: sql.NullInt64{}, value: sql.NullInt64{Int64: 200, Valid: true}, want: true},
+		{name: "greater big.Int", segment: "amount>18446744073709551616", column: (*big.Int)(nil), value: newBigInt("18446744073709551617"), want: true},
+		{name: "less big.Int", segment: "amount<18446744073709551616", column: (*big.Int)(nil), value: newBigInt("18446744073709551617")},
+		{name: "greater time", segment: "created_at>2021-11-01T00:00:00Z", column: time.Time{}, value: created, want: true},
+		{name: "less time", segment: "created_at<2021-11-01T00:00:00Z", column: time.Time{}, value: created},
+		{name: "less string", segment: "name<M", column: "", value: "Jane", want: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			field, ok, err := parseCacheKeyField(c.segment)
+			if err != nil || !ok {
+				t.Fatalf("parseCacheKeyField(%q) = %v, %v", c.segment, ok, err)
+			}
+			err = field.parseValues(c.column)
+			if err != nil {
+				t.Fatalf("parseValues(%T): %s", c.column, err)
+			}
+
+			if got := field.eval(c.value); got != c.want {
+				t.Errorf("`%s` eval(%#v) = %v, want %v", c.segment, c.value, got, c.want)
+			}
+		})
+	}
+}
+
+func TestPredicateParseValuesErrors(t *testing.T) {
+	cases := []struct {
+		segment string
+		column  interface{}
+	}{
+		{segment: "amount>lots", column: int64(0)},
+		{segment: "active is true", column: int64(0)},
+		{segment: "created_at>yesterday", column: time.Time{}},
+		{segment: "active>true", column: false},
+	}
+
+	for _, c := range cases {
+		field, _, err := parseCacheKeyField(c.segment)
+		if err != nil {
+			t.Fatalf("parseCacheKeyField(%q): %s", c.segment, err)
+		}
+		if err := field.parseValues(c.column); err == nil {
+			t.Errorf("`%s` parseValues(%T) = %v, want an error", c.segment, c.column, field.typedValues)
+		}
+	}
+}
+
+func TestIsValidQuery(t *testing.T) {
+	q := &Query{Name: "test", CacheKey: "user_id=%v|role!=OWNER|deleted_at is null"}
+	q.parseFullCacheKey("test", "Members")
+	err := q.validateAndParseCacheFields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.validateAndParseCacheKeyValues(map[string]interface{}{"user_id": int64(0), "role": "", "deleted_at": (*time.Time)(nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	cases := []struct {
+		name string
+		row  map[string]interface{}
+		want bool
+	}{
+		{name: "matches", row: map[string]interface{}{"user_id": int64(4), "role": "MEMBER", "deleted_at": (*time.Time)(nil)}, want: true},
+		{name: "owner", row: map[string]interface{}{"user_id": int64(4), "role": "OWNER", "deleted_at": (*time.Time)(nil)}},
+		{name: "deleted", row: map[string]interface{}{"user_id": int64(4), "role": "MEMBER", "deleted_at": &now}},
+	}
+
+	for _, c := range cases {
+		if got := q.isValidQuery(context.Background(), c.row); got != c.want {
+			t.Errorf("%s: isValidQuery = %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	// the predicates are part of the key name as is
+	if got, want := q.getKeyName(map[string]interface{}{"user_id": int64(4)}), "service:test|Members|user_id=4|role!=OWNER|deleted_at is null"; got != want {
+		t.Errorf("getKeyName = %q, want %q", got, want)
+	}
+}
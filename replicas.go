@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+	Reads (cache misses) are spread across the read replicas: Config.ReadOnlyDbConn and/or Config.ReadOnlyDbConns. Every
+	Config.ReplicaProbeInterval each replica is probed for its lag & latency. A replica that fails its probe or lags more than
+	Config.MaxReplicaLag is ejected until a probe passes again, and if there are no healthy replicas then reads go to the primary.
+*/
+
+type ReplicaSelection int32
+
+const (
+	ReplicaRoundRobin   ReplicaSelection = iota // each read goes to the next healthy replica
+	ReplicaLeastLatency                         // each read goes to the healthy replica with the lowest probe latency
+)
+
+const (
+	defaultReplicaProbeInterval = 5 * time.Second
+	defaultMaxReplicaLag        = 30 * time.Second
+
+	// replicaLatencyWeight is how much a new probe's latency counts towards a replica's (moving average) latency
+	replicaLatencyWeight = 0.3
+)
+
+/*
+	replicaProbeQuery returns the replica's lag & replay LSN. The lag is 0 if the replica has replayed everything it has received
+	since pg_last_xact_replay_timestamp() is the time of the last transaction replayed which is old if the primary is idle.
+	On a server that isn't a replica (e.g. the primary in development) both are NULL
+*/
+const replicaProbeQuery = `select
+	coalesce(case when pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() then 0
+		else extract(epoch from now() - pg_last_xact_replay_timestamp()) end, 0)::float8,
+	pg_last_wal_replay_lsn()::text`
+
+type replica struct {
+	// first so they're 64-bit aligned for atomics
+	replayLSN uint64 // the latest LSN the replica has been seen to have replayed
+	latency   int64  // moving average of the probe's round trip in nanoseconds
+
+	conn    *sqlx.DB
+	healthy int32 // 1 if the replica can be read from
+}
+
+func (r *replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+func (r *replica) setHealthy(healthy bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	atomic.StoreInt32(&r.healthy, v)
+}
+
+// replicaPool picks the replica to read from & probes them in the background
+type replicaPool struct {
+	replicas  []*replica
+	selection ReplicaSelection
+	next      uint32 // round robin counter
+
+	probeInterval time.Duration
+	maxLag        time.Duration
+	log           *logger
+	observer      Observer
+	service       string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newReplicaPool(conf *Config) *replicaPool {
+	p := &replicaPool{
+		selection:     conf.ReplicaSelection,
+		probeInterval: conf.ReplicaProbeInterval,
+		maxLag:        conf.MaxReplicaLag,
+		log:           newLogger(conf),
+		observer:      conf.Observer,
+		service:       conf.ServiceName,
+		stop:          make(chan struct{}),
+	}
+	if p.probeInterval == 0 {
+		p.probeInterval = defaultReplicaProbeInterval
+	}
+	if p.maxLag == 0 {
+		p.maxLag = defaultMaxReplicaLag
+	}
+
+	conns := conf.ReadOnlyDbConns
+	if conf.ReadOnlyDbConn != nil {
+		conns = append([]*sqlx.DB{conf.ReadOnlyDbConn}, conns...)
+	}
+	for _, conn := range conns {
+		// healthy until a probe says otherwise
+		p.replicas = append(p.replicas, &replica{conn: conn, healthy: 1})
+	}
+	return p
+}
+
+// pick returns a healthy replica; nil if there aren't any
+func (p *replicaPool) pick() *replica {
+	switch p.selection {
+	case ReplicaLeastLatency:
+		var best *replica
+		for _, r := range p.replicas {
+			if r.isHealthy() && (best == nil || atomic.LoadInt64(&r.latency) < atomic.LoadInt64(&best.latency)) {
+				best = r
+			}
+		}
+		return best
+
+	default:
+		// the next of the healthy ones so an ejected replica's reads are spread across the rest rather than all going to its neighbor
+		healthy := 0
+		for _, r := range p.replicas {
+			if r.isHealthy() {
+				healthy++
+			}
+		}
+		if healthy == 0 {
+			return nil
+		}
+
+		next := int(atomic.AddUint32(&p.next, 1) % uint32(healthy))
+		var last *replica
+		for _, r := range p.replicas {
+			if !r.isHealthy() {
+				continue
+			}
+			if next == 0 {
+				return r
+			}
+			next--
+			last = r
+		}
+		// one was ejected since they were counted
+		return last
+	}
+}
+
+// start probes the replicas every probeInterval until close
+func (p *replicaPool) start() {
+	if len(p.replicas) == 0 {
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		ticker := time.NewTicker(p.probeInterval)
+		defer ticker.Stop()
+
+		for {
+			p.probeAll()
+
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (p *replicaPool) close() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	p.wg.Wait()
+}
+
+func (p *replicaPool) probeAll() {
+	var wg sync.WaitGroup
+	for _, r := range p.replicas {
+		wg.Add(1)
+		go func(r *replica) {
+			defer wg.Done()
+			p.probe(r)
+		}(r)
+	}
+	wg.Wait()
+}
+
+// probe checks the replica's lag & latency and ejects it (or brings it back) based off of them
+func (p *replicaPool) probe(r *replica) {
+	ctx := withObserver(p.log.withContext(context.Background()), p.observer, p.service)
+	ctx, cancel := context.WithTimeout(ctx, p.probeInterval)
+	defer cancel()
+
+	var (
+		lagSeconds float64
+		lsn        sql.NullString
+	)
+	started := time.Now()
+	err := r.conn.QueryRowContext(ctx, replicaProbeQuery).Scan(&lagSeconds, &lsn)
+	latency := time.Since(started)
+	if err != nil {
+		if r.isHealthy() {
+			logError(ctx, "ejecting read replica; probe failed", err)
+		}
+		r.setHealthy(false)
+		return
+	}
+
+	// moving average so one slow probe doesn't swing the selection
+	old := atomic.LoadInt64(&r.latency)
+	if old == 0 {
+		atomic.StoreInt64(&r.latency, int64(latency))
+	} else {
+		atomic.StoreInt64(&r.latency, int64(replicaLatencyWeight*float64(latency)+(1-replicaLatencyWeight)*float64(old)))
+	}
+
+	if lsn.Valid {
+		if position, err := parseLSN(lsn.String); err == nil {
+			storeMax(&r.replayLSN, position)
+		}
+	} else {
+		storeMax(&r.replayLSN, replicaNotReplaying)
+	}
+
+	lag := time.Duration(lagSeconds * float64(time.Second))
+	if lag > p.maxLag {
+		if r.isHealthy() {
+			logError(ctx, "ejecting read replica; it's lagging", fmt.Errorf("%s behind", lag))
+		}
+		r.setHealthy(false)
+		return
+	}
+
+	if !r.isHealthy() {
+		logInfo(ctx, fmt.Sprintf("read replica is healthy again; lag: %s latency: %s", lag, latency))
+	}
+	r.setHealthy(true)
+}
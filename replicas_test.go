@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func testReplicaPool(t *testing.T, selection ReplicaSelection, n int) *replicaPool {
+	conns := make([]*sqlx.DB, n)
+	for i := range conns {
+		conns[i] = stubConn(t, t.Name()+string(rune('a'+i)), stubRow(float64(0), []byte("0/0")))
+	}
+	return newReplicaPool(&Config{ReadOnlyDbConns: conns, ReplicaSelection: selection, MaxReplicaLag: time.Second})
+}
+
+func TestPickRoundRobin(t *testing.T) {
+	p := testReplicaPool(t, ReplicaRoundRobin, 3)
+	p.replicas[1].setHealthy(false)
+
+	picked := map[*replica]int{}
+	for i := 0; i < 10; i++ {
+		picked[p.pick()]++
+	}
+	if picked[p.replicas[1]] != 0 {
+		t.Errorf("picked the unhealthy replica %d times", picked[p.replicas[1]])
+	}
+	if picked[p.replicas[0]] != 5 || picked[p.replicas[2]] != 5 {
+		t.Errorf("picked the healthy replicas %d & %d times, want 5 each", picked[p.replicas[0]], picked[p.replicas[2]])
+	}
+
+	for _, r := range p.replicas {
+		r.setHealthy(false)
+	}
+	if r := p.pick(); r != nil {
+		t.Errorf("pick with no healthy replicas = %v, want nil", r)
+	}
+
+	if r := newReplicaPool(&Config{}).pick(); r != nil {
+		t.Errorf("pick with no replicas = %v, want nil", r)
+	}
+}
+
+func TestPickLeastLatency(t *testing.T) {
+	p := testReplicaPool(t, ReplicaLeastLatency, 3)
+	p.replicas[0].latency = int64(20 * time.Millisecond)
+	p.replicas[1].latency = int64(5 * time.Millisecond)
+	p.replicas[2].latency = int64(10 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		if r := p.pick(); r != p.replicas[1] {
+			t.Fatalf("pick = replica with latency %s, want the 5ms one", time.Duration(r.latency))
+		}
+	}
+
+	p.replicas[1].setHealthy(false)
+	if r := p.pick(); r != p.replicas[2] {
+		t.Errorf("pick = replica with latency %s, want the 10ms one once the 5ms one is unhealthy", time.Duration(r.latency))
+	}
+
+	for _, r := range p.replicas {
+		r.setHealthy(false)
+	}
+	if r := p.pick(); r != nil {
+		t.Errorf("pick with no healthy replicas = %v, want nil", r)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	p := testReplicaPool(t, ReplicaRoundRobin, 1)
+	r := p.replicas[0]
+	name := t.Name() + "a"
+
+	steps := []struct {
+		name    string
+		lag     float64 // seconds
+		lsn     interface{}
+		fail    bool
+		healthy bool
+		lsnWant uint64
+	}{
+		{name: "caught up", lag: 0, lsn: []byte("0/10"), healthy: true, lsnWant: 0x10},
+		{name: "lagging", lag: 2, lsn: []byte("0/20"), healthy: false, lsnWant: 0x20},
+		{name: "recovered", lag: 0.5, lsn: []byte("0/30"), healthy: true, lsnWant: 0x30},
+		{name: "failed", fail: true, healthy: false, lsnWant: 0x30},
+		{name: "back", lag: 0, lsn: []byte("0/28"), healthy: true, lsnWant: 0x30}, // the replay lsn never goes back
+		{name: "not a replica", lag: 0, lsn: nil, healthy: true, lsnWant: replicaNotReplaying},
+	}
+
+	for _, s := range steps {
+		if s.fail {
+			stubQuery(name, stubRow())
+		} else {
+			stubQuery(name, stubRow(s.lag, s.lsn))
+		}
+
+		p.probe(r)
+		if r.isHealthy() != s.healthy {
+			t.Errorf("%s: healthy = %v, want %v", s.name, r.isHealthy(), s.healthy)
+		}
+		if r.replayLSN != s.lsnWant {
+			t.Errorf("%s: replayLSN = %#x, want %#x", s.name, r.replayLSN, s.lsnWant)
+		}
+	}
+
+	if r.latency <= 0 {
+		t.Errorf("latency = %d, want the probes' moving average", r.latency)
+	}
+}
+
+func TestReadConnFallsBackToPrimary(t *testing.T) {
+	primary := stubConn(t, "primary", stubRow([]byte("0/0")))
+	p := testReplicaPool(t, ReplicaRoundRobin, 2)
+	db := &db{writeConnection: primary, replicas: p}
+
+	if got := db.readConn(context.Background()); got == primary {
+		t.Error("readConn = the primary with healthy replicas")
+	}
+
+	for _, r := range p.replicas {
+		r.setHealthy(false)
+	}
+	if got := db.readConn(context.Background()); got != primary {
+		t.Error("readConn with no healthy replicas should be the primary")
+	}
+	if got := db.consistentReadConn(context.Background()); got != primary {
+		t.Error("consistentReadConn with ConsistencyOff & no healthy replicas should be the primary")
+	}
+}
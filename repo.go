@@ -0,0 +1,103 @@
+package storage
+
+import "context"
+
+/*
+	The typed API: a TableRef[T] registers the queries of a table whose Struct is a T and returns a QueryRef[T] for each, and a
+	Repo[T] only takes the QueryRefs & structs of that same T. That way a query of the leads table being used with a Users struct
+	(or a typo in a query name) is a compile error instead of an error at runtime.
+
+	e.g.
+		var leadsTable = storage.NewTable[Leads](&storage.Table{PrimaryKeyField: "lead_id", ...})
+		var leadsGetByID = leadsTable.Query(&storage.Query{Name: "LeadsGetByID", ...})
+
+		leads := storage.NewRepo[Leads](s) // or storage.NewRepo[Leads](tx) inside a transaction
+		lead, err := leads.Get(ctx, leadsGetByID, Leads{LeadID: 4})
+*/
+
+// Querier is what a Repo runs its queries on; both Storage & TxInterface are Queriers
+type Querier interface {
+	Insert(ctx context.Context, obj interface{}) error
+	Update(ctx context.Context, obj interface{}) error
+	Delete(ctx context.Context, obj interface{}) error
+	Restore(ctx context.Context, obj interface{}) error
+	Select(ctx context.Context, obj interface{}, key string) error
+	SelectAll(ctx context.Context, obj interface{}, objs interface{}, key string, opts *SelectOptions) error
+}
+
+// TableRef is a Table whose Struct is a T; pass TableRef.Table to Config.Tables
+type TableRef[T any] struct {
+	*Table
+}
+
+// NewTable sets the table's Struct to a T & returns it as a TableRef[T]
+func NewTable[T any](t *Table) *TableRef[T] {
+	var row T
+	t.Struct = row
+	return &TableRef[T]{Table: t}
+}
+
+// Query adds q to the table's Queries & returns a QueryRef[T] to use with a Repo[T]
+func (t *TableRef[T]) Query(q *Query) QueryRef[T] {
+	t.Queries = append(t.Queries, q)
+	return QueryRef[T]{name: q.Name}
+}
+
+// QueryRef is a query of a table whose Struct is a T
+type QueryRef[T any] struct {
+	name string
+}
+
+// Name is the query's Name e.g. for Storage.KeyName
+func (q QueryRef[T]) Name() string {
+	return q.name
+}
+
+// Repo runs the queries of a table whose Struct is a T on a Storage or a TxInterface
+type Repo[T any] struct {
+	q Querier
+}
+
+func NewRepo[T any](q Querier) *Repo[T] {
+	return &Repo[T]{q: q}
+}
+
+// Get returns the row of query where key has the fields the query needs e.g. Leads{LeadID: 4} for LeadsGetByID
+func (r *Repo[T]) Get(ctx context.Context, query QueryRef[T], key T) (*T, error) {
+	row := key
+	err := r.q.Select(ctx, &row, query.name)
+	if err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
+
+// List returns the rows of query where key has the fields the query needs e.g. Leads{UserID: 2} for LeadsGetByUserID
+func (r *Repo[T]) List(ctx context.Context, query QueryRef[T], key T, opts *SelectOptions) ([]T, error) {
+	rows := []T{}
+	err := r.q.SelectAll(ctx, &key, &rows, query.name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Insert inserts obj & fills it out with the inserted row
+func (r *Repo[T]) Insert(ctx context.Context, obj *T) error {
+	return r.q.Insert(ctx, obj)
+}
+
+// Update updates obj & fills it out with the updated row
+func (r *Repo[T]) Update(ctx context.Context, obj *T) error {
+	return r.q.Update(ctx, obj)
+}
+
+// Delete deletes obj & fills it out with the deleted row
+func (r *Repo[T]) Delete(ctx context.Context, obj *T) error {
+	return r.q.Delete(ctx, obj)
+}
+
+// Restore restores the soft deleted obj & fills it out with the restored row
+func (r *Repo[T]) Restore(ctx context.Context, obj *T) error {
+	return r.q.Restore(ctx, obj)
+}
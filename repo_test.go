@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// recordingQuerier is a Querier that records the calls made to it & sets the name of the objs it's given
+type recordingQuerier struct {
+	calls []string
+}
+
+func (q *recordingQuerier) record(call string, obj interface{}) error {
+	q.calls = append(q.calls, call)
+	obj.(*benchLead).Name = call
+	return nil
+}
+
+func (q *recordingQuerier) Insert(ctx context.Context, obj interface{}) error {
+	return q.record("insert", obj)
+}
+func (q *recordingQuerier) Update(ctx context.Context, obj interface{}) error {
+	return q.record("update", obj)
+}
+func (q *recordingQuerier) Delete(ctx context.Context, obj interface{}) error {
+	return q.record("delete", obj)
+}
+func (q *recordingQuerier) Restore(ctx context.Context, obj interface{}) error {
+	return q.record("restore", obj)
+}
+func (q *recordingQuerier) Select(ctx context.Context, obj interface{}, key string) error {
+	return q.record("select "+key, obj)
+}
+func (q *recordingQuerier) SelectAll(ctx context.Context, obj interface{}, objs interface{}, key string, opts *SelectOptions) error {
+	q.calls = append(q.calls, "selectAll "+key)
+	*objs.(*[]benchLead) = []benchLead{*obj.(*benchLead), *obj.(*benchLead)}
+	return nil
+}
+
+func TestRepo(t *testing.T) {
+	ctx := context.Background()
+
+	table := NewTable[benchLead](&Table{PrimaryKeyField: "lead_id", PrimaryQueryName: "LeadsGetByID"})
+	getByID := table.Query(&Query{Name: "LeadsGetByID"})
+	byUser := table.Query(&Query{Name: "LeadsByUser"})
+	if len(table.Queries) != 2 || getByID.Name() != "LeadsGetByID" || byUser.Name() != "LeadsByUser" {
+		t.Fatalf("Queries = %v", table.Queries)
+	}
+	if _, ok := table.Struct.(benchLead); !ok {
+		t.Errorf("Struct = %T, want a benchLead", table.Struct)
+	}
+
+	q := &recordingQuerier{}
+	leads := NewRepo[benchLead](q)
+
+	key := benchLead{LeadID: 4}
+	lead, err := leads.Get(ctx, getByID, key)
+	if err != nil || lead.LeadID != 4 || lead.Name != "select LeadsGetByID" {
+		t.Errorf("Get = %+v, %v", lead, err)
+	}
+	if key.Name != "" {
+		t.Error("Get changed the key")
+	}
+
+	rows, err := leads.List(ctx, byUser, benchLead{UserID: 2}, nil)
+	if err != nil || len(rows) != 2 || rows[0].UserID != 2 {
+		t.Errorf("List = %+v, %v", rows, err)
+	}
+
+	for _, write := range []func(context.Context, *benchLead) error{leads.Insert, leads.Update, leads.Delete, leads.Restore} {
+		err := write(ctx, lead)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"select LeadsGetByID", "selectAll LeadsByUser", "insert", "update", "delete", "restore"}
+	if !reflect.DeepEqual(q.calls, want) {
+		t.Errorf("calls = %v, want %v", q.calls, want)
+	}
+	if lead.Name != "restore" {
+		t.Errorf("Restore didn't fill out the row; Name = %s", lead.Name)
+	}
+}
+
+func TestDeleteEvictsTheRow(t *testing.T) {
+	ctx := context.Background()
+	s, m := stubStorage(t, benchLeads(1), benchLeadsTable())
+
+	err := s.Select(ctx, &benchLead{LeadID: 1}, "LeadsGetByID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := s.KeyName("LeadsGetByID", &benchLead{LeadID: 1})
+	if !m.Exists(key) {
+		t.Fatalf("%s wasn't cached", key)
+	}
+
+	lead := &benchLead{LeadID: 1}
+	err = s.Delete(ctx, lead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Exists(key) {
+		t.Errorf("%s is still cached after the row was deleted", key)
+	}
+	if lead.Email != "jane@example.com" {
+		t.Errorf("Delete didn't fill out the deleted row: %+v", lead)
+	}
+}
+
+func TestDeleteQueryMustReturnTheRow(t *testing.T) {
+	table := &Table{DeleteQuery: "delete from leads where lead_id=:lead_id"}
+	if err := table.validateInsertAndUpdateQueries(); err == nil {
+		t.Error("a DeleteQuery without `returning *`: want an error")
+	}
+}
@@ -1,23 +1,84 @@
 package storage
 
 import (
+	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx/reflectx"
+	"github.com/lib/pq"
 )
 
+/*
+	fieldMapper maps the json tags of a struct to its fields. It's the same mapping that's used for the db connections in New
+	so a column, a key in an objMap, and a json tag are always the same name.
+
+	The fields of each struct type are found once and cached in structFields so converting between a struct & its objMap is
+	just setting fields rather than a json.Marshal & json.Unmarshal round-trip.
+*/
+var fieldMapper = reflectx.NewMapperFunc("json", strings.ToLower)
+
+// structFields is a cache of reflect.Type -> []*reflectx.FieldInfo of the top level fields of the struct (embedded structs are flattened)
+var structFields sync.Map
+
+func columnsOf(t reflect.Type) []*reflectx.FieldInfo {
+	if fields, ok := structFields.Load(t); ok {
+		return fields.([]*reflectx.FieldInfo)
+	}
+
+	fields := []*reflectx.FieldInfo{}
+	for _, fi := range fieldMapper.TypeMap(t).Index {
+		// embedded structs are flattened & we only want the columns, not the fields of a column's struct e.g. time.Time
+		if fi.Embedded || strings.Contains(fi.Path, ".") {
+			continue
+		}
+		fields = append(fields, fi)
+	}
+
+	structFields.Store(t, fields)
+	return fields
+}
+
 // structToMap converts a struct to a map and adds the struct name as a key
 func structToMap(obj interface{}) (map[string]interface{}, error) {
-	// lol...
-	m := map[string]interface{}{}
-
-	j, err := json.Marshal(obj)
-	if err != nil {
-		return nil, err
+	v := reflect.Indirect(reflect.ValueOf(obj))
+	if !v.IsValid() {
+		return nil, fmt.Errorf("cannot convert %T to a map", obj)
 	}
 
+	m := map[string]interface{}{}
 	m[objMapStructNameKey] = getStructName(obj)
 
-	return m, json.Unmarshal(j, &m)
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, fi := range columnsOf(v.Type()) {
+			m[fi.Name] = reflectx.FieldByIndexesReadOnly(v, fi.Index).Interface()
+		}
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("cannot convert %T to a map", obj)
+		}
+
+		// it's already an objMap e.g. the rows in selectAll
+		iter := v.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = iter.Value().Interface()
+		}
+
+	default:
+		return nil, fmt.Errorf("cannot convert %T to a map", obj)
+	}
+
+	return m, nil
 }
 
 func structToMapWithOptions(obj interface{}, opts *SelectOptions) (map[string]interface{}, error) {
@@ -32,24 +93,545 @@ func structToMapWithOptions(obj interface{}, opts *SelectOptions) (map[string]in
 	return objMap, nil
 }
 
-// mapToStruct converts a map to a struct
+// mapToStruct converts a map to a struct; only the fields in the map are set
 func mapToStruct(m map[string]interface{}, s interface{}) error {
-	j, err := json.Marshal(m)
-	if err != nil {
-		return err
+	v := reflect.ValueOf(s)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("cannot convert a map to %T; must be a pointer", s)
+	}
+
+	return mapToValue(m, v.Elem())
+}
+
+func mapToValue(m map[string]interface{}, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, fi := range columnsOf(v.Type()) {
+			value, ok := m[fi.Name]
+			if !ok {
+				continue
+			}
+
+			err := setValue(reflectx.FieldByIndexes(v, fi.Index), value)
+			if err != nil {
+				return fmt.Errorf("%s: %s", fi.Name, err)
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		if v.Type().Key().Kind() == reflect.String {
+			if v.IsNil() {
+				v.Set(reflect.MakeMapWithSize(v.Type(), len(m)))
+			}
+
+			for k, value := range m {
+				elem := reflect.New(v.Type().Elem()).Elem()
+				err := setValue(elem, value)
+				if err != nil {
+					return fmt.Errorf("%s: %s", k, err)
+				}
+				v.SetMapIndex(reflect.ValueOf(k).Convert(v.Type().Key()), elem)
+			}
+			return nil
+		}
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return mapToValue(m, v.Elem())
 	}
 
-	return json.Unmarshal(j, s)
+	// anything else e.g. an interface{}
+	return setValue(v, m)
 }
 
-// mapsToStruct converts a map to a struct
+// mapsToStruct converts a slice of maps to a pointer to a slice of structs
 func mapsToStruct(m []map[string]interface{}, s interface{}) error {
-	j, err := json.Marshal(m)
+	v := reflect.ValueOf(s)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("cannot convert maps to %T; must be a pointer to a slice", s)
+	}
+
+	slice := reflect.MakeSlice(v.Elem().Type(), len(m), len(m))
+	for i, row := range m {
+		err := mapToValue(row, slice.Index(i))
+		if err != nil {
+			return err
+		}
+	}
+
+	v.Elem().Set(slice)
+	return nil
+}
+
+// structsToSlice puts the rows (pointers to structs) into s which is a pointer to a slice of structs or pointers to structs
+func structsToSlice(rows []interface{}, s interface{}) error {
+	v := reflect.ValueOf(s)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("cannot convert rows to %T; must be a pointer to a slice", s)
+	}
+
+	slice := reflect.MakeSlice(v.Elem().Type(), len(rows), len(rows))
+	for i, row := range rows {
+		err := copyRow(row, slice.Index(i).Addr().Interface())
+		if err != nil {
+			return err
+		}
+	}
+
+	v.Elem().Set(slice)
+	return nil
+}
+
+// copyRow copies the row (a pointer to a struct) into obj. If obj is a pointer to the same struct then it's a straight copy
+func copyRow(row interface{}, obj interface{}) error {
+	src := reflect.ValueOf(row)
+	dst := reflect.ValueOf(obj)
+	if dst.Kind() != reflect.Ptr || dst.IsNil() {
+		return fmt.Errorf("cannot copy a row to %T; must be a pointer", obj)
+	}
+
+	switch {
+	case src.Type() == dst.Type():
+		dst.Elem().Set(src.Elem())
+		return nil
+	case src.Type() == dst.Elem().Type():
+		// e.g. a *Leads into a *(*Leads)
+		dst.Elem().Set(src)
+		return nil
+	}
+
+	m, err := structToMap(row)
+	if err != nil {
+		return err
+	}
+	return mapToStruct(m, obj)
+}
+
+/*
+	setValue sets dst to value, converting value if need be. The values in an objMap can come from a struct, the db (e.g. int64 or
+	[]byte), or the cache (e.g. float64 or string from json) so the conversions are the ones between those.
+*/
+func setValue(dst reflect.Value, value interface{}) error {
+	if value == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	src := reflect.ValueOf(value)
+	if src.Type().AssignableTo(dst.Type()) {
+		dst.Set(src)
+		return nil
+	}
+
+	if src.Kind() == reflect.Ptr {
+		if src.IsNil() {
+			dst.Set(reflect.Zero(dst.Type()))
+			return nil
+		}
+		return setValue(dst, src.Elem().Interface())
+	}
+
+	if dst.Kind() == reflect.Ptr {
+		ptr := reflect.New(dst.Type().Elem())
+		err := setValue(ptr.Elem(), value)
+		if err != nil {
+			return err
+		}
+		dst.Set(ptr)
+		return nil
+	}
+
+	if dst.Type() == bigIntType {
+		return setBigInt(dst.Addr().Interface().(*big.Int), value)
+	}
+
+	if dst.Type() == timeType {
+		switch v := value.(type) {
+		case string:
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return err
+			}
+			dst.Set(reflect.ValueOf(t))
+			return nil
+		case []byte:
+			return setValue(dst, string(v))
+		}
+	}
+
+	// e.g. sql.NullString, pq.Int64Array, or a uuid type. Values decoded from json (maps & slices) go through json instead
+	if scanner, ok := dst.Addr().Interface().(sql.Scanner); ok && !isJSONComposite(value) {
+		return scanner.Scan(driverValue(value))
+	}
+
+	// e.g. a JSONB column into a map or struct, or a postgres array into a slice
+	if raw, ok := rawBytes(value); ok {
+		switch dst.Kind() {
+		case reflect.Map, reflect.Struct, reflect.Interface:
+			return json.Unmarshal(raw, dst.Addr().Interface())
+		case reflect.Slice:
+			if len(raw) > 0 && raw[0] == '{' {
+				return pq.Array(dst.Addr().Interface()).Scan(raw)
+			}
+			return json.Unmarshal(raw, dst.Addr().Interface())
+		}
+	}
+
+	switch dst.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch v := value.(type) {
+		case string:
+			i, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return err
+			}
+			dst.SetInt(i)
+			return nil
+		case []byte:
+			return setValue(dst, string(v))
+		case json.Number:
+			return setValue(dst, string(v))
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		switch v := value.(type) {
+		case string:
+			i, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return err
+			}
+			dst.SetUint(i)
+			return nil
+		case []byte:
+			return setValue(dst, string(v))
+		case json.Number:
+			return setValue(dst, string(v))
+		}
+
+	case reflect.Bool:
+		switch v := value.(type) {
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			dst.SetBool(b)
+			return nil
+		case []byte:
+			return setValue(dst, string(v))
+		}
+
+	case reflect.Float32, reflect.Float64:
+		switch v := value.(type) {
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return err
+			}
+			dst.SetFloat(f)
+			return nil
+		case []byte:
+			return setValue(dst, string(v))
+		case json.Number:
+			return setValue(dst, string(v))
+		}
+	}
+
+	if convertible(src.Type(), dst.Type()) {
+		dst.Set(src.Convert(dst.Type()))
+		return nil
+	}
+
+	// everything else e.g. a time.Time from a json string or a nested struct from a map goes through json
+	j, err := json.Marshal(value)
 	if err != nil {
 		return err
 	}
+	return json.Unmarshal(j, dst.Addr().Interface())
+}
+
+var (
+	bigIntType = reflect.TypeOf(big.Int{})
+	timeType   = reflect.TypeOf(time.Time{})
+)
+
+// setBigInt sets the value of a numeric column e.g. `numeric(40)` into i
+func setBigInt(i *big.Int, value interface{}) error {
+	switch v := value.(type) {
+	case big.Int:
+		i.Set(&v)
+		return nil
+	case int64:
+		i.SetInt64(v)
+		return nil
+	case uint64:
+		i.SetUint64(v)
+		return nil
+	case float64:
+		return setBigInt(i, strconv.FormatFloat(v, 'f', -1, 64))
+	case json.Number:
+		return setBigInt(i, string(v))
+	case []byte:
+		return setBigInt(i, string(v))
+	case string:
+		if _, ok := i.SetString(v, 10); !ok {
+			return fmt.Errorf("cannot convert %s to a big.Int", v)
+		}
+		return nil
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i.SetInt64(rv.Int())
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i.SetUint64(rv.Uint())
+		return nil
+	}
+	return fmt.Errorf("cannot convert %T to a big.Int", value)
+}
+
+// isJSONComposite returns true if the value is an object or array decoded from json
+func isJSONComposite(value interface{}) bool {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		return true
+	}
+	return false
+}
+
+// rawBytes returns the bytes of a string or []byte value
+func rawBytes(value interface{}) ([]byte, bool) {
+	switch v := value.(type) {
+	case []byte:
+		return v, true
+	case string:
+		return []byte(v), true
+	case json.RawMessage:
+		return v, true
+	}
+	return nil, false
+}
+
+// driverValue converts a value to one of the types a sql.Scanner expects from a driver e.g. int64, float64, []byte, string, time.Time
+func driverValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, int64, float64, bool, []byte, string, time.Time:
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return string(v)
+	case driver.Valuer:
+		dv, err := v.Value()
+		if err != nil {
+			return value
+		}
+		return dv
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return int64(rv.Uint())
+	case reflect.Float32:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	}
+	return value
+}
+
+/*
+	keyValue formats a value of an objMap for a cache key. It's the same for a value no matter where it came from:
+	- NULLs (nil, nil pointers, invalid sql.Null*, empty json.RawMessages) are `null`
+	- pointers are the value they point to
+	- driver.Valuers (e.g. sql.NullInt64, pq arrays, uuids) are the value they send to the db
+	- times are RFC3339 in UTC
+*/
+func keyValue(value interface{}) string {
+	if value == nil {
+		return "null"
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return "null"
+	}
+
+	switch v := value.(type) {
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return string(v)
+	case json.RawMessage:
+		if len(v) == 0 {
+			// a NULL JSONB column; it's `null` once it's been through json
+			return "null"
+		}
+		return string(v)
+	case *big.Int:
+		return v.String()
+	case driver.Valuer:
+		dv, err := v.Value()
+		if err != nil {
+			return fmt.Sprint(value)
+		}
+		if _, ok := dv.(driver.Valuer); ok {
+			// don't loop forever on a Valuer that returns itself
+			return fmt.Sprint(dv)
+		}
+		return keyValue(dv)
+	}
+
+	if rv.Kind() == reflect.Ptr {
+		return keyValue(rv.Elem().Interface())
+	}
+
+	return fmt.Sprint(value)
+}
+
+/*
+	namedArgs converts the values of an objMap to what the driver can take as a named parameter:
+	- json.RawMessage, maps, and structs (e.g. a JSONB column) are sent as json
+	- slices (e.g. an array column) are sent as postgres arrays
+	- big ints (e.g. a numeric column) are sent as strings
+*/
+func namedArgs(objMap map[string]interface{}) map[string]interface{} {
+	args := make(map[string]interface{}, len(objMap))
+	for k, v := range objMap {
+		args[k] = namedArg(v)
+	}
+	return args
+}
+
+func namedArg(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, driver.Valuer, time.Time, []byte:
+		return v
+	case json.RawMessage:
+		if len(v) == 0 {
+			return nil
+		}
+		return string(v)
+	case *big.Int:
+		if v == nil {
+			return nil
+		}
+		return v.String()
+	case big.Int:
+		return v.String()
+	case uint64:
+		if v > math.MaxInt64 {
+			return strconv.FormatUint(v, 10)
+		}
+		return v
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil
+		}
+		return namedArg(rv.Elem().Interface())
+	case reflect.Slice:
+		return pq.Array(value)
+	case reflect.Map, reflect.Struct:
+		j, err := json.Marshal(value)
+		if err != nil {
+			return value
+		}
+		return string(j)
+	}
+	return value
+}
+
+// convertible is reflect's ConvertibleTo but only between the same family of kinds e.g. an int can't be converted to a string
+func convertible(src reflect.Type, dst reflect.Type) bool {
+	if !src.ConvertibleTo(dst) {
+		return false
+	}
+
+	return kindFamily(src) == kindFamily(dst)
+}
+
+func kindFamily(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// []byte <-> string
+			return "string"
+		}
+	}
+	return t.String()
+}
+
+// newRow returns a pointer to a new struct of the table's Struct
+func (t *Table) newRow() interface{} {
+	return reflect.New(t.structType).Interface()
+}
+
+// rowFromMap returns a pointer to a new struct of the table's Struct with the values of objMap
+func (t *Table) rowFromMap(objMap map[string]interface{}) (interface{}, error) {
+	row := t.newRow()
+	return row, mapToStruct(objMap, row)
+}
+
+/*
+	listMember is what a cached list stores for the row: its primary key as it'd be in a cache key e.g. `12` or a uuid.
+	Composite primary keys are a json array in the order of PrimaryKeyFields e.g. `["4","12"]`
+*/
+func (t *Table) listMember(objMap map[string]interface{}) (string, error) {
+	if len(t.pkFields) == 1 {
+		return keyValue(objMap[t.pkFields[0]]), nil
+	}
+
+	values := make([]string, len(t.pkFields))
+	for i, field := range t.pkFields {
+		values[i] = keyValue(objMap[field])
+	}
+	b, err := json.Marshal(values)
+	return string(b), err
+}
+
+// rowFromListMember returns a pointer to a new struct of the table's Struct with only the primary key from listMember set
+func (t *Table) rowFromListMember(member string) (interface{}, error) {
+	pk := map[string]interface{}{}
+	if len(t.pkFields) == 1 {
+		pk[t.pkFields[0]] = member
+	} else {
+		values := []string{}
+		err := json.Unmarshal([]byte(member), &values)
+		if err != nil {
+			return nil, fmt.Errorf("list member %s of %s is not a composite primary key: %s", member, t.tableName, err)
+		}
+		if len(values) != len(t.pkFields) {
+			return nil, fmt.Errorf("list member %s of %s has %d values; primary key has %d fields", member, t.tableName, len(values), len(t.pkFields))
+		}
+		for i, field := range t.pkFields {
+			pk[field] = values[i]
+		}
+	}
 
-	return json.Unmarshal(j, s)
+	// mapToStruct converts the strings to the primary key fields' types
+	return t.rowFromMap(pk)
 }
 
 func getStructName(myvar interface{}) string {
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+type benchLead struct {
+	LeadID    int64     `json:"lead_id"`
+	UserID    int64     `json:"user_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Notes     string    `json:"notes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var benchCreatedAt = time.Date(2021, 11, 19, 0, 0, 0, 0, time.UTC)
+
+// benchLeads is a stubFunc that returns a lead for a query by lead_id & n leads for anything else
+func benchLeads(n int) stubFunc {
+	return func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		count := n
+		if strings.Contains(query, "lead_id=") {
+			count = 1
+		}
+
+		rows := make([][]driver.Value, count)
+		for i := range rows {
+			rows[i] = []driver.Value{
+				int64(i + 1), int64(2), []byte("Jane Doe"), []byte("jane@example.com"),
+				[]byte("called about the renewal; follow up next week"), benchCreatedAt,
+			}
+		}
+		return []string{"lead_id", "user_id", "name", "email", "notes", "created_at"}, rows, nil
+	}
+}
+
+// benchLeadsTable is a table of benchLeads that are cached by lead_id & in a list by user_id
+func benchLeadsTable() *Table {
+	return &Table{
+		Struct:           &benchLead{},
+		PrimaryKeyField:  "lead_id",
+		PrimaryQueryName: "LeadsGetByID",
+		DeleteQuery:      "delete from leads where lead_id=:lead_id returning *",
+		Queries: []*Query{
+			{
+				Name:         "LeadsGetByID",
+				CacheKey:     "lead_id=%v",
+				Query:        "select * from leads where lead_id=:lead_id",
+				InsertAction: CacheSet,
+				UpdateAction: CacheSet,
+				SelectAction: CacheSet,
+			},
+			{
+				Name:                    "LeadsByUser",
+				CacheKey:                "user_id=%v",
+				CachePrimaryQueryStored: "LeadsGetByID",
+				Query:                   "select * from leads where user_id=:user_id order by lead_id",
+				InsertAction:            CacheRPush,
+				UpdateAction:            CacheNoAction,
+				SelectAction:            CacheRPush,
+			},
+		},
+	}
+}
+
+// benchStorage is a Storage of benchLeads with redis in memory & a db that returns rows leads for a list
+func benchStorage(b *testing.B, rows int) Storage {
+	s, _ := stubStorage(b, benchLeads(rows), benchLeadsTable())
+	return s
+}
+
+// BenchmarkSelect is a Select by the primary key that's a cache hit & one that's a miss read from the db & cached
+func BenchmarkSelect(b *testing.B) {
+	ctx := context.Background()
+
+	b.Run("hit", func(b *testing.B) {
+		s := benchStorage(b, 1)
+		err := s.Select(ctx, &benchLead{LeadID: 1}, "LeadsGetByID")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			lead := &benchLead{LeadID: 1}
+			err := s.Select(ctx, lead, "LeadsGetByID")
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("miss", func(b *testing.B) {
+		s := benchStorage(b, 1)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			lead := &benchLead{LeadID: int64(i)}
+			err := s.Select(ctx, lead, "LeadsGetByID")
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkSelectAll is a page of 100 leads from a list that's cached & one that's filled from the db
+func BenchmarkSelectAll(b *testing.B) {
+	ctx := context.Background()
+	opts := &SelectOptions{Limit: 100}
+
+	b.Run("hit", func(b *testing.B) {
+		s := benchStorage(b, 100)
+		var leads []*benchLead
+		err := s.SelectAll(ctx, &benchLead{UserID: 2}, &leads, "LeadsByUser", opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			var leads []*benchLead
+			err := s.SelectAll(ctx, &benchLead{UserID: 2}, &leads, "LeadsByUser", opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("miss", func(b *testing.B) {
+		s := benchStorage(b, 100)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			var leads []*benchLead
+			err := s.SelectAll(ctx, &benchLead{UserID: int64(i)}, &leads, "LeadsByUser", opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,534 @@
+package storage
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type int64Ptr = *int64
+
+func newInt64(i int64) *int64 {
+	return &i
+}
+
+func newBigInt(s string) *big.Int {
+	i, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic("bad big.Int " + s)
+	}
+	return i
+}
+
+/*
+	valueCases are the types of columns that have bitten us before. Each is the value in the struct (value), its cache key value
+	(key), what the driver is sent as its named parameter (arg), and what the driver returns when it's selected (db)
+*/
+var valueCases = []struct {
+	name  string
+	value interface{}
+	key   string
+	arg   driver.Value
+	db    interface{}
+}{
+	{
+		name:  "int64 above 2^53",
+		value: int64(1<<53 + 1),
+		key:   "9007199254740993",
+		arg:   int64(1<<53 + 1),
+		db:    int64(1<<53 + 1),
+	},
+	{
+		name:  "max int64",
+		value: int64(math.MaxInt64),
+		key:   "9223372036854775807",
+		arg:   int64(math.MaxInt64),
+		db:    int64(math.MaxInt64),
+	},
+	{
+		name:  "nil pointer",
+		value: int64Ptr(nil),
+		key:   "null",
+		arg:   nil,
+		db:    nil,
+	},
+	{
+		name:  "pointer to zero",
+		value: newInt64(0),
+		key:   "0",
+		arg:   int64(0),
+		db:    int64(0),
+	},
+	{
+		name:  "pointer above 2^53",
+		value: newInt64(1<<53 + 1),
+		key:   "9007199254740993",
+		arg:   int64(1<<53 + 1),
+		db:    int64(1<<53 + 1),
+	},
+	{
+		name:  "NULL sql.NullString",
+		value: sql.NullString{},
+		key:   "null",
+		arg:   nil,
+		db:    nil,
+	},
+	{
+		name:  "empty sql.NullString",
+		value: sql.NullString{Valid: true},
+		key:   "",
+		arg:   "",
+		db:    []byte{},
+	},
+	{
+		name:  "NULL sql.NullInt64",
+		value: sql.NullInt64{},
+		key:   "null",
+		arg:   nil,
+		db:    nil,
+	},
+	{
+		name:  "zero sql.NullInt64",
+		value: sql.NullInt64{Valid: true},
+		key:   "0",
+		arg:   int64(0),
+		db:    int64(0),
+	},
+	{
+		name:  "sql.NullInt64 above 2^53",
+		value: sql.NullInt64{Int64: 1<<53 + 1, Valid: true},
+		key:   "9007199254740993",
+		arg:   int64(1<<53 + 1),
+		db:    int64(1<<53 + 1),
+	},
+	{
+		name:  "uuid string",
+		value: "3f2c8a4e-9b1d-4c6e-8f0a-2d5b7e9c1a34",
+		key:   "3f2c8a4e-9b1d-4c6e-8f0a-2d5b7e9c1a34",
+		arg:   "3f2c8a4e-9b1d-4c6e-8f0a-2d5b7e9c1a34",
+		db:    []byte("3f2c8a4e-9b1d-4c6e-8f0a-2d5b7e9c1a34"),
+	},
+	{
+		name:  "pq.StringArray",
+		value: pq.StringArray{"OPEN", "WON,LOST"},
+		key:   `{"OPEN","WON,LOST"}`,
+		arg:   `{"OPEN","WON,LOST"}`,
+		db:    []byte(`{"OPEN","WON,LOST"}`),
+	},
+	{
+		name:  "int64 slice as a postgres array",
+		value: []int64{1, 1<<53 + 1},
+		key:   "[1 9007199254740993]",
+		arg:   "{1,9007199254740993}",
+		db:    []byte("{1,9007199254740993}"),
+	},
+	{
+		name:  "json.RawMessage",
+		value: json.RawMessage(`{"stage":"demo"}`),
+		key:   `{"stage":"demo"}`,
+		arg:   `{"stage":"demo"}`,
+		db:    []byte(`{"stage":"demo"}`),
+	},
+	{
+		name:  "NULL json.RawMessage",
+		value: json.RawMessage(nil),
+		key:   "null",
+		arg:   nil,
+		db:    nil,
+	},
+	{
+		name:  "JSONB map",
+		value: map[string]string{"stage": "demo"},
+		key:   "map[stage:demo]",
+		arg:   `{"stage":"demo"}`,
+		db:    []byte(`{"stage":"demo"}`),
+	},
+	{
+		name:  "big.Int",
+		value: newBigInt("1180591620717411303424"),
+		key:   "1180591620717411303424",
+		arg:   "1180591620717411303424",
+		db:    []byte("1180591620717411303424"),
+	},
+	{
+		name:  "negative big.Int",
+		value: newBigInt("-1180591620717411303424"),
+		key:   "-1180591620717411303424",
+		arg:   "-1180591620717411303424",
+		db:    []byte("-1180591620717411303424"),
+	},
+	{
+		name:  "nil big.Int",
+		value: (*big.Int)(nil),
+		key:   "null",
+		arg:   nil,
+		db:    nil,
+	},
+	{
+		name:  "time",
+		value: time.Date(2021, 11, 19, 8, 30, 0, 500, time.FixedZone("PST", -8*60*60)),
+		key:   "2021-11-19T16:30:00.0000005Z",
+		arg:   time.Date(2021, 11, 19, 8, 30, 0, 500, time.FixedZone("PST", -8*60*60)),
+		db:    time.Date(2021, 11, 19, 8, 30, 0, 500, time.FixedZone("PST", -8*60*60)),
+	},
+}
+
+// valuesEqual compares values by their key as well since e.g. big.Ints & times with the same value aren't always DeepEqual
+func valuesEqual(a interface{}, b interface{}) bool {
+	if ta, ok := a.(time.Time); ok {
+		tb, ok := b.(time.Time)
+		return ok && ta.Equal(tb)
+	}
+	if reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return false
+	}
+	return reflect.DeepEqual(a, b) || keyValue(a) == keyValue(b)
+}
+
+func TestKeyValue(t *testing.T) {
+	for _, c := range valueCases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := keyValue(c.value); got != c.key {
+				t.Errorf("keyValue(%#v) = %q, want %q", c.value, got, c.key)
+			}
+
+			// the key is the same whether the row came from a struct or the db
+			dst := reflect.New(reflect.TypeOf(c.value)).Elem()
+			err := setValue(dst, c.db)
+			if err != nil {
+				t.Fatalf("setValue(%T, %#v): %s", c.value, c.db, err)
+			}
+			if got := keyValue(dst.Interface()); got != c.key {
+				t.Errorf("keyValue of the db's %#v = %q, want %q", c.db, got, c.key)
+			}
+		})
+	}
+}
+
+func TestGetKeyName(t *testing.T) {
+	for _, c := range valueCases {
+		t.Run(c.name, func(t *testing.T) {
+			q := &Query{Name: "test", CacheKey: "org=acme|value=%v"}
+			q.parseFullCacheKey("test", "Values")
+			err := q.validateAndParseCacheFields()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := q.getKeyName(map[string]interface{}{"value": c.value})
+			if want := "service:test|Values|org=acme|value=" + c.key; got != want {
+				t.Errorf("getKeyName = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestNamedArgs(t *testing.T) {
+	for _, c := range valueCases {
+		t.Run(c.name, func(t *testing.T) {
+			args := namedArgs(map[string]interface{}{"value": c.value})
+
+			// what database/sql does with the arg before it's handed to the driver
+			got, err := driver.DefaultParameterConverter.ConvertValue(args["value"])
+			if err != nil {
+				t.Fatalf("ConvertValue(%#v): %s", args["value"], err)
+			}
+			if b, ok := got.([]byte); ok {
+				got = string(b)
+			}
+
+			if !valuesEqual(got, c.arg) {
+				t.Errorf("namedArgs(%#v) sends %#v, want %#v", c.value, got, c.arg)
+			}
+		})
+	}
+}
+
+func TestNamedArgsUint64(t *testing.T) {
+	args := namedArgs(map[string]interface{}{"small": uint64(12), "big": uint64(math.MaxUint64)})
+	if args["small"] != uint64(12) {
+		t.Errorf("small = %#v, want uint64(12)", args["small"])
+	}
+	if args["big"] != "18446744073709551615" {
+		t.Errorf("big = %#v, want the string 18446744073709551615", args["big"])
+	}
+}
+
+func TestSetValueFromDB(t *testing.T) {
+	for _, c := range valueCases {
+		t.Run(c.name, func(t *testing.T) {
+			dst := reflect.New(reflect.TypeOf(c.value)).Elem()
+			err := setValue(dst, c.db)
+			if err != nil {
+				t.Fatalf("setValue(%T, %#v): %s", c.value, c.db, err)
+			}
+
+			if !valuesEqual(dst.Interface(), c.value) {
+				t.Errorf("setValue(%T, %#v) = %#v, want %#v", c.value, c.db, dst.Interface(), c.value)
+			}
+		})
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	codecs := map[string]Codec{"json": JSONCodec, "msgpack": MsgpackCodec}
+
+	for codecName, codec := range codecs {
+		for _, c := range valueCases {
+			t.Run(codecName+"/"+c.name, func(t *testing.T) {
+				enc := newEncoder(codec)
+				b, err := enc.encode(c.value)
+				if err != nil {
+					t.Fatalf("encode(%#v): %s", c.value, err)
+				}
+
+				// a hash's fields are decoded without knowing their type & then set into the struct
+				var decoded interface{}
+				err = enc.decode(b, &decoded)
+				if err != nil {
+					t.Fatalf("decode: %s", err)
+				}
+
+				dst := reflect.New(reflect.TypeOf(c.value)).Elem()
+				err = setValue(dst, decoded)
+				if err != nil {
+					t.Fatalf("setValue(%T, %#v): %s", c.value, decoded, err)
+				}
+
+				if !valuesEqual(dst.Interface(), c.value) {
+					t.Errorf("round trip of %#v = %#v", c.value, dst.Interface())
+				}
+				if got := keyValue(dst.Interface()); got != c.key {
+					t.Errorf("keyValue after the round trip = %q, want %q", got, c.key)
+				}
+			})
+		}
+	}
+}
+
+// valueRow is a row with a column of each of the valueCases
+type valueRow struct {
+	ID     int64             `json:"id"`
+	Ref    *int64            `json:"ref"`
+	Name   sql.NullString    `json:"name"`
+	Score  sql.NullInt64     `json:"score"`
+	UUID   string            `json:"uuid"`
+	Tags   pq.StringArray    `json:"tags"`
+	IDs    []int64           `json:"ids"`
+	Data   json.RawMessage   `json:"data"`
+	Meta   map[string]string `json:"meta"`
+	Amount *big.Int          `json:"amount"`
+}
+
+func TestEncodeDecodeRow(t *testing.T) {
+	rows := map[string]valueRow{
+		"set": {
+			ID:     1<<53 + 1,
+			Ref:    newInt64(0),
+			Name:   sql.NullString{Valid: true},
+			Score:  sql.NullInt64{Int64: 1<<53 + 1, Valid: true},
+			UUID:   "3f2c8a4e-9b1d-4c6e-8f0a-2d5b7e9c1a34",
+			Tags:   pq.StringArray{"OPEN", "WON,LOST"},
+			IDs:    []int64{1, 1<<53 + 1},
+			Data:   json.RawMessage(`{"stage":"demo"}`),
+			Meta:   map[string]string{"stage": "demo"},
+			Amount: newBigInt("1180591620717411303424"),
+		},
+		"null": {
+			ID: 1,
+		},
+	}
+
+	for _, codec := range []Codec{JSONCodec, MsgpackCodec} {
+		for name, row := range rows {
+			enc := newEncoder(codec)
+
+			// a row is cached as its objMap & read back into the struct
+			objMap, err := structToMap(&row)
+			if err != nil {
+				t.Fatal(err)
+			}
+			delete(objMap, objMapStructNameKey)
+
+			b, err := enc.encode(objMap)
+			if err != nil {
+				t.Fatalf("%T %s: encode: %s", codec, name, err)
+			}
+
+			var got valueRow
+			err = enc.decode(b, &got)
+			if err != nil {
+				t.Fatalf("%T %s: decode: %s", codec, name, err)
+			}
+
+			gotMap, err := structToMap(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for column, value := range objMap {
+				if keyValue(gotMap[column]) != keyValue(value) {
+					t.Errorf("%T %s: %s = %#v after the round trip, want %#v", codec, name, column, gotMap[column], value)
+				}
+			}
+		}
+	}
+}
+
+func TestSetBigInt(t *testing.T) {
+	cases := []struct {
+		name  string
+		value interface{}
+		want  string
+		err   bool
+	}{
+		{name: "int64", value: int64(-42), want: "-42"},
+		{name: "uint64", value: uint64(math.MaxUint64), want: "18446744073709551615"},
+		{name: "int32", value: int32(7), want: "7"},
+		{name: "uint8", value: uint8(255), want: "255"},
+		{name: "float64 from json", value: float64(1e20), want: "100000000000000000000"},
+		{name: "json.Number", value: json.Number("1180591620717411303424"), want: "1180591620717411303424"},
+		{name: "numeric from the db", value: []byte("-1180591620717411303424"), want: "-1180591620717411303424"},
+		{name: "string", value: "1180591620717411303424", want: "1180591620717411303424"},
+		{name: "big.Int", value: *newBigInt("1180591620717411303424"), want: "1180591620717411303424"},
+		{name: "not a number", value: "12abc", err: true},
+		{name: "fraction", value: float64(1.5), err: true},
+		{name: "bool", value: true, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			i := new(big.Int)
+			err := setBigInt(i, c.value)
+			if c.err {
+				if err == nil {
+					t.Errorf("setBigInt(%#v) = %s, want an error", c.value, i)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("setBigInt(%#v): %s", c.value, err)
+			}
+			if i.String() != c.want {
+				t.Errorf("setBigInt(%#v) = %s, want %s", c.value, i, c.want)
+			}
+		})
+	}
+}
+
+type leadStatus string
+
+type badValuer struct{}
+
+func (badValuer) Value() (driver.Value, error) {
+	return nil, errors.New("bad value")
+}
+
+func TestDriverValue(t *testing.T) {
+	cases := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{name: "nil", value: nil, want: nil},
+		{name: "int64", value: int64(1<<53 + 1), want: int64(1<<53 + 1)},
+		{name: "int32", value: int32(-7), want: int64(-7)},
+		{name: "uint16", value: uint16(7), want: int64(7)},
+		{name: "float32", value: float32(1.5), want: float64(1.5)},
+		{name: "json.Number int above 2^53", value: json.Number("9007199254740993"), want: int64(1<<53 + 1)},
+		{name: "json.Number float", value: json.Number("1.5"), want: float64(1.5)},
+		{name: "json.Number too big", value: json.Number("1e400"), want: "1e400"},
+		{name: "string type", value: leadStatus("OPEN"), want: "OPEN"},
+		{name: "bytes", value: []byte("OPEN"), want: []byte("OPEN")},
+		{name: "valid sql.NullString", value: sql.NullString{String: "OPEN", Valid: true}, want: "OPEN"},
+		{name: "NULL sql.NullInt64", value: sql.NullInt64{}, want: nil},
+		{name: "pq array", value: pq.Int64Array{1, 2}, want: "{1,2}"},
+		{name: "Valuer error", value: badValuer{}, want: badValuer{}},
+		{name: "map", value: map[string]interface{}{"a": 1}, want: map[string]interface{}{"a": 1}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := driverValue(c.value)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("driverValue(%#v) = %#v, want %#v", c.value, got, c.want)
+			}
+		})
+	}
+}
+
+type memberLead struct {
+	LeadID int64  `json:"lead_id"`
+	Name   string `json:"name"`
+}
+
+type memberSeat struct {
+	OrgID  int64  `json:"org_id"`
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+func memberTable(t *testing.T, table *Table) *Table {
+	table.PrimaryQueryName = "GetByID"
+	table.Queries = []*Query{{Name: "GetByID"}}
+	err := table.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func TestListMember(t *testing.T) {
+	leads := memberTable(t, &Table{Struct: &memberLead{}, PrimaryKeyField: "lead_id"})
+	seats := memberTable(t, &Table{Struct: &memberSeat{}, PrimaryKeyFields: []string{"org_id", "user_id"}})
+
+	cases := []struct {
+		name   string
+		table  *Table
+		row    interface{}
+		member string
+		pk     interface{}
+	}{
+		{name: "single", table: leads, row: &memberLead{LeadID: 1<<53 + 1, Name: "Jane"}, member: "9007199254740993", pk: &memberLead{LeadID: 1<<53 + 1}},
+		{name: "composite", table: seats, row: &memberSeat{OrgID: 4, UserID: "b5f1", Role: "OWNER"}, member: `["4","b5f1"]`, pk: &memberSeat{OrgID: 4, UserID: "b5f1"}},
+		{name: "composite with a quote", table: seats, row: &memberSeat{OrgID: 4, UserID: `a"b`}, member: `["4","a\"b"]`, pk: &memberSeat{OrgID: 4, UserID: `a"b`}},
+	}
+
+	for _, c := range cases {
+		objMap, err := structToMap(c.row)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		member, err := c.table.listMember(objMap)
+		if err != nil || member != c.member {
+			t.Errorf("%s: listMember = %s, %v; want %s", c.name, member, err, c.member)
+			continue
+		}
+
+		row, err := c.table.rowFromListMember(member)
+		if err != nil {
+			t.Errorf("%s: rowFromListMember: %s", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(row, c.pk) {
+			t.Errorf("%s: rowFromListMember = %+v, want %+v", c.name, row, c.pk)
+		}
+	}
+
+	for _, member := range []string{`4`, `["4"]`, `["4","b5f1","x"]`, `{"org_id":4}`} {
+		if _, err := seats.rowFromListMember(member); err == nil {
+			t.Errorf("rowFromListMember(%s) of a composite key: want an error", member)
+		}
+	}
+	if _, err := leads.rowFromListMember("twelve"); err == nil {
+		t.Error("rowFromListMember(twelve) of an int64 key: want an error")
+	}
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+/*
+	A table with a SoftDeleteField (e.g. `deleted_at`) isn't deleted from: its DeleteQuery is an UPDATE that sets the field &
+	the row is then removed from the cache like any other delete. A row with the field set is never cached & is ignored if it's
+	found in the cache (e.g. it was cached before it was deleted): Select returns sql.ErrNoRows and SelectAll leaves it out.
+	RestoreQuery (optional) unsets the field & the insert actions are taken again (see Storage.Restore).
+*/
+
+// validateSoftDelete checks the SoftDeleteField is a time column that the DeleteQuery (& RestoreQuery) sets
+func (t *Table) validateSoftDelete() error {
+	if t.SoftDeleteField == "" {
+		if t.RestoreQuery != "" {
+			return fmt.Errorf("Table: %s Err: RestoreQuery can only be used with a SoftDeleteField", t.tableName)
+		}
+		return nil
+	}
+
+	column, ok := t.objMap[t.SoftDeleteField]
+	if !ok {
+		return fmt.Errorf("Table: %s Err: SoftDeleteField %s is not a json field of the struct", t.tableName, t.SoftDeleteField)
+	}
+	typ := reflect.TypeOf(column)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ != timeType && typ != nullTimeType {
+		return fmt.Errorf("Table: %s Err: SoftDeleteField %s must be a time.Time, *time.Time, or sql.NullTime; is %T", t.tableName, t.SoftDeleteField, column)
+	}
+
+	if t.DeleteQuery == "" {
+		return fmt.Errorf("Table: %s Err: a SoftDeleteField needs a DeleteQuery that sets it e.g. `update ... set %s=now() where ... returning *`", t.tableName, t.SoftDeleteField)
+	}
+
+	queries := map[string]string{
+		"DeleteQuery":  t.DeleteQuery,
+		"RestoreQuery": t.RestoreQuery,
+	}
+	for name, query := range queries {
+		if query == "" {
+			continue
+		}
+		if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(query)), "update") || !containsString(setColumns(query), t.SoftDeleteField) {
+			return fmt.Errorf("Table: %s Err: %s must be an UPDATE that sets the SoftDeleteField %s", t.tableName, name, t.SoftDeleteField)
+		}
+	}
+	return nil
+}
+
+// isSoftDeleted returns whether the row in objMap has its SoftDeleteField set
+func (t *Table) isSoftDeleted(objMap map[string]interface{}) bool {
+	if t == nil || t.SoftDeleteField == "" {
+		return false
+	}
+
+	deletedAt, ok := orderedValue(objMap[t.SoftDeleteField]).(time.Time)
+	return ok && !deletedAt.IsZero()
+}
+
+// rowIsSoftDeleted is isSoftDeleted of a row (a pointer to the table's Struct)
+func (t *Table) rowIsSoftDeleted(row interface{}) bool {
+	if t == nil || t.SoftDeleteField == "" {
+		return false
+	}
+
+	objMap, err := structToMap(row)
+	if err != nil {
+		return false
+	}
+	return t.isSoftDeleted(objMap)
+}
+
+// withoutSoftDeleted returns the rows that aren't soft deleted
+func (t *Table) withoutSoftDeleted(rows []interface{}) []interface{} {
+	if t == nil || t.SoftDeleteField == "" {
+		return rows
+	}
+
+	res := make([]interface{}, 0, len(rows))
+	for _, row := range rows {
+		if !t.rowIsSoftDeleted(row) {
+			res = append(res, row)
+		}
+	}
+	return res
+}
+
+// anySoftDeleted returns whether any of the rows of dest (a pointer to a slice of the table's Struct or pointers to it) are soft deleted
+func (t *Table) anySoftDeleted(dest interface{}) bool {
+	if t == nil || t.SoftDeleteField == "" {
+		return false
+	}
+
+	rows := reflect.Indirect(reflect.ValueOf(dest))
+	if rows.Kind() != reflect.Slice {
+		return false
+	}
+
+	for i := 0; i < rows.Len(); i++ {
+		if t.rowIsSoftDeleted(rows.Index(i).Interface()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *storage) restoreRow(ctx context.Context, objMap map[string]interface{}, conn InsertInterface) (map[string]interface{}, error) {
+	// get the struct's string name to get config key
+	structName := objMap[objMapStructNameKey].(string)
+	if structName == "" {
+		return nil, errors.New("struct name cannot be blank")
+	}
+
+	// get config key
+	table, ok := s.structToTable[structName]
+	if !ok {
+		return nil, errors.New("no config key found for " + structName)
+	}
+
+	if table.RestoreQuery == "" {
+		return nil, errors.New("no RestoreQuery set for " + structName)
+	}
+
+	res, err := s.db.queryStructs(withTable(ctx, table), objMap, table.RestoreQuery, conn, table.structType)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) != 1 {
+		return nil, errors.New("restore did not return a single row; returned: " + fmt.Sprintf("%d", len(res)))
+	}
+
+	return mergeRow(objMap, res[0])
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+type softLead struct {
+	LeadID    int64      `json:"lead_id"`
+	UserID    int64      `json:"user_id"`
+	DeletedAt *time.Time `json:"deleted_at"`
+}
+
+func TestValidateSoftDelete(t *testing.T) {
+	objMap, err := structToMap(&softLead{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	softDelete := "update leads set deleted_at=now() where lead_id=:lead_id returning *"
+	restore := "update leads set deleted_at=null where lead_id=:lead_id returning *"
+
+	cases := []struct {
+		name  string
+		table Table
+		err   bool
+	}{
+		{name: "not soft deleted", table: Table{DeleteQuery: "delete from leads where lead_id=:lead_id returning *"}},
+		{name: "restore without a field", table: Table{RestoreQuery: restore}, err: true},
+		{name: "not a field", table: Table{SoftDeleteField: "removed_at", DeleteQuery: softDelete}, err: true},
+		{name: "not a time", table: Table{SoftDeleteField: "user_id", DeleteQuery: softDelete}, err: true},
+		{name: "no DeleteQuery", table: Table{SoftDeleteField: "deleted_at"}, err: true},
+		{name: "DeleteQuery deletes", table: Table{SoftDeleteField: "deleted_at", DeleteQuery: "delete from leads where lead_id=:lead_id returning *"}, err: true},
+		{name: "RestoreQuery doesn't set it", table: Table{SoftDeleteField: "deleted_at", DeleteQuery: softDelete, RestoreQuery: "update leads set user_id=:user_id where lead_id=:lead_id returning *"}, err: true},
+		{name: "valid", table: Table{SoftDeleteField: "deleted_at", DeleteQuery: softDelete, RestoreQuery: restore}},
+	}
+
+	for _, c := range cases {
+		c.table.tableName = "Leads"
+		c.table.objMap = objMap
+		err := c.table.validateSoftDelete()
+		if c.err != (err != nil) {
+			t.Errorf("%s: validateSoftDelete = %v, want an error: %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestIsSoftDeleted(t *testing.T) {
+	now := time.Now()
+	table := &Table{SoftDeleteField: "deleted_at"}
+
+	cases := []struct {
+		name      string
+		deletedAt interface{}
+		want      bool
+	}{
+		{name: "nil", deletedAt: (*time.Time)(nil)},
+		{name: "set", deletedAt: &now, want: true},
+		{name: "zero time", deletedAt: time.Time{}},
+		{name: "NULL sql.NullTime", deletedAt: sql.NullTime{}},
+		{name: "sql.NullTime", deletedAt: sql.NullTime{Time: now, Valid: true}, want: true},
+	}
+
+	for _, c := range cases {
+		if got := table.isSoftDeleted(map[string]interface{}{"deleted_at": c.deletedAt}); got != c.want {
+			t.Errorf("%s: isSoftDeleted = %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	// a table without a SoftDeleteField never has deleted rows
+	var none *Table
+	if none.isSoftDeleted(map[string]interface{}{"deleted_at": &now}) || (&Table{}).isSoftDeleted(map[string]interface{}{"deleted_at": &now}) {
+		t.Error("isSoftDeleted of a table without a SoftDeleteField = true")
+	}
+
+	rows := []interface{}{&softLead{LeadID: 1}, &softLead{LeadID: 2, DeletedAt: &now}}
+	if kept := table.withoutSoftDeleted(rows); len(kept) != 1 || kept[0].(*softLead).LeadID != 1 {
+		t.Errorf("withoutSoftDeleted = %+v", kept)
+	}
+	if !table.anySoftDeleted(&[]softLead{{LeadID: 1}, {LeadID: 2, DeletedAt: &now}}) || table.anySoftDeleted(&[]*softLead{{LeadID: 1}}) {
+		t.Error("anySoftDeleted is wrong")
+	}
+}
+
+func softLeadsTable() *Table {
+	return &Table{
+		Struct:           &softLead{},
+		PrimaryKeyField:  "lead_id",
+		PrimaryQueryName: "LeadsGetByID",
+		SoftDeleteField:  "deleted_at",
+		DeleteQuery:      "update leads set deleted_at=now() where lead_id=:lead_id returning *",
+		RestoreQuery:     "update leads set deleted_at=null where lead_id=:lead_id returning *",
+		Queries: []*Query{
+			{
+				Name:         "LeadsGetByID",
+				CacheKey:     "lead_id=%v",
+				Query:        "select * from leads where lead_id=:lead_id",
+				InsertAction: CacheSet,
+				UpdateAction: CacheSet,
+				SelectAction: CacheSet,
+			},
+			{
+				Name:                    "LeadsByUser",
+				CacheKey:                "user_id=%v",
+				CachePrimaryQueryStored: "LeadsGetByID",
+				Query:                   "select * from leads where user_id=:user_id order by lead_id",
+				InsertAction:            CacheRPush,
+				UpdateAction:            CacheNoAction,
+				SelectAction:            CacheRPush,
+			},
+		},
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	ctx := context.Background()
+
+	// lead 2 of user 2 is deleted when deleted2 is set
+	var deleted2 driver.Value
+	s, m := stubStorage(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		columns := []string{"lead_id", "user_id", "deleted_at"}
+		switch {
+		case strings.Contains(query, "user_id="):
+			return columns, [][]driver.Value{{int64(1), int64(2), nil}, {int64(2), int64(2), deleted2}}, nil
+		case strings.Contains(query, "set deleted_at=now()"):
+			deleted2 = time.Now()
+		case strings.Contains(query, "set deleted_at=null"):
+			deleted2 = nil
+		}
+		// by lead_id
+		if len(args) > 0 && args[0] == int64(1) {
+			return columns, [][]driver.Value{{int64(1), int64(2), nil}}, nil
+		}
+		return columns, [][]driver.Value{{int64(2), int64(2), deleted2}}, nil
+	}, softLeadsTable())
+
+	leads := []softLead{}
+	opts := &SelectOptions{Limit: 10, FetchAllData: true}
+	err := s.SelectAll(ctx, &softLead{UserID: 2}, &leads, "LeadsByUser", opts)
+	if err != nil || len(leads) != 2 {
+		t.Fatalf("SelectAll = %+v, %v", leads, err)
+	}
+
+	err = s.Delete(ctx, &softLead{LeadID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := s.KeyName("LeadsGetByID", &softLead{LeadID: 2}); m.Exists(key) {
+		t.Error("the soft deleted row is still cached")
+	}
+
+	err = s.Select(ctx, &softLead{LeadID: 2}, "LeadsGetByID")
+	if err != sql.ErrNoRows {
+		t.Errorf("Select of a soft deleted row = %v, want sql.ErrNoRows", err)
+	}
+
+	leads = []softLead{}
+	err = s.SelectAll(ctx, &softLead{UserID: 2}, &leads, "LeadsByUser", opts)
+	if err != nil || len(leads) != 1 || leads[0].LeadID != 1 {
+		t.Errorf("SelectAll after the delete = %+v, %v", leads, err)
+	}
+
+	lead := &softLead{LeadID: 2}
+	err = s.Restore(ctx, lead)
+	if err != nil || lead.DeletedAt != nil {
+		t.Fatalf("Restore = %+v, %v", lead, err)
+	}
+	err = s.Select(ctx, &softLead{LeadID: 2}, "LeadsGetByID")
+	if err != nil {
+		t.Errorf("Select of a restored row = %v", err)
+	}
+}
@@ -3,11 +3,10 @@ package storage
 import (
 	"context"
 	"errors"
-	"strings"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/jmoiron/sqlx"
-	"github.com/jmoiron/sqlx/reflectx"
 )
 
 /*
@@ -22,6 +21,8 @@ type Storage interface {
 
 	Insert(ctx context.Context, obj interface{}) error
 	Update(ctx context.Context, obj interface{}) error
+	Delete(ctx context.Context, obj interface{}) error             // Delete runs the table's DeleteQuery & takes each query's DeleteAction
+	Restore(ctx context.Context, obj interface{}) error            // Restore runs the table's RestoreQuery & takes each query's InsertAction
 	Select(ctx context.Context, obj interface{}, key string) error // Select fills out the obj for its response
 
 	/*
@@ -32,20 +33,37 @@ type Storage interface {
 	*/
 	SelectAll(ctx context.Context, obj interface{}, objs interface{}, key string, opts *SelectOptions) error
 
-	DeleteKeys(ctx context.Context, objs ...interface{}) error // Deletes the object's keys from the cache
+	DeleteKeys(ctx context.Context, objs ...interface{}) error // Deletes the object's keys from the cache whatever the queries' DeleteActions are
+
+	// SelectBucket fills out dest with the row of the bucket query's bucket that `at` falls into
+	SelectBucket(ctx context.Context, obj interface{}, dest interface{}, key string, at time.Time) error
+
+	// Count returns the count for a counter query (e.g. `select count(*) from leads where user_id=:user_id`)
+	Count(ctx context.Context, obj interface{}, key string) (int64, error)
 
 	// gets the key's formatted name
 	KeyName(key string, obj interface{}) (string, error)
 
+	// CompressionStats returns the totals of the cached values that have been compressed; see Query.CompressAbove
+	CompressionStats() CompressionStats
+
 	// clear's out all of this service's stuff such as during a migration
 	Clear(ctx context.Context, serviceName string) error
+
+	// History fills out dest with the AuditEntries of obj's row (oldest first); obj's Table must have Audit set
+	History(ctx context.Context, obj interface{}, dest *[]AuditEntry, opts *SelectOptions) error
+
+	// Close stops the background refreshes of SoftTTL queries & the read replicas' probes
+	Close() error
 }
 
 // storage is the private implements the API
 type storage struct {
 	cache              *cache
 	db                 *db
-	debugger           bool
+	log                *logger // the debug logger (Config.Debugger); each call has its own copy in its ctx
+	observer           Observer
+	tracer             Tracer
 	doNotUseCache      bool
 	disableConcurrency bool
 
@@ -72,22 +90,46 @@ type storage struct {
 
 	queryToTable map[string]*Table // maps query to the table
 
+	rollupParents map[string][]*Query // maps query.Name -> the bucket queries that are a RollupOf it
+
+	compressionStats *compressionStats // totals of the values compressed by every query's encoder
+
+	refresher *refresher // refreshes the stale keys of SoftTTL queries in the background
+
 	// serviceName is the name of the service that is being used
 	serviceName string
 
 	defaultTTL int
+	ttlPolicy  ttlPolicy
 }
 
 type Config struct {
 	ReadOnlyDbConn     *sqlx.DB
+	ReadOnlyDbConns    []*sqlx.DB // more read replicas to spread reads across; see ReplicaSelection
 	WriteOnlyDbConn    *sqlx.DB
 	Redis              *redis.ClusterClient
 	Tables             []*Table
 	ServiceName        string
-	Debugger           bool // turn on / off the debugger
-	DoNotUseCache      bool // make sure defaults to bool
-	DisableConcurrency bool // used to disable concurrency for testing
-	DefaultTTL         int  // if 0 then it defaults to packages
+	Debugger           bool     // turn on / off the debugger i.e. the Logger's Debug lines
+	Logger             Logger   // what the library logs with; defaults to NopLogger. See NewLogrusLogger
+	Observer           Observer // receives an Event for each cache hit, miss, db query, etc.; defaults to NopObserver. See ExpvarObserver
+	Tracer             Tracer   // traces the cache & db operations; defaults to NopTracer. See the otel package
+	DoNotUseCache      bool     // make sure defaults to bool
+	DisableConcurrency bool     // used to disable concurrency for testing
+	DefaultTTL         int      // in seconds; if 0 then it defaults to 7 days
+	MinTTL             int      // the smallest CacheTTL a query can have in seconds; 0 = no minimum
+	MaxTTL             int      // the largest CacheTTL a query (or a row's TTLField) can have in seconds; 0 = no maximum
+	AllowNoExpire      bool     // allows queries with a CacheTTL of -1 i.e. cached forever
+	RefreshWorkers     int      // the number of background refreshes of SoftTTL queries at once; defaults to 4
+
+	Consistency        ConsistencyMode // read-your-writes on cache misses; see WithConsistency
+	ReplicaWaitTimeout time.Duration   // how long ConsistencyWaitForReplica waits for the replica; defaults to 500ms
+
+	ReplicaSelection     ReplicaSelection // how a read replica is picked; defaults to ReplicaRoundRobin
+	ReplicaProbeInterval time.Duration    // how often the read replicas are checked; defaults to 5s
+	MaxReplicaLag        time.Duration    // replicas lagging behind more than this aren't read from; defaults to 30s
+
+	AuditTable string // the table that the AuditEntries of tables with Audit set are written to; defaults to DefaultAuditTable
 }
 
 // New returns group which implements the interface
@@ -95,20 +137,23 @@ func New(conf *Config) (Storage, error) {
 	// create storage
 
 	// use the json tag instead of the DB tag
-	conf.ReadOnlyDbConn.Mapper = reflectx.NewMapperFunc("json", strings.ToLower)
-	conf.WriteOnlyDbConn.Mapper = reflectx.NewMapperFunc("json", strings.ToLower)
-
-	// first, set debug up so that we don't get a nil pointer err
-	debug = &logger{
-		debuggerEnabled: conf.Debugger,
+	if conf.ReadOnlyDbConn != nil {
+		conf.ReadOnlyDbConn.Mapper = fieldMapper
 	}
+	for _, conn := range conf.ReadOnlyDbConns {
+		conn.Mapper = fieldMapper
+	}
+	conf.WriteOnlyDbConn.Mapper = fieldMapper
 
 	s := &storage{
 		cache:              newCache(conf.Redis),
 		db:                 newDB(conf),
-		debugger:           conf.Debugger,
+		log:                newLogger(conf),
+		observer:           conf.Observer,
+		tracer:             conf.Tracer,
 		doNotUseCache:      conf.DoNotUseCache,
 		disableConcurrency: conf.DisableConcurrency,
+		compressionStats:   &compressionStats{},
 	}
 
 	s.queries = make(map[string]*Query)
@@ -116,14 +161,35 @@ func New(conf *Config) (Storage, error) {
 	s.structToTable = make(map[string]*Table)
 	s.queryToTable = make(map[string]*Table)
 	s.queryToMap = make(map[string]map[string]interface{})
+	s.rollupParents = make(map[string][]*Query)
 	s.serviceName = conf.ServiceName
 
-	if conf.DefaultTTL == 0 {
+	s.defaultTTL = conf.DefaultTTL
+	if s.defaultTTL == 0 {
 		s.defaultTTL = (24 * 60 * 60 * 7) // 7 days
 	}
 
-	// TODO: validate cache keys
+	s.ttlPolicy = ttlPolicy{
+		min:           conf.MinTTL,
+		max:           conf.MaxTTL,
+		allowNoExpire: conf.AllowNoExpire,
+	}
+	err := s.ttlPolicy.validate(s.defaultTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := conf.Tables
 	for _, t := range conf.Tables {
+		if t.Audit {
+			// the history is read through the audit table's queries like any other table
+			tables = append(append([]*Table{}, conf.Tables...), newAuditTable(conf.AuditTable))
+			break
+		}
+	}
+
+	// TODO: validate cache keys
+	for _, t := range tables {
 
 		// validate the table & its configuration
 		err := t.validate()
@@ -150,6 +216,27 @@ func New(conf *Config) (Storage, error) {
 			query.parseFullCacheKey(s.serviceName, tableName)
 			query.parseTTL(s.defaultTTL)
 			query.parseCacheListKey()
+			query.parseDeleteAction()
+
+			err = query.validateTTL(s.ttlPolicy, t.objMap)
+			if err != nil {
+				return nil, err
+			}
+
+			err = query.validateAndParseCacheKeyValues(t.objMap)
+			if err != nil {
+				return nil, err
+			}
+
+			err = query.validateAndParseHashFields(t.objMap)
+			if err != nil {
+				return nil, err
+			}
+
+			err = query.validateAndParseEncoder(t.Codec, s.compressionStats)
+			if err != nil {
+				return nil, err
+			}
 
 			s.queryToMap[query.Name] = t.objMap
 			s.queries[query.Name] = query
@@ -157,15 +244,27 @@ func New(conf *Config) (Storage, error) {
 			s.queryToTable[query.Name] = t
 		}
 
+		// now that the queries are parsed, check them against each other & the table's struct
+		err = t.validateQueries()
+		if err != nil {
+			return nil, err
+		}
+
 		// then add the configKey to the structToTable
 		s.structToTable[tableName] = t
 
 		t.validateAndParseObjMap()
 	}
 
-	err := s.validate()
+	err = s.validate()
+	if err != nil {
+		return s, err
+	}
+
+	s.refresher = newRefresher(conf.RefreshWorkers)
+	s.db.replicas.start()
 
-	return s, err
+	return s, nil
 }
 
 func (s *storage) KeyName(key string, obj interface{}) (string, error) {
@@ -182,10 +281,17 @@ func (s *storage) KeyName(key string, obj interface{}) (string, error) {
 	return q.getKeyName(objMap), nil
 }
 
-func (s *storage) Update(ctx context.Context, obj interface{}) error {
-	debug.init(ctx)
-	defer debug.clean()
-	d("Update() with obj: %+v", obj)
+func (s *storage) Update(ctx context.Context, obj interface{}) (err error) {
+	ctx, end := s.startCall(ctx, "Update", "")
+	defer func() {
+		end(err)
+	}()
+	d(ctx, "Update() with obj: %+v", obj)
+
+	err = s.runHook(ctx, hookBeforeUpdate, obj)
+	if err != nil {
+		return err
+	}
 
 	objMap, err := structToMap(obj)
 	if err != nil {
@@ -193,23 +299,37 @@ func (s *storage) Update(ctx context.Context, obj interface{}) error {
 	}
 
 	// set objMap to the return value
-	objMap, err = s.update(ctx, objMap, s.db.writeConn())
+	var previous map[string]interface{}
+	objMap, err = s.writePrimary(ctx, objMap, AuditUpdate, s.updateKeepingPrevious(&previous))
 	if err != nil {
 		return err
 	}
+	s.db.recordWrite(ctx)
 
-	err = s.actionNonSelect(objMap, actionUpdate)
+	err = s.actionNonSelect(ctx, objMap, previous, actionUpdate)
 	if err != nil {
 		return err
 	}
 
-	return mapToStruct(objMap, obj)
+	err = mapToStruct(objMap, obj)
+	if err != nil {
+		return err
+	}
+
+	return s.runHook(ctx, hookAfterUpdate, obj)
 }
 
-func (s *storage) Insert(ctx context.Context, obj interface{}) error {
-	debug.init(ctx)
-	defer debug.clean()
-	d("Insert() with obj: %+v", obj)
+func (s *storage) Insert(ctx context.Context, obj interface{}) (err error) {
+	ctx, end := s.startCall(ctx, "Insert", "")
+	defer func() {
+		end(err)
+	}()
+	d(ctx, "Insert() with obj: %+v", obj)
+
+	err = s.runHook(ctx, hookBeforeInsert, obj)
+	if err != nil {
+		return err
+	}
 
 	objMap, err := structToMap(obj)
 	if err != nil {
@@ -217,12 +337,45 @@ func (s *storage) Insert(ctx context.Context, obj interface{}) error {
 	}
 
 	// set objMap to the return value
-	objMap, err = s.insert(ctx, objMap, s.db.writeConn())
+	objMap, err = s.writePrimary(ctx, objMap, AuditInsert, s.insert)
+	if err != nil {
+		return err
+	}
+	s.db.recordWrite(ctx)
+
+	err = s.actionNonSelect(ctx, objMap, nil, actionInsert)
+	if err != nil {
+		return err
+	}
+
+	err = mapToStruct(objMap, obj)
 	if err != nil {
 		return err
 	}
 
-	err = s.actionNonSelect(objMap, actionInsert)
+	return s.runHook(ctx, hookAfterInsert, obj)
+}
+
+func (s *storage) Delete(ctx context.Context, obj interface{}) (err error) {
+	ctx, end := s.startCall(ctx, "Delete", "")
+	defer func() {
+		end(err)
+	}()
+	d(ctx, "Delete() with obj: %+v", obj)
+
+	objMap, err := structToMap(obj)
+	if err != nil {
+		return err
+	}
+
+	// set objMap to the deleted row
+	objMap, err = s.writePrimary(ctx, objMap, AuditDelete, s.deleteRow)
+	if err != nil {
+		return err
+	}
+	s.db.recordWrite(ctx)
+
+	err = s.actionNonSelect(ctx, objMap, nil, actionDelete)
 	if err != nil {
 		return err
 	}
@@ -230,17 +383,55 @@ func (s *storage) Insert(ctx context.Context, obj interface{}) error {
 	return mapToStruct(objMap, obj)
 }
 
+func (s *storage) Restore(ctx context.Context, obj interface{}) (err error) {
+	ctx, end := s.startCall(ctx, "Restore", "")
+	defer func() {
+		end(err)
+	}()
+	d(ctx, "Restore() with obj: %+v", obj)
+
+	objMap, err := structToMap(obj)
+	if err != nil {
+		return err
+	}
+
+	// set objMap to the restored row
+	objMap, err = s.writePrimary(ctx, objMap, AuditRestore, s.restoreRow)
+	if err != nil {
+		return err
+	}
+	s.db.recordWrite(ctx)
+
+	// the row is back so it's cached as if it was just inserted
+	err = s.actionNonSelect(ctx, objMap, nil, actionInsert)
+	if err != nil {
+		return err
+	}
+
+	return mapToStruct(objMap, obj)
+}
+
+func (s *storage) CompressionStats() CompressionStats {
+	return s.compressionStats.snapshot()
+}
+
+func (s *storage) Close() error {
+	if s.refresher != nil {
+		s.refresher.close()
+	}
+	s.db.replicas.close()
+	return nil
+}
+
 func (s *storage) Clear(ctx context.Context, serviceName string) error {
-	debug.init(ctx)
-	defer debug.clean()
-	d("Clear called for service: %s", serviceName)
+	ctx = s.withContext(ctx)
+	d(ctx, "Clear called for service: %s", serviceName)
 	return nil
 }
 
 func (s *storage) DeleteKeys(ctx context.Context, objs ...interface{}) error {
-	debug.init(ctx)
-	defer debug.clean()
-	d("DeleteKeys() called")
+	ctx = s.withContext(ctx)
+	d(ctx, "DeleteKeys() called")
 
 	// really should chain together errors and keep deleting even if an error occurs
 	for _, obj := range objs {
@@ -248,7 +439,7 @@ func (s *storage) DeleteKeys(ctx context.Context, objs ...interface{}) error {
 		if err != nil {
 			return err
 		}
-		err = s.delete(ctx, objMap)
+		err = s.evict(ctx, objMap)
 		if err != nil {
 			return err
 		}
@@ -257,17 +448,38 @@ func (s *storage) DeleteKeys(ctx context.Context, objs ...interface{}) error {
 }
 
 func (s *storage) Select(ctx context.Context, obj interface{}, queryName string) error {
-	debug.init(ctx)
-	defer debug.clean()
-	d("Select() with obj: %+v, queryName: %d", obj, queryName)
+	ctx, end := s.startCall(ctx, "Select", queryName)
+	d(ctx, "Select() with obj: %+v, queryName: %s", obj, queryName)
 
-	return s.selectOne(ctx, obj, queryName, s.db.readConn())
+	err := s.selectOne(ctx, obj, queryName, s.db.consistentReadConn(ctx))
+	if err == nil {
+		err = s.afterSelect(ctx, queryName, obj)
+	}
+	return end(err)
+}
+
+func (s *storage) SelectBucket(ctx context.Context, obj interface{}, dest interface{}, queryName string, at time.Time) error {
+	ctx, end := s.startCall(ctx, "SelectBucket", queryName)
+	d(ctx, "SelectBucket() with obj: %+v, queryName: %s, at: %v", obj, queryName, at)
+
+	return end(s.selectBucketInto(ctx, obj, dest, queryName, at, s.db.consistentReadConn(ctx)))
+}
+
+func (s *storage) Count(ctx context.Context, obj interface{}, queryName string) (int64, error) {
+	ctx, end := s.startCall(ctx, "Count", queryName)
+	d(ctx, "Count() with obj: %+v, queryName: %s", obj, queryName)
+
+	count, err := s.count(ctx, obj, queryName, s.db.consistentReadConn(ctx))
+	return count, end(err)
 }
 
 func (s *storage) SelectAll(ctx context.Context, obj interface{}, dest interface{}, queryName string, opts *SelectOptions) error {
-	debug.init(ctx)
-	defer debug.clean()
-	d("SelectAll() with obj: %+v, queryName: %d, opts: %+v", obj, queryName, opts)
+	ctx, end := s.startCall(ctx, "SelectAll", queryName)
+	d(ctx, "SelectAll() with obj: %+v, queryName: %s, opts: %+v", obj, queryName, opts)
 
-	return s.selectAll(ctx, obj, dest, queryName, opts, s.db.readConn())
+	err := s.selectAll(ctx, obj, dest, queryName, opts, s.db.consistentReadConn(ctx))
+	if err == nil {
+		err = s.afterSelect(ctx, queryName, dest)
+	}
+	return end(err)
 }
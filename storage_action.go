@@ -3,8 +3,6 @@ package storage
 import (
 	"context"
 	"errors"
-
-	"github.com/sirupsen/logrus"
 )
 
 // NOTE: this would ideally be placed on the cache struct but there's too much on the storage struct that we need
@@ -15,15 +13,20 @@ import (
 	2. If insert or update action, a list can be RPushX or LPushX
 		NOTE: if action is a select then lists will NOT be set; a list is only set with actionRows &&
 
-	This is very different than actionRows which will take the queried rows and actually set them in a list
+	This is very different than actionRows which will take the queried rows and actually set them in a list.
+	previous is the row from before an update if it could have moved the row to another bucket (see update); nil otherwise
 */
-func (s *storage) actionNonSelect(objMap map[string]interface{}, action actionTypes) error {
-	d("actionNonSelect")
+func (s *storage) actionNonSelect(ctx context.Context, objMap map[string]interface{}, previous map[string]interface{}, action actionTypes) (err error) {
 	if action == actionSelect {
 		return errors.New("cannot do actionSelect in actionNonSelect")
 	}
+	d(ctx, "actionNonSelect")
 
-	ctx := context.Background()
+	// the cache should be updated even if the caller has gone away
+	ctx, span := startSpan(detach(ctx), "storage.cache.actionNonSelect")
+	defer func() {
+		endSpan(span, err)
+	}()
 
 	structName := objMap[objMapStructNameKey].(string)
 	if structName == "" {
@@ -35,12 +38,48 @@ func (s *storage) actionNonSelect(objMap map[string]interface{}, action actionTy
 		return errors.New("no config key found for " + structName)
 	}
 
-	var err error
+	if action == actionUpdate && table.isSoftDeleted(objMap) {
+		// the update soft deleted the row (e.g. it set deleted_at) so it's removed from the cache like any other delete
+		d(ctx, "row was soft deleted; taking the delete actions")
+		action = actionDelete
+	}
+
+	// the value that's cached for CacheSet; it's the struct (not the objMap) so it's the same as when it's cached from a select
+	row, err := table.rowFromMap(objMap)
+	if err != nil {
+		return err
+	}
+
 	for _, q := range table.Queries {
+		ctx := withQuery(ctx, q)
+		if logging(ctx) {
+			ctx = logWith(ctx, Field{Key: FieldCacheKey, Value: q.getKeyName(objMap)})
+		}
 
 		// check to see if all the cache's fields are what they're supposed to be
 		// e.g. check to make sure if there's a != then the column's values don't match
-		if !q.isValidQuery(objMap) {
+		if !q.isValidQuery(ctx, objMap) {
+			// the row doesn't belong in the key but it could have before the update (e.g. role OWNER -> MEMBER) so remove the key
+			if action == actionUpdate && q.UpdateAction != CacheNoAction && q.Bucket == BucketNone {
+				err = s.delKey(ctx, table, q, objMap, action)
+				if err == nil {
+					observe(ctx, Event{Type: EventInvalidation, Action: q.UpdateAction, Count: 1})
+				}
+				if err == nil && q.cacheDataStructure == CacheDataStructureList {
+					err = s.cache.updateList(ctx, q, objMap)
+				}
+				if err != nil {
+					logError(ctx, "error in actionNonSelect", err)
+				}
+			}
+			continue
+		}
+
+		if action == actionEvict {
+			err = s.evictKey(ctx, q, objMap)
+			if err != nil {
+				logError(ctx, "error in actionNonSelect", err)
+			}
 			continue
 		}
 
@@ -51,52 +90,93 @@ func (s *storage) actionNonSelect(objMap map[string]interface{}, action actionTy
 		case actionUpdate:
 			actionToTake = q.UpdateAction
 		case actionDelete:
-			actionToTake = CacheDel
+			actionToTake = q.DeleteAction
 		}
 
-		d("taking action: %v on key: %v", actionToTake, q.getKeyName(objMap))
+		d(ctx, "taking action: %v", actionToTake)
+
+		if q.Bucket != BucketNone {
+			err = s.actionBucket(ctx, q, objMap, previous)
+			if err != nil {
+				logError(ctx, "error in actionNonSelect", err)
+			}
+			continue
+		}
 
 		if q.cacheDataStructure == CacheDataStructureList {
-			err = s.cache.updateList(q, objMap)
+			err = s.cache.updateList(ctx, q, objMap)
 		}
 
 		switch actionToTake {
 		case CacheNoAction:
-			d("action is CacheNoAction")
+			d(ctx, "action is CacheNoAction")
 			// don't do anything;
 
 		case CacheSet:
-			d("action is CacheSet")
-			err = s.cache.set(ctx, q.getKeyName(objMap), objMap, q.CacheTTL)
+			d(ctx, "action is CacheSet")
+			ttl, ok := q.rowTTL(objMap)
+			if !ok {
+				// the row has expired so it shouldn't be cached anymore
+				err = s.delKey(ctx, table, q, objMap, action)
+				break
+			}
+			err = s.cache.setRow(ctx, table, q.getKeyName(objMap), row, objMap, ttl, q.encoder)
+			if err == nil {
+				err = s.cache.markFresh(ctx, q, q.getKeyName(objMap))
+			}
+
+		case CacheHSet:
+			d(ctx, "action is CacheHSet")
+			fields := q.cacheFields
+			if action == actionUpdate {
+				// only HSET the columns the update could have changed
+				fields = q.updatedHashFields(table.updateColumns)
+			}
+			ttl, ok := q.rowTTL(objMap)
+			if !ok {
+				// the row has expired so it shouldn't be cached anymore
+				err = s.delKey(ctx, table, q, objMap, action)
+				break
+			}
+			err = s.cache.hsetRow(ctx, table, q.getKeyName(objMap), objMap, fields, ttl, q.encoder)
+			if err == nil {
+				err = s.cache.markFresh(ctx, q, q.getKeyName(objMap))
+			}
 
 		case CacheDel:
-			d("action is CacheDel")
-			err = s.cache.Del(ctx, q.getKeyName(objMap)).Err()
+			d(ctx, "action is CacheDel")
+			err = s.delKey(ctx, table, q, objMap, action)
+
+		case CacheIncr:
+			d(ctx, "action is CacheIncr")
+			err = s.cache.incrX(ctx, q.getKeyName(objMap), 1, q.ttl())
+
+		case CacheDecr:
+			d(ctx, "action is CacheDecr")
+			err = s.cache.incrX(ctx, q.getKeyName(objMap), -1, q.ttl())
 
 		case CacheLPush:
-			d("action is CacheLPush")
-			// get the map of the struct that's the basis for what's stored in this LRange
-			m := s.queryToMap[q.CachePrimaryQueryStored]
-			// get the primary key (such as "lead_id" for the lead table) from q.CachePrimaryQueryStored
-			pkField, ok := m[objMapStructPrimaryKey].(string)
-			if !ok {
-				return errors.New("issue getting q.CachePrimaryQueryStored of m")
+			d(ctx, "action is CacheLPush")
+			// the list stores the primary key (such as "lead_id" for the lead table) of q.CachePrimaryQueryStored's table
+			var member string
+			member, err = s.queryToTable[q.CachePrimaryQueryStored].listMember(objMap)
+			if err != nil {
+				break
 			}
 
 			// do the insert / update actions with is just going to LPushX (note the X: don't push if key doesn't exist)
-			err = s.cache.LPushX(ctx, q.getKeyName(objMap), objMap[pkField]).Err()
+			err = s.cache.LPushX(ctx, q.getKeyName(objMap), member).Err()
 
 		case CacheRPush:
-			d("action is CacheRPush")
-			// get the map of the struct that's the basis for what's stored in this LRange
-			m := s.queryToMap[q.CachePrimaryQueryStored]
-			// get the primary key (such as "lead_id" for the lead table) from q.CachePrimaryQueryStored
-			pkField, ok := m[objMapStructPrimaryKey].(string)
-			if !ok {
-				return errors.New("issue getting q.CachePrimaryQueryStored of m")
+			d(ctx, "action is CacheRPush")
+			// the list stores the primary key (such as "lead_id" for the lead table) of q.CachePrimaryQueryStored's table
+			var member string
+			member, err = s.queryToTable[q.CachePrimaryQueryStored].listMember(objMap)
+			if err != nil {
+				break
 			}
 			// do the insert / update actions with is just going to RPushX (note the X: don't push if key doesn't exist)
-			err = s.cache.RPushX(ctx, q.getKeyName(objMap), objMap[pkField]).Err()
+			err = s.cache.RPushX(ctx, q.getKeyName(objMap), member).Err()
 
 		default:
 			err = errors.New("unknown update action")
@@ -104,66 +184,157 @@ func (s *storage) actionNonSelect(objMap map[string]interface{}, action actionTy
 
 		if err != nil {
 			// actually log this error since it's in a loop
-			logrus.Errorf("error in actionNonSelect: %s\nkeyName: %s\nAction"+err.Error(), q.getKeyName(objMap), actionToTake)
+			logError(ctx, "error in actionNonSelect", err, Field{Key: FieldAction, Value: actionToTake})
 			// do not return; we want to update all the queries
+			continue
+		}
+
+		switch actionToTake {
+		case CacheNoAction:
+		case CacheDel:
+			observe(ctx, Event{Type: EventCacheDel, Action: actionToTake})
+		default:
+			observe(ctx, Event{Type: EventCacheSet, Action: actionToTake})
+		}
+	}
+
+	return err
+}
+
+// delKey deletes the key of q for the row; its version (see VersionField) is only deleted with it if the row was deleted
+func (s *storage) delKey(ctx context.Context, table *Table, q *Query, objMap map[string]interface{}, action actionTypes) error {
+	if q.cacheDataStructure == CacheDataStructureCounter {
+		return s.cache.delCounter(ctx, q.getKeyName(objMap), q.ttl())
+	}
+	if action == actionDelete {
+		return s.cache.delRow(ctx, table, q.getKeyName(objMap)).Err()
+	}
+	return s.cache.delRowKeepVersion(ctx, table, q.getKeyName(objMap), objMap, q.ttl())
+}
+
+/*
+	evictKey removes the key of q for the row (e.g. for DeleteKeys). Unlike the DeleteAction it's always a delete: a counter is
+	filled again by the next count rather than decremented & a list's pages go with it. The row's version (see VersionField) is
+	kept since the row itself hasn't gone anywhere
+*/
+func (s *storage) evictKey(ctx context.Context, q *Query, objMap map[string]interface{}) error {
+	if q.Bucket != BucketNone {
+		return s.actionBucket(ctx, q, objMap, nil)
+	}
+
+	if q.cacheDataStructure == CacheDataStructureList {
+		err := s.cache.updateList(ctx, q, objMap)
+		if err != nil {
+			return err
 		}
 	}
 
+	var err error
+	if q.cacheDataStructure == CacheDataStructureCounter {
+		err = s.cache.delCounter(ctx, q.getKeyName(objMap), q.ttl())
+	} else {
+		err = s.cache.Del(ctx, q.getKeyName(objMap)).Err()
+	}
+	if err == nil {
+		observe(ctx, Event{Type: EventCacheDel, Action: CacheDel})
+	}
 	return err
 }
 
-func (s *storage) cacheActionSelect(objMap map[string]interface{}, objs []map[string]interface{}, query *Query) error {
-	d("cacheActionSelect")
-	ctx := context.Background()
+// cacheActionSelect takes the select action of the query on the rows (pointers to the table's struct) that were queried from the db
+func (s *storage) cacheActionSelect(ctx context.Context, objMap map[string]interface{}, rows []interface{}, query *Query) (err error) {
+	ctx = logWith(withQuery(detach(ctx), query), Field{Key: FieldAction, Value: query.SelectAction})
+	d(ctx, "cacheActionSelect")
+
+	ctx, span := startSpan(ctx, "storage.cache.actionSelect")
+	defer func() {
+		endSpan(span, err)
+	}()
 
 	// valueToStore represents what will be put into the cache
 	objsToInsert := []interface{}{}
 	if query.cacheDataStructure == CacheDataStructureList {
-		d("query is CacheDataStructureList")
-		// get the map of the struct that's the basis for what's stored in this LRange
-		m := s.queryToMap[query.CachePrimaryQueryStored]
-		// get the primary key (such as "lead_id" for the lead table) from q.CachePrimaryQueryStored
-		pkField, ok := m[objMapStructPrimaryKey].(string)
-		if !ok {
-			return errors.New("issue getting q.CachePrimaryQueryStored of m")
-		}
-
-		for _, v := range objs {
-			objsToInsert = append(objsToInsert, v[pkField])
+		d(ctx, "query is CacheDataStructureList")
+		// the list stores the primary key (such as "lead_id" for the lead table) of q.CachePrimaryQueryStored's table
+		pkTable := s.queryToTable[query.CachePrimaryQueryStored]
+
+		for _, row := range rows {
+			v, err := structToMap(row)
+			if err != nil {
+				return err
+			}
+			member, err := pkTable.listMember(v)
+			if err != nil {
+				return err
+			}
+			objsToInsert = append(objsToInsert, member)
 		}
 	}
 
-	var err error
 	keyName := query.getKeyName(objMap)
 
-	d("keyName: %s", keyName)
+	ctx = logWith(ctx, Field{Key: FieldCacheKey, Value: keyName})
 
 	switch query.SelectAction {
 	case CacheNoAction:
-		d("action is CacheNoAction")
+		d(ctx, "action is CacheNoAction")
 		// don't do anything;
 
 	case CacheSet:
-		d("cacheActionSelect: CacheSet\nobjMap: %+v", objMap)
-		err = s.cache.set(ctx, keyName, objMap, query.CacheTTL)
+		d(ctx, "cacheActionSelect: CacheSet\nobjMap: %+v", objMap)
+		// cache the row as it was scanned so a cache hit is exactly the same as the db
+		ttl, ok := query.rowTTL(objMap)
+		if !ok {
+			// the row has already expired; don't cache it
+			break
+		}
+		err = s.cache.setRow(ctx, s.queryToTable[query.Name], keyName, rows[0], objMap, ttl, query.encoder)
+		if err == nil {
+			observe(ctx, Event{Type: EventCacheSet, Action: CacheSet})
+			err = s.cache.markFresh(ctx, query, keyName)
+		}
+
+	case CacheHSet:
+		d(ctx, "cacheActionSelect: CacheHSet\nobjMap: %+v", objMap)
+		ttl, ok := query.rowTTL(objMap)
+		if !ok {
+			// the row has already expired; don't cache it
+			break
+		}
+		err = s.cache.hsetRow(ctx, s.queryToTable[query.Name], keyName, objMap, query.cacheFields, ttl, query.encoder)
+		if err == nil {
+			observe(ctx, Event{Type: EventCacheSet, Action: CacheHSet})
+			err = s.cache.markFresh(ctx, query, keyName)
+		}
 
 	case CacheDel:
-		d("cacheActionSelect: CacheDel")
-		err = s.cache.Del(ctx, keyName).Err()
+		d(ctx, "cacheActionSelect: CacheDel")
+		err = s.cache.delRowKeepVersion(ctx, s.queryToTable[query.Name], keyName, objMap, query.ttl())
+		if err == nil {
+			observe(ctx, Event{Type: EventCacheDel, Action: CacheDel})
+		}
 
 	case CacheLPush:
 		if len(objsToInsert) == 0 {
 			break
 		}
-		d("cacheActionSelect: CacheLPush. objsToInsert:", objsToInsert)
-		err = s.cache.LPush(ctx, keyName, objsToInsert...).Err()
+		d(ctx, "cacheActionSelect: CacheLPush. objsToInsert: %+v", objsToInsert)
+		err = s.cache.fillList(ctx, keyName, true, objsToInsert, query.ttl())
+		if err == nil {
+			observe(ctx, Event{Type: EventListFill, Action: CacheLPush, Count: len(objsToInsert)})
+			err = s.cache.markFresh(ctx, query, keyName)
+		}
 
 	case CacheRPush:
 		if len(objsToInsert) == 0 {
 			break
 		}
-		d("cacheActionSelect: RPush. objsToInsert:", objsToInsert)
-		err = s.cache.RPush(ctx, keyName, objsToInsert...).Err()
+		d(ctx, "cacheActionSelect: RPush. objsToInsert: %+v", objsToInsert)
+		err = s.cache.fillList(ctx, keyName, false, objsToInsert, query.ttl())
+		if err == nil {
+			observe(ctx, Event{Type: EventListFill, Action: CacheRPush, Count: len(objsToInsert)})
+			err = s.cache.markFresh(ctx, query, keyName)
+		}
 
 	default:
 		err = errors.New("unknown update action")
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+// a row updated out of a `role=OWNER` key is removed from it
+func TestUpdateOutOfAValueKey(t *testing.T) {
+	ctx := context.Background()
+
+	role := "OWNER"
+	members := func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		return []string{"group_id", "user_id", "role", "level", "active"}, [][]driver.Value{{int64(15), int64(2), role, int64(5), true}}, nil
+	}
+	s, m := stubStorage(t, members, &Table{
+		Struct:           &valueMember{},
+		PrimaryKeyFields: []string{"group_id", "user_id"},
+		PrimaryQueryName: "MemberGetByID",
+		UpdateQuery:      "update members set role=:role where group_id=:group_id and user_id=:user_id returning *",
+		Queries: []*Query{
+			{
+				Name:         "MemberGetByID",
+				CacheKey:     "group_id=%v|user_id=%v",
+				Query:        "select * from members where group_id=:group_id and user_id=:user_id",
+				InsertAction: CacheSet,
+				UpdateAction: CacheSet,
+				SelectAction: CacheSet,
+			},
+			{
+				Name:         "OwnerOfGroup",
+				CacheKey:     "group_id=%v|role=OWNER",
+				Query:        "select * from members where group_id=:group_id and role='OWNER'",
+				InsertAction: CacheSet,
+				UpdateAction: CacheSet,
+				SelectAction: CacheSet,
+			},
+		},
+	})
+
+	owner := &valueMember{GroupID: 15}
+	err := s.Select(ctx, owner, "OwnerOfGroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := s.KeyName("OwnerOfGroup", owner)
+	if !m.Exists(key) {
+		t.Fatalf("%s wasn't cached", key)
+	}
+
+	role = "MEMBER"
+	err = s.Update(ctx, &valueMember{GroupID: 15, UserID: 2, Role: "MEMBER"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Exists(key) {
+		t.Errorf("%s is still cached after its owner became a member", key)
+	}
+}
+
+// DeleteKeys removes every key of the row even if the DeleteAction of its query wouldn't (e.g. a counter's CacheDecr)
+func TestDeleteKeysEvicts(t *testing.T) {
+	ctx := context.Background()
+
+	leads := benchLeads(2)
+	table := benchLeadsTable()
+	table.Queries[0].DeleteAction = CacheNoAction
+	table.Queries = append(table.Queries, &Query{
+		Name:         "LeadsCountByUser",
+		CacheKey:     "user_id=%v|count",
+		Query:        "select count(*) from leads where user_id=:user_id",
+		InsertAction: CacheIncr,
+		UpdateAction: CacheNoAction,
+		DeleteAction: CacheDecr,
+		SelectAction: CacheSet,
+	})
+	s, m := stubStorage(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "count(*)") {
+			return []string{"count"}, [][]driver.Value{{int64(2)}}, nil
+		}
+		return leads(query, args)
+	}, table)
+
+	lead := &benchLead{LeadID: 1, UserID: 2}
+	err := s.Select(ctx, lead, "LeadsGetByID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := []benchLead{}
+	err = s.SelectAll(ctx, lead, &page, "LeadsByUser", &SelectOptions{Limit: 10, FetchAllData: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Count(ctx, lead, "LeadsCountByUser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := m.Keys()
+	if len(cached) == 0 {
+		t.Fatal("nothing was cached")
+	}
+
+	err = s.DeleteKeys(ctx, lead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the counter's fill generation is kept so a count from before DeleteKeys isn't filled
+	for _, key := range m.Keys() {
+		if !strings.HasSuffix(key, cacheKeyCounterGenModifier) {
+			t.Errorf("%s is still cached after DeleteKeys (of %v)", key, cached)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	// defaultRefreshWorkers is the number of background refreshes for SoftTTL queries at once if Config.RefreshWorkers isn't set
+	defaultRefreshWorkers = 4
+	// refreshQueueSize is how many refreshes can be waiting for a worker; any more are dropped & tried again on a later read
+	refreshQueueSize = 256
+)
+
+/*
+refresher is the bounded pool of workers that refresh the keys of SoftTTL queries in the background. A stale key is only
+scheduled once since the caller has to claim it first (see cache.claimStale) so the pool is only ever doing one refresh per key.
+*/
+type refresher struct {
+	jobs chan refreshJob
+
+	mu     sync.RWMutex // guards closed & sending to jobs
+	closed bool
+
+	ctx    context.Context // canceled on close so in-flight refreshes stop
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type refreshJob struct {
+	ctx     context.Context // the ctx of the read that scheduled it; only its values (e.g. the logger) are used
+	key     string
+	refresh func(ctx context.Context) error
+}
+
+func newRefresher(workers int) *refresher {
+	if workers <= 0 {
+		workers = defaultRefreshWorkers
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &refresher{
+		jobs:   make(chan refreshJob, refreshQueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	r.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go r.work()
+	}
+	return r
+}
+
+func (r *refresher) work() {
+	defer r.wg.Done()
+	for job := range r.jobs {
+		if r.ctx.Err() != nil {
+			// closing; drain the rest without refreshing
+			continue
+		}
+
+		ctx := withValuesOf(r.ctx, job.ctx)
+		d(ctx, "refreshing key %s in the background", job.key)
+		err := job.refresh(ctx)
+		if err != nil && r.ctx.Err() == nil {
+			logError(ctx, "error refreshing a key in the background", err, Field{Key: FieldCacheKey, Value: job.key})
+		}
+	}
+}
+
+// schedule queues the refresh; it returns false if the queue is full or the refresher is closed
+func (r *refresher) schedule(ctx context.Context, key string, refresh func(ctx context.Context) error) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return false
+	}
+
+	select {
+	case r.jobs <- refreshJob{ctx: ctx, key: key, refresh: refresh}:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops any refreshes in flight & waits for the workers to exit
+func (r *refresher) close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	close(r.jobs)
+	r.mu.Unlock()
+
+	r.cancel()
+	r.wg.Wait()
+}
+
+// revalidate schedules a background refresh of key if it's past the query's SoftTTL. The cached value is still returned by the caller
+func (s *storage) revalidate(ctx context.Context, q *Query, key string, refresh func(ctx context.Context) error) {
+	stale, err := s.cache.claimStale(ctx, q, key)
+	if err != nil {
+		logError(ctx, "error checking if a key is stale", err, Field{Key: FieldCacheKey, Value: key})
+		return
+	}
+	if !stale {
+		return
+	}
+
+	if !s.refresher.schedule(ctx, key, refresh) {
+		// the pool is busy or closed; let a later read claim it again
+		d(ctx, "couldn't schedule a refresh of key %s", key)
+		s.cache.Del(ctx, key+cacheKeyFreshModifier)
+	}
+}
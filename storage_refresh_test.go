@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefresherRuns(t *testing.T) {
+	r := newRefresher(2)
+	defer r.close()
+
+	done := make(chan string, 3)
+	for _, key := range []string{"a", "b", "c"} {
+		key := key
+		if !r.schedule(context.Background(), key, func(ctx context.Context) error {
+			done <- key
+			return nil
+		}) {
+			t.Fatalf("couldn't schedule %s", key)
+		}
+	}
+
+	got := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		select {
+		case key := <-done:
+			got[key] = true
+		case <-time.After(time.Second):
+			t.Fatalf("only refreshed %v", got)
+		}
+	}
+}
+
+func TestRefresherQueueFull(t *testing.T) {
+	r := newRefresher(1)
+	defer r.close()
+
+	// the worker is busy until it's canceled by close
+	started := make(chan struct{})
+	r.schedule(context.Background(), "busy", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	<-started
+
+	for i := 0; i < refreshQueueSize; i++ {
+		if !r.schedule(context.Background(), "queued", func(ctx context.Context) error { return nil }) {
+			t.Fatalf("the queue was full after %d", i)
+		}
+	}
+	if r.schedule(context.Background(), "dropped", func(ctx context.Context) error { return nil }) {
+		t.Error("scheduled past the size of the queue")
+	}
+}
+
+func TestRefresherClose(t *testing.T) {
+	r := newRefresher(1)
+
+	started := make(chan struct{})
+	var canceled, ran int32
+	r.schedule(context.Background(), "in flight", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		atomic.AddInt32(&canceled, 1)
+		return ctx.Err()
+	})
+	r.schedule(context.Background(), "queued", func(ctx context.Context) error {
+		atomic.AddInt32(&ran, 1)
+		return nil
+	})
+	<-started
+
+	// close cancels the refresh in flight, drops the queued one & waits for the workers
+	r.close()
+	if atomic.LoadInt32(&canceled) != 1 {
+		t.Error("the refresh in flight wasn't canceled")
+	}
+	if atomic.LoadInt32(&ran) != 0 {
+		t.Error("a queued refresh ran after close")
+	}
+
+	if r.schedule(context.Background(), "closed", func(ctx context.Context) error { return nil }) {
+		t.Error("scheduled after close")
+	}
+	r.close()
+}
+
+// a stale key is only refreshed by the first read that finds it stale
+func TestRevalidateOnce(t *testing.T) {
+	ctx := context.Background()
+	client, m := stubRedis(t)
+	s := &storage{cache: newCache(client), refresher: newRefresher(1)}
+	defer s.refresher.close()
+
+	q := &Query{SoftTTL: 60}
+	refreshed := make(chan struct{}, 10)
+	refresh := func(ctx context.Context) error {
+		refreshed <- struct{}{}
+		return nil
+	}
+
+	// fresh
+	s.cache.markFresh(ctx, q, "key")
+	s.revalidate(ctx, q, "key", refresh)
+
+	// stale & read a few times at once
+	m.FastForward(time.Minute)
+	for i := 0; i < 5; i++ {
+		s.revalidate(ctx, q, "key", refresh)
+	}
+
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("the stale key wasn't refreshed")
+	}
+	select {
+	case <-refreshed:
+		t.Error("the stale key was refreshed more than once")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
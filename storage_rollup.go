@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/sync/errgroup"
+)
+
+// rollupFillConcurrency is how many of a rollup's children are filled at once on a miss
+const rollupFillConcurrency = 8
+
+// Bucket is the size of a time bucket for analytics queries; see Query.Bucket
+type Bucket int32
+
+const (
+	BucketNone Bucket = iota
+	BucketMinute
+	BucketHour
+	BucketDay
+	BucketMonth
+)
+
+// start returns the beginning of the bucket that t falls into. Buckets are always in UTC
+func (b Bucket) start(t time.Time) time.Time {
+	t = t.UTC()
+	switch b {
+	case BucketMinute:
+		return t.Truncate(time.Minute)
+	case BucketHour:
+		return t.Truncate(time.Hour)
+	case BucketDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case BucketMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return t
+}
+
+// next returns the beginning of the bucket after the one that starts at start
+func (b Bucket) next(start time.Time) time.Time {
+	switch b {
+	case BucketMinute:
+		return start.Add(time.Minute)
+	case BucketHour:
+		return start.Add(time.Hour)
+	case BucketDay:
+		return start.AddDate(0, 0, 1)
+	case BucketMonth:
+		return start.AddDate(0, 1, 0)
+	}
+	return start
+}
+
+func (b Bucket) String() string {
+	switch b {
+	case BucketMinute:
+		return "minute"
+	case BucketHour:
+		return "hour"
+	case BucketDay:
+		return "day"
+	case BucketMonth:
+		return "month"
+	}
+	return "none"
+}
+
+// bucketTime takes the value of a Query.BucketField column from an objMap and returns it as a time
+func bucketTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case *time.Time:
+		if t != nil {
+			return *t, nil
+		}
+	case string:
+		return time.Parse(time.RFC3339Nano, t)
+	}
+	return time.Time{}, fmt.Errorf("bucket field must be a time; is %T", v)
+}
+
+/*
+	selectBucket returns the row for the bucket that starts at start. On a miss:
+	- a leaf query (no RollupOf) is run against the db with :bucket_start & :bucket_end set
+	- a rollup query fetches each of its child query's buckets (which are cached in their own right) concurrently and Aggregates them
+
+	The result is then cached per bucket.
+*/
+func (s *storage) selectBucket(ctx context.Context, q *Query, objMap map[string]interface{}, start time.Time, conn InsertInterface) (map[string]interface{}, error) {
+	keyName := q.getKeyNameBucket(objMap, start)
+	ctx = logWith(withQuery(ctx, q), Field{Key: FieldCacheKey, Value: keyName})
+	d(ctx, "selectBucket()")
+
+	row := map[string]interface{}{}
+	err := s.cache.get(ctx, keyName, &row, q.encoder)
+	if err == nil {
+		observe(ctx, Event{Type: EventCacheHit})
+		return row, nil
+	}
+
+	// check to see if there's a real error
+	if err != redis.Nil {
+		return nil, err
+	}
+	observe(ctx, Event{Type: EventCacheMiss})
+
+	end := q.Bucket.next(start)
+
+	if q.RollupOf == "" {
+		m := map[string]interface{}{}
+		for k, v := range objMap {
+			m[k] = v
+		}
+		m[bucketStartParameter] = start
+		m[bucketEndParameter] = end
+
+		dbQuery, err := q.getQuery(m)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := s.db.query(ctx, m, dbQuery, conn)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+
+		// an empty bucket is an empty row so that rollups still see every bucket
+		if len(res) != 0 {
+			row = res[0]
+		}
+		delete(row, objMapStructNameKey)
+	} else {
+		children, err := s.selectChildBuckets(ctx, s.queries[q.RollupOf], objMap, start, end, conn)
+		if err != nil {
+			return nil, err
+		}
+
+		row, err = q.Aggregate(children)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if q.SelectAction == CacheSet {
+		err = s.cache.set(ctx, keyName, row, q.ttl(), q.encoder)
+		if err != nil {
+			return nil, err
+		}
+		observe(ctx, Event{Type: EventCacheSet, Action: CacheSet})
+	}
+
+	// return the row as it'd be read from the cache so the types in it are the same for a hit & a miss
+	b, err := q.encoder.encode(row)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded := map[string]interface{}{}
+	return decoded, q.encoder.decode(b, &decoded)
+}
+
+/*
+	selectChildBuckets returns the rows of child's buckets from start until end in order. A miss on a month would otherwise be
+	~720 hours one at a time so they're fetched rollupFillConcurrency at a time (at each level) unless concurrency is disabled.
+*/
+func (s *storage) selectChildBuckets(ctx context.Context, child *Query, objMap map[string]interface{}, start time.Time, end time.Time, conn InsertInterface) ([]map[string]interface{}, error) {
+	starts := []time.Time{}
+	for t := start; t.Before(end); t = child.Bucket.next(t) {
+		starts = append(starts, t)
+	}
+	children := make([]map[string]interface{}, len(starts))
+
+	if s.disableConcurrency {
+		for i, t := range starts {
+			childRow, err := s.selectBucket(ctx, child, objMap, t, conn)
+			if err != nil {
+				return nil, err
+			}
+			children[i] = childRow
+		}
+		return children, nil
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, rollupFillConcurrency)
+	for i, t := range starts {
+		i, t := i, t
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			childRow, err := s.selectBucket(ctx, child, objMap, t, conn)
+			children[i] = childRow
+			return err
+		})
+	}
+	return children, g.Wait()
+}
+
+// invalidateBucket deletes the bucket of q that the time t falls into & then every rollup built on top of it
+func (s *storage) invalidateBucket(ctx context.Context, q *Query, objMap map[string]interface{}, t time.Time) error {
+	keyName := q.getKeyNameBucket(objMap, q.Bucket.start(t))
+	d(ctx, "invalidateBucket() deleting: %s", keyName)
+
+	err := s.cache.Del(ctx, keyName).Err()
+	if err != nil {
+		return err
+	}
+	observe(withQuery(ctx, q), Event{Type: EventInvalidation, Count: 1})
+
+	for _, parent := range s.rollupParents[q.Name] {
+		err = s.invalidateBucket(ctx, parent, objMap, t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// actionBucket takes the bucket a written row falls into and invalidates it along with its rollups
+func (s *storage) actionBucket(ctx context.Context, q *Query, objMap map[string]interface{}, previous map[string]interface{}) error {
+	if q.RollupOf != "" {
+		// rollups are invalidated from the leaf query up
+		return nil
+	}
+
+	t, err := bucketTime(objMap[q.BucketField])
+	if err != nil {
+		return fmt.Errorf("query %s: %s", q.Name, err)
+	}
+
+	err = s.invalidateBucket(ctx, q, objMap, t)
+	if err != nil {
+		return err
+	}
+
+	// an update that moved the row (e.g. changed its created_at) changed the bucket it used to be in as well
+	if previous == nil {
+		return nil
+	}
+	previousTime, err := bucketTime(orderedValue(previous[q.BucketField]))
+	if err != nil {
+		// e.g. it was NULL so it wasn't in a bucket
+		return nil
+	}
+	if q.getKeyNameBucket(previous, q.Bucket.start(previousTime)) == q.getKeyNameBucket(objMap, q.Bucket.start(t)) {
+		return nil
+	}
+	return s.invalidateBucket(ctx, q, previous, previousTime)
+}
+
+// movesBuckets returns whether the UpdateQuery can move a row to another bucket of one of the table's leaf bucket queries
+func (t *Table) movesBuckets() bool {
+	for _, q := range t.Queries {
+		if q.Bucket == BucketNone || q.RollupOf != "" {
+			continue
+		}
+		if len(t.updateColumns) == 0 || containsString(t.updateColumns, q.BucketField) {
+			return true
+		}
+		for _, field := range q.cacheKeyFields {
+			if containsString(t.updateColumns, field.columnName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// previousRow selects the row (with the table's primary query) before it's updated if the update can move it to another bucket
+func (s *storage) previousRow(ctx context.Context, table *Table, objMap map[string]interface{}, conn InsertInterface) (map[string]interface{}, error) {
+	if !table.movesBuckets() {
+		return nil, nil
+	}
+
+	q, ok := s.queries[table.PrimaryQueryName]
+	if !ok {
+		return nil, nil
+	}
+
+	res, err := s.db.queryStructs(ctx, objMap, q.Query, conn, table.structType)
+	if err == sql.ErrNoRows {
+		// the update will return the error
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return structToMap(res[0])
+}
+
+func (s *storage) selectBucketInto(ctx context.Context, obj interface{}, dest interface{}, queryName string, at time.Time, conn InsertInterface) error {
+	q, ok := s.queries[queryName]
+	if !ok {
+		return errors.New("config query not found; have you configured storage properly?")
+	}
+
+	if q.Bucket == BucketNone {
+		return fmt.Errorf("query %s is not a bucket query", queryName)
+	}
+
+	objMap, err := structToMap(obj)
+	if err != nil {
+		return err
+	}
+
+	row, err := s.selectBucket(ctx, q, objMap, q.Bucket.start(at), conn)
+	if err != nil {
+		return err
+	}
+
+	return mapToStruct(row, dest)
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketStartAndNext(t *testing.T) {
+	// not UTC; buckets always are
+	at := time.Date(2022, time.March, 31, 20, 45, 30, 500, time.FixedZone("EST", -5*60*60))
+
+	cases := []struct {
+		bucket      Bucket
+		start, next time.Time
+	}{
+		{BucketMinute, time.Date(2022, time.April, 1, 1, 45, 0, 0, time.UTC), time.Date(2022, time.April, 1, 1, 46, 0, 0, time.UTC)},
+		{BucketHour, time.Date(2022, time.April, 1, 1, 0, 0, 0, time.UTC), time.Date(2022, time.April, 1, 2, 0, 0, 0, time.UTC)},
+		{BucketDay, time.Date(2022, time.April, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, time.April, 2, 0, 0, 0, 0, time.UTC)},
+		{BucketMonth, time.Date(2022, time.April, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, time.May, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		start := c.bucket.start(at)
+		if !start.Equal(c.start) || start.Location() != time.UTC {
+			t.Errorf("%s: start = %v, want %v", c.bucket, start, c.start)
+		}
+		if next := c.bucket.next(start); !next.Equal(c.next) {
+			t.Errorf("%s: next = %v, want %v", c.bucket, next, c.next)
+		}
+	}
+
+	// a month bucket of january 31st is followed by february, not march
+	jan := BucketMonth.start(time.Date(2022, time.January, 31, 12, 0, 0, 0, time.UTC))
+	if next := BucketMonth.next(jan); !next.Equal(time.Date(2022, time.February, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("next of january = %v", next)
+	}
+
+	if BucketNone.String() != "none" || BucketDay.String() != "day" {
+		t.Errorf("String = %s & %s", BucketNone, BucketDay)
+	}
+}
+
+func TestBucketTime(t *testing.T) {
+	at := time.Date(2022, time.April, 1, 1, 45, 0, 0, time.UTC)
+
+	cases := []struct {
+		name  string
+		value interface{}
+		err   bool
+	}{
+		{name: "time", value: at},
+		{name: "pointer", value: &at},
+		{name: "string", value: "2022-04-01T01:45:00Z"},
+		{name: "nil pointer", value: (*time.Time)(nil), err: true},
+		{name: "not a time", value: "yesterday", err: true},
+		{name: "int", value: int64(1648777500), err: true},
+	}
+
+	for _, c := range cases {
+		got, err := bucketTime(c.value)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: want an error", c.name)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(at) {
+			t.Errorf("%s: bucketTime = %v, %v; want %v", c.name, got, err, at)
+		}
+	}
+}
+
+// leadsPerHour is benchLeadsTable with an UpdateQuery that can move a lead to another hour of a bucket query
+func leadsPerHour() *Table {
+	table := benchLeadsTable()
+	table.UpdateQuery = "update leads set created_at=:created_at where lead_id=:lead_id returning *"
+	table.Queries = append(table.Queries, &Query{
+		Name:         "LeadsPerHour",
+		CacheKey:     "user_id=%v|leads",
+		Bucket:       BucketHour,
+		BucketField:  "created_at",
+		Query:        "select count(*) as count from leads where user_id=:user_id and created_at >= :bucket_start and created_at < :bucket_end",
+		SelectAction: CacheSet,
+	})
+	return table
+}
+
+// an update that moves a lead to another hour invalidates the hour it used to be in as well as the one it's in now
+func TestUpdateMovesBuckets(t *testing.T) {
+	ctx := context.Background()
+
+	createdAt := benchCreatedAt
+	movedTo := benchCreatedAt.Add(3 * time.Hour)
+	s, m := stubStorage(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if strings.Contains(query, "count(*)") {
+			return []string{"count"}, [][]driver.Value{{int64(1)}}, nil
+		}
+		if strings.HasPrefix(query, "update") {
+			createdAt = movedTo
+		}
+		return []string{"lead_id", "user_id", "name", "email", "notes", "created_at"}, [][]driver.Value{
+			{int64(1), int64(2), []byte("Jane Doe"), []byte("jane@example.com"), []byte(""), createdAt},
+		}, nil
+	}, leadsPerHour())
+
+	lead := &benchLead{LeadID: 1, UserID: 2}
+	hours := map[string]time.Time{"before": benchCreatedAt, "after": movedTo}
+	keys := map[string]string{}
+	for name, at := range hours {
+		stats := map[string]interface{}{}
+		err := s.SelectBucket(ctx, lead, &stats, "LeadsPerHour", at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = s.(*storage).queries["LeadsPerHour"].getKeyNameBucket(map[string]interface{}{"user_id": int64(2)}, BucketHour.start(at))
+		if !m.Exists(keys[name]) {
+			t.Fatalf("the bucket %s wasn't cached", keys[name])
+		}
+	}
+
+	updated := &benchLead{LeadID: 1, UserID: 2, CreatedAt: movedTo}
+	err := s.Update(ctx, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range keys {
+		if m.Exists(key) {
+			t.Errorf("the bucket of the hour %s update is still cached", name)
+		}
+	}
+}
+
+// the params of the EXPLAIN of a query aren't left in the objMap that the table's queries share
+func TestValidateQueriesCopiesTheObjMap(t *testing.T) {
+	s, _ := stubStorage(t, benchLeads(1), leadsPerHour())
+
+	for _, q := range s.(*storage).queries {
+		for _, param := range []string{"limit", "offset", bucketStartParameter, bucketEndParameter} {
+			if _, ok := s.(*storage).queryToMap[q.Name][param]; ok {
+				t.Errorf("%s: %s was left in the objMap", q.Name, param)
+			}
+		}
+	}
+}
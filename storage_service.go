@@ -2,9 +2,11 @@ package storage
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
 
 	"github.com/go-redis/redis/v8"
 	"golang.org/x/sync/errgroup"
@@ -20,6 +22,7 @@ func (s *storage) selectOne(ctx context.Context, obj interface{}, queryName stri
 	if !ok {
 		return errors.New("config query not found; have you configured storage properly?")
 	}
+	ctx = withQuery(ctx, q)
 
 	objMap, err := structToMap(obj)
 	if err != nil {
@@ -31,10 +34,27 @@ func (s *storage) selectOne(ctx context.Context, obj interface{}, queryName stri
 
 	// get the cache value
 	// the obj should be of the value that the cache is expecting so we can then just unmarshal into that
-	err = s.cache.get(ctx, keyName, obj)
+	if q.cacheDataStructure == CacheDataStructureHash {
+		err = s.cache.hget(ctx, keyName, q.cacheFields, obj, q.encoder)
+	} else {
+		err = s.cache.get(ctx, keyName, obj, q.encoder)
+	}
+	if err == nil && s.queryToTable[q.Name].rowIsSoftDeleted(obj) {
+		// the row was cached before it was soft deleted
+		d(ctx, "cached row of key %s is soft deleted", keyName)
+		s.cache.delRow(ctx, s.queryToTable[q.Name], keyName)
+		return sql.ErrNoRows
+	}
 	if err == nil {
 		// we found the value in the cache
 		// object should already be set in the obj
+		observe(ctx, Event{Type: EventCacheHit})
+		if q.SoftTTL > 0 {
+			s.revalidate(ctx, q, keyName, func(ctx context.Context) error {
+				_, err := s.selectOneFromDB(ctx, q, objMap, s.db.consistentReadConn(ctx))
+				return err
+			})
+		}
 		return nil
 	}
 
@@ -43,28 +63,49 @@ func (s *storage) selectOne(ctx context.Context, obj interface{}, queryName stri
 		return err
 	}
 
-	dbQuery, err := q.getQuery(objMap)
+	// we have an err and it's a redis.Nil which means the value wasn't found in the cache
+	// let's get from the database and then set the cache
+	observe(ctx, Event{Type: EventCacheMiss})
+	res, err := s.selectOneFromDB(ctx, q, objMap, conn)
 	if err != nil {
 		return err
 	}
 
-	// we have an err and it's a redis.Nil which means the value wasn't found in the cache
-	// let's get from the database and then set the cache
-	res, err := s.db.query(ctx, objMap, dbQuery, conn)
+	return copyRow(res[0], obj)
+}
+
+// selectOneFromDB runs the query against the db & takes the query's SelectAction with the rows
+func (s *storage) selectOneFromDB(ctx context.Context, q *Query, objMap map[string]interface{}, conn InsertInterface) ([]interface{}, error) {
+	dbQuery, err := q.getQuery(objMap)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	table := s.queryToTable[q.Name]
+	res, err := s.db.queryStructs(ctx, objMap, dbQuery, conn, table.structType)
+	if err != nil {
+		return nil, err
+	}
+
+	res = table.withoutSoftDeleted(res)
+	if len(res) == 0 {
+		// the row's soft deleted; make sure it's not still cached (e.g. this is a background refresh)
+		s.cache.delRow(ctx, table, q.getKeyName(objMap))
+		return nil, sql.ErrNoRows
 	}
 	if len(res) == 1 {
-		objMap = res[0]
+		objMap, err = structToMap(res[0])
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// update the cache
-	err = s.cacheActionSelect(objMap, res, s.queries[queryName])
+	err = s.cacheActionSelect(ctx, objMap, res, q)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	return mapToStruct(res[0], obj)
+	return res, nil
 }
 
 func (s *storage) selectAll(ctx context.Context, obj interface{}, dest interface{}, queryName string, opts *SelectOptions, conn InsertInterface) error {
@@ -82,6 +123,7 @@ func (s *storage) selectAll(ctx context.Context, obj interface{}, dest interface
 	if !ok {
 		return errors.New("table config not found; have you configured storage properly?")
 	}
+	ctx = withQuery(ctx, q)
 
 	objMap, err := structToMapWithOptions(obj, opts)
 	if err != nil {
@@ -95,19 +137,46 @@ func (s *storage) selectAll(ctx context.Context, obj interface{}, dest interface
 
 	// there's no action to take on select so just do the query and return
 	if q.SelectAction == CacheNoAction {
-		objs, err := s.db.query(ctx, objMap, dbQuery, conn)
+		table := s.queryToTable[queryName]
+		objs, err := s.db.queryStructs(ctx, objMap, dbQuery, conn, table.structType)
 		if err != nil {
-			d("error: %+v", err)
+			d(ctx, "error: %+v", err)
 			return err
 		}
 
-		return mapsToStruct(objs, dest)
+		objs = table.withoutSoftDeleted(objs)
+		if len(objs) == 0 {
+			return sql.ErrNoRows
+		}
+		return structsToSlice(objs, dest)
 	}
 
-	if opts.FetchAllData {
-		err = s.cache.getList(ctx, q, objMap, dest, opts)
+	// the list stores the primary key (such as "lead_id" for the lead table) of q.CachePrimaryQueryStored's table
+	pkTable := s.queryToTable[q.CachePrimaryQueryStored]
+
+	if opts.FetchAllData && !opts.skipPageCache {
+		// read the page into its own slice so it can be checked before it's returned; getList keeps using it to set the page again
+		page := reflect.New(v.Elem().Type())
+		err = s.cache.getList(ctx, q, objMap, page.Interface(), opts)
+		if err == nil && pkTable.anySoftDeleted(page.Interface()) {
+			// a row was soft deleted after the page was cached; the page is filled from the list instead
+			d(ctx, "cached page has a soft deleted row")
+			s.cache.Del(ctx, q.getKeyNameSelectOpts(objMap, opts))
+			err = redis.Nil
+		}
+		if err == nil {
+			v.Elem().Set(page.Elem())
+
+			// the whole page was cached
+			observe(ctx, Event{Type: EventCacheHit})
+			if q.SoftTTL > 0 {
+				s.revalidate(ctx, q, q.getKeyNameSelectOpts(objMap, opts), s.refreshAll(obj, dest, queryName, opts))
+			}
+			return nil
+		}
+
 		// return if there is a real err. If it's redis.Nil then just keep moving forward
-		if err != nil && err != redis.Nil {
+		if err != redis.Nil {
 			return err
 		}
 	}
@@ -121,88 +190,275 @@ func (s *storage) selectAll(ctx context.Context, obj interface{}, dest interface
 	}
 
 	if exists == 1 {
+		if !opts.filled {
+			observe(ctx, Event{Type: EventCacheHit})
+			if q.SoftTTL > 0 {
+				s.revalidate(ctx, q, keyName, s.refreshAll(obj, dest, queryName, opts))
+			}
+		}
+
 		// get the cache value
 		// the obj should be of the value that the cache is expecting so we can then just unmarshal into that
-		ints := []int32{}
-		err = s.cache.LRange(ctx, keyName, int64(opts.Offset), int64(opts.cacheLimit)).ScanSlice(&ints)
+		// the members are the primary keys of CachePrimaryQueryStored's table as strings; they're converted to the pk fields' types below
+		members, err := s.cache.LRange(ctx, keyName, int64(opts.Offset), int64(opts.cacheLimit)).Result()
 		if err != nil {
 			return err
 		}
 
 		g, ctx := errgroup.WithContext(ctx)
 
-		d("found data in LRange; values: %+v", ints)
+		d(ctx, "found data in LRange; values: %+v", members)
 
-		res := []map[string]interface{}{}
-		for _, i := range ints {
+		res := []interface{}{}
+		// rows that are soft deleted are left out; it's by index so the goroutines don't share anything
+		missing := make([]bool, len(members))
+		for i, member := range members {
+			i := i
 
-			// get the row that corresponds to the primary key's id stored -> row
-			row := map[string]interface{}{}
-			for query, val := range s.queryToMap[q.CachePrimaryQueryStored] {
-				row[query] = val
+			// get the row that corresponds to the primary key stored with only the primary key's fields set
+			row, err := pkTable.rowFromListMember(member)
+			if err != nil {
+				return err
 			}
 
-			// set the CachePrimaryQueryStored's primary_key field to i
-			row[s.queryToTable[q.CachePrimaryQueryStored].PrimaryKeyField] = i // set the primary key's value
-
 			if opts.FetchAllData {
 				if s.disableConcurrency {
-					d("fetching without concurrency")
-					err = s.selectOne(ctx, &row, q.CachePrimaryQueryStored, conn)
+					d(ctx, "fetching without concurrency")
+					err = s.selectOne(ctx, row, q.CachePrimaryQueryStored, conn)
+					if err == sql.ErrNoRows && pkTable.SoftDeleteField != "" {
+						missing[i], err = true, nil
+					}
 					if err != nil {
 						return err
 					}
 				} else {
-					d("fetching with concurrency")
+					d(ctx, "fetching with concurrency")
 					g.Go(func() error {
-						return s.selectOne(ctx, &row, q.CachePrimaryQueryStored, conn)
+						err := s.selectOne(ctx, row, q.CachePrimaryQueryStored, conn)
+						if err == sql.ErrNoRows && pkTable.SoftDeleteField != "" {
+							missing[i], err = true, nil
+						}
+						return err
 					})
 				}
 			}
 			res = append(res, row)
 		}
 
-		g.Wait()
-		d("returning data (unmarshalled): %+v")
+		err = g.Wait()
+		if err != nil {
+			return err
+		}
+
+		if pkTable.SoftDeleteField != "" {
+			kept := res[:0]
+			for i, row := range res {
+				if !missing[i] {
+					kept = append(kept, row)
+				}
+			}
+			res = kept
+		}
+		d(ctx, "returning data (unmarshalled): %+v", res)
 		// put the res into the dest (type of []interface to dest's type)
 
 		if opts.FetchAllData {
-			s.cache.setList(q, objMap, res, opts)
+			s.cache.setList(detach(ctx), q, objMap, res, opts)
 		}
-		return mapsToStruct(res, dest)
+		return structsToSlice(res, dest)
 
 	}
 
 	// shouldn't have err here since we've already checked above
 	objMap, _ = structToMap(obj)
 
-	dbQuery, err = q.getQuery(objMap)
+	// we have an err and it's a redis.Nil which means the value wasn't found in the cache
+	// let's get from the database and then set the cache
+	observe(ctx, Event{Type: EventCacheMiss})
+	_, err = s.selectAllFromDB(ctx, q, objMap, conn)
 	if err != nil {
+		d(ctx, "error: %+v", err)
 		return err
 	}
 
-	// we have an err and it's a redis.Nil which means the value wasn't found in the cache
-	// let's get from the database and then set the cache
-	objs, err := s.db.query(ctx, objMap, dbQuery, conn)
+	d(ctx, "about to selectAll recursively\nObj: %+v\ndest: %+v", obj, dest)
+
+	filledOpts := *opts
+	filledOpts.filled = true
+
+	// this is dangerous...
+	return s.selectAll(ctx, obj, dest, queryName, &filledOpts, conn)
+}
+
+// selectAllFromDB runs the list query against the db & fills its list with the rows that aren't soft deleted
+func (s *storage) selectAllFromDB(ctx context.Context, q *Query, objMap map[string]interface{}, conn InsertInterface) ([]interface{}, error) {
+	dbQuery, err := q.getQuery(objMap)
 	if err != nil {
-		d("error: %+v", err)
-		return err
+		return nil, err
 	}
 
-	d("returning data (unmarshalled): %+v", objs)
+	table := s.queryToTable[q.Name]
+	objs, err := s.db.queryStructs(ctx, objMap, dbQuery, conn, table.structType)
+	if err != nil {
+		return nil, err
+	}
 
-	d("updating cache")
-	// update the cache
-	err = s.cacheActionSelect(objMap, objs, s.queries[queryName])
+	// soft deleted rows aren't cached; the list is filled with the rest
+	objs = table.withoutSoftDeleted(objs)
+	if len(objs) == 0 {
+		// the rows are gone; make sure the list isn't still cached (e.g. this is a background refresh)
+		s.cache.Del(ctx, q.getKeyName(objMap))
+		return nil, sql.ErrNoRows
+	}
+
+	d(ctx, "returning data (unmarshalled): %+v", objs)
+
+	d(ctx, "updating cache")
+	err = s.cacheActionSelect(ctx, objMap, objs, q)
 	if err != nil {
-		d("error: %+v", err)
-		return err
+		return nil, err
 	}
+	return objs, nil
+}
 
-	d("about to selectAll recursively\nObj: %+v\ndest: %+v", obj, dest)
+/*
+	refreshAll is the background refresh of a SoftTTL list query. The list is queried from the db & filled again, and its cached
+	pages are dropped since its members might've changed. If the read was FetchAllData then its page is read & set again too.
+*/
+func (s *storage) refreshAll(obj interface{}, dest interface{}, queryName string, opts *SelectOptions) func(ctx context.Context) error {
+	// copy obj since the caller owns it & the refresh runs after we've returned
+	v := reflect.Indirect(reflect.ValueOf(obj))
+	key := reflect.New(v.Type())
+	key.Elem().Set(v)
+	destType := reflect.TypeOf(dest).Elem()
+
+	refreshOpts := *opts
+	refreshOpts.skipPageCache = true
+	refreshOpts.filled = true
+
+	return func(ctx context.Context) error {
+		q := s.queries[queryName]
+		conn := s.db.consistentReadConn(ctx)
+
+		objMap, err := structToMap(key.Interface())
+		if err != nil {
+			return err
+		}
 
-	// this is dangerous...
-	return s.selectAll(ctx, obj, dest, queryName, opts, conn)
+		_, err = s.selectAllFromDB(ctx, q, objMap, conn)
+		// no rows means the list was deleted; its pages are still dropped but there's nothing to read
+		deleted := err == sql.ErrNoRows
+		if err != nil && !deleted {
+			return err
+		}
+
+		err = s.cache.updateList(ctx, q, objMap)
+		if err != nil || deleted || !opts.FetchAllData {
+			return err
+		}
+		return s.selectAll(ctx, key.Interface(), reflect.New(destType).Interface(), queryName, &refreshOpts, conn)
+	}
+}
+
+func (s *storage) count(ctx context.Context, obj interface{}, queryName string, conn InsertInterface) (int64, error) {
+	q, ok := s.queries[queryName]
+	if !ok {
+		return 0, errors.New("config query not found; have you configured storage properly?")
+	}
+	ctx = withQuery(ctx, q)
+
+	if q.cacheDataStructure != CacheDataStructureCounter && q.SelectAction != CacheNoAction {
+		return 0, fmt.Errorf("query %s is not a counter", queryName)
+	}
+
+	objMap, err := structToMap(obj)
+	if err != nil {
+		return 0, err
+	}
+
+	keyName := q.getKeyName(objMap)
+
+	// the generation from before the count is queried so the fill is skipped if the counter is written in the meantime
+	var gen string
+	if q.SelectAction != CacheNoAction {
+		count, err := s.cache.Get(ctx, keyName).Int64()
+		if err == nil {
+			observe(ctx, Event{Type: EventCacheHit})
+			return count, nil
+		}
+
+		// check to see if there's a real error
+		if err != redis.Nil {
+			return 0, err
+		}
+		observe(ctx, Event{Type: EventCacheMiss})
+
+		gen, err = s.cache.counterGen(ctx, keyName)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	dbQuery, err := q.getQuery(objMap)
+	if err != nil {
+		return 0, err
+	}
+
+	// we have a redis.Nil which means the count wasn't found in the cache; fill it from the db
+	res, err := s.db.query(ctx, objMap, dbQuery, conn)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := countFromRow(res[0])
+	if err != nil {
+		return 0, fmt.Errorf("query %s: %s", queryName, err)
+	}
+
+	if q.SelectAction == CacheSet {
+		d(ctx, "count() filling counter %s with %d", keyName, count)
+		// not if it was filled or written while we were querying; the count is still right for this call
+		var filled bool
+		filled, err = s.cache.fillCounter(ctx, keyName, gen, count, q.ttl())
+		if err == nil && filled {
+			observe(ctx, Event{Type: EventCacheSet, Action: CacheSet})
+		}
+	}
+
+	return count, err
+}
+
+// countFromRow takes the single column of a count query's row and returns it as an int64
+func countFromRow(row map[string]interface{}) (int64, error) {
+	var value interface{}
+	columns := 0
+	for column, v := range row {
+		if column == objMapStructNameKey {
+			continue
+		}
+		value = v
+		columns++
+	}
+
+	if columns != 1 {
+		return 0, fmt.Errorf("count query must return a single column; returned: %d", columns)
+	}
+
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case int32:
+		return int64(v), nil
+	case int:
+		return int64(v), nil
+	case float64:
+		return int64(v), nil
+	case []byte:
+		return strconv.ParseInt(string(v), 10, 64)
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, fmt.Errorf("count query returned a %T", value)
 }
 
 func (s *storage) insert(ctx context.Context, objMap map[string]interface{}, conn InsertInterface) (map[string]interface{}, error) {
@@ -218,8 +474,7 @@ func (s *storage) insert(ctx context.Context, objMap map[string]interface{}, con
 		return nil, errors.New("no config key found for " + structName)
 	}
 
-	// TODO: set objMap
-	res, err := s.db.query(ctx, objMap, table.InsertQuery, conn)
+	res, err := s.db.queryStructs(withTable(ctx, table), objMap, table.InsertQuery, conn, table.structType)
 	if err != nil {
 		return nil, err
 	}
@@ -228,14 +483,61 @@ func (s *storage) insert(ctx context.Context, objMap map[string]interface{}, con
 		return nil, errors.New("insert did not return a single row; returned: " + fmt.Sprintf("%d", len(res)))
 	}
 
-	// objMap probably has stuff we need, such as private keys, so we'll just overwrite the fields we have and return objMap
-	for k, v := range res[0] {
-		objMap[k] = v
+	return mergeRow(objMap, res[0])
+}
+
+/*
+	update runs the table's UpdateQuery & returns the updated row. previous is the row from before the update if it could have
+	moved the row to another bucket (see previousRow) so those buckets are invalidated too; it's nil otherwise
+*/
+func (s *storage) update(ctx context.Context, objMap map[string]interface{}, conn InsertInterface) (res map[string]interface{}, previous map[string]interface{}, err error) {
+	// get the struct's string name to get config key
+	structName := objMap[objMapStructNameKey].(string)
+	if structName == "" {
+		return nil, nil, errors.New("struct name cannot be blank")
 	}
-	return objMap, nil
+
+	// get config key
+	table, ok := s.structToTable[structName]
+	if !ok {
+		return nil, nil, errors.New("no config key found for " + structName)
+	}
+
+	previous, err = s.previousRow(withTable(ctx, table), table, objMap, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := s.db.queryStructs(withTable(ctx, table), objMap, table.updateQuery, conn, table.structType)
+	if err == sql.ErrNoRows && table.VersionField != "" {
+		// the version check didn't match so someone else has updated the row (or it doesn't exist)
+		version, _ := table.version(objMap)
+		return nil, nil, fmt.Errorf("%w: %s %s %d", ErrConflict, table.tableName, table.VersionField, version)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(rows) != 1 {
+		return nil, nil, errors.New("update did not return a single row; returned: " + fmt.Sprintf("%d", len(rows)))
+	}
+
+	res, err = mergeRow(objMap, rows[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, previous, nil
 }
 
-func (s *storage) update(ctx context.Context, objMap map[string]interface{}, conn InsertInterface) (map[string]interface{}, error) {
+// updateKeepingPrevious is update as a writeFunc; the row from before the update is kept in previous
+func (s *storage) updateKeepingPrevious(previous *map[string]interface{}) writeFunc {
+	return func(ctx context.Context, objMap map[string]interface{}, conn InsertInterface) (res map[string]interface{}, err error) {
+		res, *previous, err = s.update(ctx, objMap, conn)
+		return res, err
+	}
+}
+
+func (s *storage) deleteRow(ctx context.Context, objMap map[string]interface{}, conn InsertInterface) (map[string]interface{}, error) {
 	// get the struct's string name to get config key
 	structName := objMap[objMapStructNameKey].(string)
 	if structName == "" {
@@ -248,23 +550,37 @@ func (s *storage) update(ctx context.Context, objMap map[string]interface{}, con
 		return nil, errors.New("no config key found for " + structName)
 	}
 
-	res, err := s.db.query(ctx, objMap, table.UpdateQuery, conn)
+	if table.DeleteQuery == "" {
+		return nil, errors.New("no DeleteQuery set for " + structName)
+	}
+
+	res, err := s.db.queryStructs(withTable(ctx, table), objMap, table.DeleteQuery, conn, table.structType)
 	if err != nil {
 		return nil, err
 	}
 
 	if len(res) != 1 {
-		return nil, errors.New("update did not return a single row; returned: " + fmt.Sprintf("%d", len(res)))
+		return nil, errors.New("delete did not return a single row; returned: " + fmt.Sprintf("%d", len(res)))
+	}
+
+	return mergeRow(objMap, res[0])
+}
+
+// mergeRow overwrites the fields of objMap with the row's & returns objMap
+func mergeRow(objMap map[string]interface{}, row interface{}) (map[string]interface{}, error) {
+	rowMap, err := structToMap(row)
+	if err != nil {
+		return nil, err
 	}
 
 	// objMap probably has stuff we need, such as private keys, so we'll just overwrite the fields we have and return objMap
-	for k, v := range res[0] {
+	for k, v := range rowMap {
 		objMap[k] = v
 	}
 	return objMap, nil
 }
 
-// delete takes action on all the keys and referenced keys associated with this object
-func (s *storage) delete(ctx context.Context, obj map[string]interface{}) error {
-	return s.actionNonSelect(obj, actionDelete)
+// evict removes all the keys and referenced keys associated with this object from the cache
+func (s *storage) evict(ctx context.Context, obj map[string]interface{}) error {
+	return s.actionNonSelect(ctx, obj, nil, actionEvict)
 }
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCountFromRow(t *testing.T) {
+	cases := []struct {
+		name string
+		row  map[string]interface{}
+		want int64
+		err  bool
+	}{
+		{name: "int64", row: map[string]interface{}{"count": int64(12)}, want: 12},
+		{name: "int32", row: map[string]interface{}{"count": int32(12)}, want: 12},
+		{name: "float64", row: map[string]interface{}{"count": float64(12)}, want: 12},
+		{name: "numeric bytes", row: map[string]interface{}{"count": []byte("12")}, want: 12},
+		{name: "string", row: map[string]interface{}{"count": "12"}, want: 12},
+		{name: "struct name is ignored", row: map[string]interface{}{objMapStructNameKey: "Lead", "count": int64(3)}, want: 3},
+		{name: "two columns", row: map[string]interface{}{"count": int64(1), "lead_id": int64(1)}, err: true},
+		{name: "no columns", row: map[string]interface{}{}, err: true},
+		{name: "not a number", row: map[string]interface{}{"count": "many"}, err: true},
+		{name: "bool", row: map[string]interface{}{"count": true}, err: true},
+	}
+
+	for _, c := range cases {
+		got, err := countFromRow(c.row)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: want an error", c.name)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("%s: countFromRow = %d, %v; want %d", c.name, got, err, c.want)
+		}
+	}
+}
+
+// a write to a counter while it's being counted in the db means the count is stale so it isn't filled; the next count fills it
+func TestCountIsNotFilledAfterAWrite(t *testing.T) {
+	ctx := context.Background()
+
+	table := benchLeadsTable()
+	table.Queries = append(table.Queries, &Query{
+		Name:         "LeadsCountByUser",
+		CacheKey:     "user_id=%v|count",
+		Query:        "select count(*) from leads where user_id=:user_id",
+		InsertAction: CacheIncr,
+		UpdateAction: CacheNoAction,
+		DeleteAction: CacheDecr,
+		SelectAction: CacheSet,
+		CacheTTL:     600,
+	})
+
+	var s Storage
+	var key string
+	write := false
+	s, m := stubStorage(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if write && strings.HasPrefix(query, "select count(*)") {
+			// a lead is inserted after the count was queried but before it's filled
+			write = false
+			err := s.(*storage).cache.incrX(ctx, key, 1, 600*time.Second)
+			if err != nil {
+				return nil, nil, err
+			}
+			return []string{"count"}, [][]driver.Value{{int64(2)}}, nil
+		}
+		return []string{"count"}, [][]driver.Value{{int64(3)}}, nil
+	}, table)
+	lead := &benchLead{UserID: 2}
+	key, _ = s.KeyName("LeadsCountByUser", lead)
+	write = true
+
+	got, err := s.Count(ctx, lead, "LeadsCountByUser")
+	if err != nil || got != 2 {
+		t.Fatalf("Count = %d, %v; want 2", got, err)
+	}
+	if m.Exists(key) {
+		t.Errorf("%s was filled with a count from before the write", key)
+	}
+	if ttl := m.TTL(counterGenKey(key)); ttl != 600*time.Second {
+		t.Errorf("the generation's TTL = %s, want 10m", ttl)
+	}
+
+	got, err = s.Count(ctx, lead, "LeadsCountByUser")
+	if err != nil || got != 3 {
+		t.Fatalf("Count = %d, %v; want 3", got, err)
+	}
+	if v, _ := m.Get(key); v != "3" {
+		t.Errorf("%s = %q, want 3", key, v)
+	}
+}
+
+func TestFillCounter(t *testing.T) {
+	ctx := context.Background()
+	client, m := stubRedis(t)
+	c := newCache(client)
+
+	gen, err := c.counterGen(ctx, "count")
+	if err != nil || gen != "" {
+		t.Fatalf("counterGen = %q, %v; want none", gen, err)
+	}
+	err = c.delCounter(ctx, "count", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := m.TTL(counterGenKey("count")); ttl != versionKeyTTL {
+		t.Errorf("the generation's TTL without a CacheTTL = %s, want %s", ttl, versionKeyTTL)
+	}
+	filled, err := c.fillCounter(ctx, "count", gen, 3, 0)
+	if err != nil || filled {
+		t.Errorf("fillCounter after a delete = %v, %v; want it skipped", filled, err)
+	}
+
+	gen, _ = c.counterGen(ctx, "count")
+	filled, err = c.fillCounter(ctx, "count", gen, 3, 0)
+	if err != nil || !filled {
+		t.Errorf("fillCounter = %v, %v; want it filled", filled, err)
+	}
+	filled, err = c.fillCounter(ctx, "count", gen, 4, 0)
+	if err != nil || filled {
+		t.Errorf("fillCounter of a filled counter = %v, %v; want it skipped", filled, err)
+	}
+	if v, _ := m.Get("count"); v != "3" || m.TTL("count") != 0 {
+		t.Errorf("count = %q with a TTL of %s, want 3 without one", v, m.TTL("count"))
+	}
+
+	// a key with a hash tag has no generation of its own; it's filled like before
+	filled, err = c.fillCounter(ctx, "{tag}count", "", 5, time.Minute)
+	if err != nil || !filled || m.TTL("{tag}count") != time.Minute {
+		t.Errorf("fillCounter of a hash tagged key = %v, %v", filled, err)
+	}
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"strings"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -10,17 +11,26 @@ type Tx struct {
 	s  *storage
 	tx *sqlx.Tx
 
-	actions []txAction
+	actions    []txAction
+	afterHooks []txHook // run on End once the tx is committed
 }
 
 type txAction struct {
-	action actionTypes
-	obj    map[string]interface{}
+	action   actionTypes
+	obj      map[string]interface{}
+	previous map[string]interface{} // the row before an update; see update
+}
+
+type txHook struct {
+	hook hookType
+	obj  interface{} // a copy of the row as it was written
 }
 
 type TxInterface interface {
 	Insert(ctx context.Context, obj interface{}) error
 	Update(ctx context.Context, obj interface{}) error
+	Delete(ctx context.Context, obj interface{}) error
+	Restore(ctx context.Context, obj interface{}) error
 
 	End(ctx context.Context) error
 	Rollback(ctx context.Context) error
@@ -46,70 +56,216 @@ func (s *storage) TXBegin(ctx context.Context) (TxInterface, error) {
 	}, nil
 }
 
-func (t *Tx) Insert(ctx context.Context, obj interface{}) error {
+func (t *Tx) Insert(ctx context.Context, obj interface{}) (err error) {
+	ctx, end := t.s.startCall(ctx, "Tx.Insert", "")
+	defer func() {
+		end(err)
+	}()
+
+	err = t.s.runHook(ctx, hookBeforeInsert, obj)
+	if err != nil {
+		return err
+	}
+
 	objMap, err := structToMap(obj)
 	if err != nil {
 		return err
 	}
 
 	// set the objMap to the return value
-	objMap, err = t.s.insert(ctx, objMap, t.tx)
+	objMap, entry, err := t.s.writeAudited(ctx, objMap, AuditInsert, t.s.insert, t.tx)
 	if err != nil {
 		return err
 	}
+	t.queueAuditEntry(entry)
 
 	t.actions = append(t.actions, txAction{
 		action: actionInsert,
 		obj:    objMap,
 	})
 
-	return mapToStruct(objMap, obj)
+	err = mapToStruct(objMap, obj)
+	if err != nil {
+		return err
+	}
+
+	t.afterHooks = append(t.afterHooks, txHook{
+		hook: hookAfterInsert,
+		obj:  copyForHook(obj),
+	})
+	return nil
 }
 
-func (t *Tx) Update(ctx context.Context, obj interface{}) error {
+func (t *Tx) Update(ctx context.Context, obj interface{}) (err error) {
+	ctx, end := t.s.startCall(ctx, "Tx.Update", "")
+	defer func() {
+		end(err)
+	}()
+
+	err = t.s.runHook(ctx, hookBeforeUpdate, obj)
+	if err != nil {
+		return err
+	}
+
 	objMap, err := structToMap(obj)
 	if err != nil {
 		return err
 	}
 
 	// set the objMap to the return value
-	objMap, err = t.s.update(ctx, objMap, t.tx)
+	var previous map[string]interface{}
+	objMap, entry, err := t.s.writeAudited(ctx, objMap, AuditUpdate, t.s.updateKeepingPrevious(&previous), t.tx)
 	if err != nil {
 		return err
 	}
+	t.queueAuditEntry(entry)
 
 	t.actions = append(t.actions, txAction{
-		action: actionUpdate,
+		action:   actionUpdate,
+		obj:      objMap,
+		previous: previous,
+	})
+	err = mapToStruct(objMap, obj)
+	if err != nil {
+		return err
+	}
+
+	t.afterHooks = append(t.afterHooks, txHook{
+		hook: hookAfterUpdate,
+		obj:  copyForHook(obj),
+	})
+	return nil
+}
+
+func (t *Tx) Delete(ctx context.Context, obj interface{}) (err error) {
+	ctx, end := t.s.startCall(ctx, "Tx.Delete", "")
+	defer func() {
+		end(err)
+	}()
+
+	objMap, err := structToMap(obj)
+	if err != nil {
+		return err
+	}
+
+	// set the objMap to the deleted row
+	objMap, entry, err := t.s.writeAudited(ctx, objMap, AuditDelete, t.s.deleteRow, t.tx)
+	if err != nil {
+		return err
+	}
+	t.queueAuditEntry(entry)
+
+	t.actions = append(t.actions, txAction{
+		action: actionDelete,
+		obj:    objMap,
+	})
+	return mapToStruct(objMap, obj)
+}
+
+func (t *Tx) Restore(ctx context.Context, obj interface{}) (err error) {
+	ctx, end := t.s.startCall(ctx, "Tx.Restore", "")
+	defer func() {
+		end(err)
+	}()
+
+	objMap, err := structToMap(obj)
+	if err != nil {
+		return err
+	}
+
+	// set the objMap to the restored row
+	objMap, entry, err := t.s.writeAudited(ctx, objMap, AuditRestore, t.s.restoreRow, t.tx)
+	if err != nil {
+		return err
+	}
+	t.queueAuditEntry(entry)
+
+	t.actions = append(t.actions, txAction{
+		action: actionInsert,
 		obj:    objMap,
 	})
 	return mapToStruct(objMap, obj)
 }
 
 func (t *Tx) Select(ctx context.Context, obj interface{}, key string) error {
-	return t.s.selectOne(ctx, obj, key, t.tx)
+	ctx, end := t.s.startCall(ctx, "Tx.Select", key)
+	err := t.s.selectOne(ctx, obj, key, t.tx)
+	if err == nil {
+		err = t.s.afterSelect(ctx, key, obj)
+	}
+	return end(err)
 }
 
 func (t *Tx) SelectAll(ctx context.Context, obj interface{}, objs interface{}, key string, opts *SelectOptions) error {
-	return t.s.selectAll(ctx, obj, objs, key, opts, t.tx)
+	ctx, end := t.s.startCall(ctx, "Tx.SelectAll", key)
+	err := t.s.selectAll(ctx, obj, objs, key, opts, t.tx)
+	if err == nil {
+		err = t.s.afterSelect(ctx, key, objs)
+	}
+	return end(err)
 }
 
 func (t *Tx) Rollback(ctx context.Context) error {
 	return t.tx.Rollback()
 }
 
-func (t *Tx) End(ctx context.Context) error {
-	err := t.tx.Commit()
+func (t *Tx) End(ctx context.Context) (err error) {
+	ctx, end := t.s.startCall(ctx, "Tx.End", "")
+	defer func() {
+		end(err)
+	}()
+
+	err = t.tx.Commit()
 	if err != nil {
+		// nothing was written so there's nothing to cache (or audit)
 		t.tx.Rollback()
+		return err
 	}
+	t.s.db.recordWrite(ctx)
 
+	// the tx is committed so every action & after hook is run even if one fails; they're all returned together
+	var errs txErrors
 	for _, action := range t.actions {
-		err = t.s.actionNonSelect(action.obj, action.action)
-		if err != nil {
-			// do we realy want to return an error here? Or finish the tx and return an error?
-			return err
-		}
+		errs = errs.add(t.s.actionNonSelect(ctx, action.obj, action.previous, action.action))
 	}
 
-	return err
+	// the after hooks only see writes that were committed
+	for _, h := range t.afterHooks {
+		errs = errs.add(t.s.runHook(ctx, h.hook, h.obj))
+	}
+	return errs.err()
+}
+
+// txErrors are the errors of a committed tx's cache actions & after hooks
+type txErrors []error
+
+func (e txErrors) add(err error) txErrors {
+	if err == nil {
+		return e
+	}
+	return append(e, err)
+}
+
+// err returns nil if there weren't any errors & the error itself if there was only one
+func (e txErrors) err() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	}
+	return e
+}
+
+func (e txErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap is so errors.Is & errors.As find any of them (go 1.20+)
+func (e txErrors) Unwrap() []error {
+	return e
 }
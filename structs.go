@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 )
 
 type actionTypes int32
@@ -13,6 +15,7 @@ const (
 	actionInsert
 	actionUpdate
 	actionDelete
+	actionEvict // DeleteKeys: the row's keys are removed whatever the queries' actions are
 )
 
 const (
@@ -21,6 +24,13 @@ const (
 
 	cacheKeyListModifier         = "|offset:%v|limit:%v"
 	cacheKeyListMetadataModifier = "|metadata"
+	cacheKeyBucketModifier       = "|bucket:%s:%v"
+	cacheKeyFreshModifier        = "|fresh" // marker that a SoftTTL query's key isn't stale yet
+	cacheKeyCounterGenModifier   = "|gen"   // the fill generation of a counter (see counterGenKey)
+
+	// named parameters set for bucket queries e.g. `created_at >= :bucket_start and created_at < :bucket_end`
+	bucketStartParameter = "bucket_start"
+	bucketEndParameter   = "bucket_end"
 )
 
 // Define the cache actions you can take
@@ -34,15 +44,36 @@ const (
 	CacheSet
 	CacheLPush
 	CacheRPush
+	CacheHSet // store the row as a hash of CacheFields; see Query.CacheFields
+	CacheIncr // increment a counter; only if the key exists
+	CacheDecr // decrement a counter; only if the key exists
 )
 
-type cacheKeyFieldOperator int32
-
-const (
-	operatorDefault cacheKeyFieldOperator = iota
-	operatorEqual
-	operatorNotEqual
-)
+func (a CacheAction) String() string {
+	switch a {
+	case CacheDefault:
+		return "default"
+	case CacheNoAction:
+		return "noAction"
+	case CacheDel:
+		return "del"
+	case CacheGet:
+		return "get"
+	case CacheSet:
+		return "set"
+	case CacheLPush:
+		return "lpush"
+	case CacheRPush:
+		return "rpush"
+	case CacheHSet:
+		return "hset"
+	case CacheIncr:
+		return "incr"
+	case CacheDecr:
+		return "decr"
+	}
+	return fmt.Sprintf("CacheAction(%d)", int32(a))
+}
 
 type CacheDataStructure int32
 
@@ -50,6 +81,8 @@ const (
 	CacheDataStructureDefault CacheDataStructure = iota
 	CacheDataStructureStruct
 	CacheDataStructureList
+	CacheDataStructureHash
+	CacheDataStructureCounter
 )
 
 // Query is the struct that holds the config for a query and how it interacts with the cache & db
@@ -96,11 +129,14 @@ type Query struct {
 	CacheKey     string
 	fullCacheKey string // adds the service name & table name to the beginning of the cache key
 
-	cacheKeyFields                    []cacheKeyField // tags of the db fields for the key e.g. if key is `lead_id=%v` then the fields would be []string{"lead_id"}
-	cacheKeyContainsNotEqualsOperator bool            // if the key contains a `!=` operator
-	cacheListKey                      string          // cacheListKey is the generated key name for when the cacheDataStructure is a list
+	cacheKeyFields                []cacheKeyField // tags of the db fields for the key e.g. if key is `lead_id=%v` then the fields would be []string{"lead_id"}
+	cacheKeyContainsValueOperator bool            // if the key compares a column to a value e.g. `email!=asdf@asdf.com` or `role=OWNER`
+	cacheListKey                  string          // cacheListKey is the generated key name for when the cacheDataStructure is a list
 
-	CacheTTL           int                // time to live in seconds; 0 = default for the application; -1 = never expire
+	CacheTTL           int                // time to live in seconds; 0 = default for the application; -1 = never expire (see Config.AllowNoExpire)
+	TTLField           string             // column with the time the row expires e.g. `expires_at`; its key expires then instead of after CacheTTL
+	SoftTTL            int                // seconds until a cached value is stale; it's still returned but refreshed in the background. 0 = off
+	maxTTL             time.Duration      // Config.MaxTTL; a TTLField's expiration can't be longer
 	cacheDataStructure CacheDataStructure // data structure to use for cache e.g. if it's a single object (struct) or a list of id's
 
 	//cacheListKeys        []string           // cacheListKeys stores the keys associated with SelectAll calls where selectOpts is defined
@@ -120,9 +156,50 @@ type Query struct {
 	*/
 	CachePrimaryQueryStored string
 
+	/*
+		CacheFields is the whitelist of columns (json tags) stored in the cache when the query uses CacheHSet.
+		The row is stored as a Redis hash with one field per column so that:
+		- large columns (e.g. a `notes` TEXT column) aren't duplicated into every cached row
+		- updates only HSET the columns that are set in Table.UpdateQuery instead of rewriting the whole row
+		- reads HMGET only the projection; columns not in CacheFields are left untouched on the obj for a cache hit
+
+		If empty then every column of the Table.Struct is stored.
+		NOTE: only applicable if the actions are CacheHSet
+	*/
+	CacheFields []string
+	cacheFields []string // the parsed CacheFields; defaults to every column of the table
+
+	encoder *encoder // encodes the cached values with the table's codec
+
+	/*
+		CompressAbove is the size in bytes above which a cached value (a struct or a SelectAll page) is compressed; 0 = never compress.
+		Compressed values are detected automatically when they're read so this can be changed at any time.
+	*/
+	CompressAbove int
+	Compressor    Compressor // compresses values over CompressAbove; defaults to GzipCompressor
+
 	InsertAction CacheAction // action to take on this key when an insert happens to the key this struct is attached to e.g. Del, LPush, etc
 	UpdateAction CacheAction // action to take on this key when an update happens to the key this struct is attached to e.g. Del, LPush, etc
 	SelectAction CacheAction // action to take on this key when a set happens to the key this struct is attached to (most likely CacheSet)
+	DeleteAction CacheAction // action to take on this key when a row is deleted e.g. CacheDecr for counters; defaults to CacheDel
+
+	/*
+		Bucket makes this an analytics query that's cached per time bucket (in UTC) e.g. `group_id=%v|chats` with a BucketHour
+		would be cached as `group_id=15|chats|bucket:hour:1637280000`.
+
+		There are two kinds of bucket queries:
+		1. A leaf query, which has a Query & BucketField. The Query is run with the named parameters :bucket_start & :bucket_end
+			e.g. `select count(*) from chats where group_id=:group_id and created_at >= :bucket_start and created_at < :bucket_end`
+		2. A rollup, which has RollupOf & Aggregate. It's built out of the buckets of the RollupOf query (like legos) e.g. a
+			day is built from its 24 hour buckets and a month from its days. Aggregate combines the children's rows into this bucket's row.
+
+		Writing a row invalidates the leaf bucket that the row's BucketField falls into and then every rollup on top of it.
+		NOTE: the Insert & Update actions are ignored; bucket queries are always invalidated. SelectAction should be CacheSet
+	*/
+	Bucket      Bucket
+	BucketField string                                                                  // column with the row's time e.g. `created_at`; only for leaf queries
+	RollupOf    string                                                                  // query.Name of the query (in the same table) with smaller buckets that this aggregates
+	Aggregate   func(children []map[string]interface{}) (map[string]interface{}, error) // combines the RollupOf buckets into this bucket's row
 }
 
 // getKeyName takes a cache's abstract key, e.g. `lead_id:%v` and returns the key name e.g. `service:lead|Lead|lead_id:1273`
@@ -130,22 +207,47 @@ func (q *Query) getKeyName(objMap map[string]interface{}) string {
 
 	args := []interface{}{}
 	for _, field := range q.cacheKeyFields {
-		if field.operator == operatorNotEqual {
+		if !field.isParameter() {
 			continue
 		}
-		args = append(args, objMap[field.columnName])
+		args = append(args, keyValue(objMap[field.columnName]))
 	}
 
 	return fmt.Sprintf(q.fullCacheKey+"|"+q.CacheKey, args...)
 }
 
+// updatedHashFields returns the cacheFields that are set by an update query's columns. If the update query's
+// columns are unknown then all of the cacheFields are returned
+func (q *Query) updatedHashFields(updateColumns []string) []string {
+	if len(updateColumns) == 0 {
+		return q.cacheFields
+	}
+
+	fields := []string{}
+	for _, field := range q.cacheFields {
+		for _, column := range updateColumns {
+			if field == column {
+				fields = append(fields, field)
+				break
+			}
+		}
+	}
+	return fields
+}
+
+// getKeyNameBucket returns the key name for the bucket that starts at start e.g. `service:chat|Chats|group_id=15|bucket:hour:1637280000`
+// the size of the bucket is in the key since e.g. an hour & the day it's in can start at the same time
+func (q *Query) getKeyNameBucket(objMap map[string]interface{}, start time.Time) string {
+	return q.getKeyName(objMap) + fmt.Sprintf(cacheKeyBucketModifier, q.Bucket, start.Unix())
+}
+
 func (q *Query) getKeyNameSelectOpts(objMap map[string]interface{}, opts *SelectOptions) string {
 	args := []interface{}{}
 	for _, field := range q.cacheKeyFields {
-		if field.operator == operatorNotEqual {
+		if !field.isParameter() {
 			continue
 		}
-		args = append(args, objMap[field.columnName])
+		args = append(args, keyValue(objMap[field.columnName]))
 	}
 
 	args = append(args, opts.Offset, opts.Limit)
@@ -156,10 +258,10 @@ func (q *Query) getKeyNameSelectOpts(objMap map[string]interface{}, opts *Select
 func (q *Query) getKeyNameMetadata(objMap map[string]interface{}) string {
 	args := []interface{}{}
 	for _, field := range q.cacheKeyFields {
-		if field.operator == operatorNotEqual {
+		if !field.isParameter() {
 			continue
 		}
-		args = append(args, objMap[field.columnName])
+		args = append(args, keyValue(objMap[field.columnName]))
 	}
 
 	return fmt.Sprintf(q.fullCacheKey+"|"+q.cacheListMetadataKey, args...)
@@ -182,36 +284,22 @@ func (q *Query) getQuery(objMap map[string]interface{}) (string, error) {
 
 	if len(q.slicesInQuery) != 0 {
 		for parameter, sliceType := range q.slicesInQuery {
-			parameterValue := ""
-			switch sliceType {
-			case reflect.TypeOf([]string{}):
-				// check if slice is nil
-				v, ok := objMap[parameter].([]interface{})
-				if !ok {
-					return "", fmt.Errorf("%v cannot be nil", parameter)
-				}
-
-				inStrings := []string{}
-				for _, value := range v {
-					inStrings = append(inStrings, value.(string))
-				}
-				parameterValue = fmt.Sprintf("'%s'", strings.Join(inStrings, "', '"))
-			default:
-				// check if slice is nil
-				v, ok := objMap[parameter].([]interface{})
-				if !ok {
-					return "", fmt.Errorf("%v cannot be nil", parameter)
-				}
+			// check if slice is nil
+			v := reflect.ValueOf(objMap[parameter])
+			if v.Kind() != reflect.Slice || v.IsNil() {
+				return "", fmt.Errorf("%v cannot be nil", parameter)
+			}
 
-				// if it's not a string then all the ints automatically get converted to int64
-				inNumbers := []float64{}
-				for _, value := range v {
-					inNumbers = append(inNumbers, value.(float64))
+			values := []string{}
+			for i := 0; i < v.Len(); i++ {
+				value := fmt.Sprint(v.Index(i).Interface())
+				if sliceType.Elem().Kind() == reflect.String {
+					value = "'" + strings.Replace(value, "'", "''", -1) + "'"
 				}
-				parameterValue = strings.Join(strings.Split(fmt.Sprint(inNumbers), " "), ", ")
-				parameterValue = strings.Replace(parameterValue, "[", "", -1)
-				parameterValue = strings.Replace(parameterValue, "]", "", -1)
+				values = append(values, value)
 			}
+
+			parameterValue := strings.Join(values, ", ")
 			query = strings.Replace(query, fmt.Sprintf(":%s", parameter), parameterValue, -1)
 		}
 	}
@@ -219,27 +307,27 @@ func (q *Query) getQuery(objMap map[string]interface{}) (string, error) {
 	return query, nil
 }
 
-func (q *Query) isValidQuery(objMap map[string]interface{}) bool {
-	if !q.cacheKeyContainsNotEqualsOperator {
-		// if it doesn't have an equal operator then it's automatically valid
+// isCached returns whether the query uses the cache at all
+func (q *Query) isCached() bool {
+	return q.InsertAction != CacheNoAction || q.UpdateAction != CacheNoAction || q.SelectAction != CacheNoAction
+}
+
+// isValidQuery returns whether the row in objMap belongs in the query's key e.g. a row with role MEMBER doesn't belong in `role=OWNER`
+func (q *Query) isValidQuery(ctx context.Context, objMap map[string]interface{}) bool {
+	if !q.cacheKeyContainsValueOperator {
+		// if it doesn't compare a column to a value then it's automatically valid
 		return true
 	}
 
 	for _, field := range q.cacheKeyFields {
-		if field.operator == operatorNotEqual && objMap[field.columnName] == field.value {
-			d("not equal operator found for field %v", field.columnName)
-			return false // the objMap has a field that matches the key's value
+		if !field.isParameter() && !field.eval(objMap[field.columnName]) {
+			d(ctx, "row doesn't match %v", field.segment)
+			return false
 		}
 	}
 	return true
 }
 
-type cacheKeyField struct {
-	columnName string
-	operator   cacheKeyFieldOperator
-	value      string
-}
-
 type Insert struct {
 	Query string
 }
@@ -248,14 +336,41 @@ type Table struct {
 	Struct interface{}            // DB struct this is based off of
 	objMap map[string]interface{} // generic map that has the struct's fields + other info as keys and the values unset
 
+	// Codec is used to encode all the values cached for this table e.g. MsgpackCodec or NewProtoCodec(...); defaults to JSONCodec
+	Codec Codec
+
 	InsertQuery       string // insert query for inserting data
 	UpdateQuery       string
+	DeleteQuery       string   // query used by Delete e.g. `delete from leads where lead_id=:lead_id returning *`
+	RestoreQuery      string   // query used by Restore for a SoftDeleteField e.g. `update leads set deleted_at=null where lead_id=:lead_id returning *`
 	PrimaryKeyField   string   // field name of the primary key e.g. LeadID or UserID
+	PrimaryKeyFields  []string // field names of a composite primary key e.g. []string{"group_id", "user_id"}; use instead of PrimaryKeyField
 	PrimaryQueryName  string   // the query.Name of the one that fetches based off the primary key in the db e.g. LeadGetByID or OpportunityGetByID
 	Queries           []*Query // all the queries that are used to fetch the data from the db & cache
 	ReferencedQueries []*Query // the query that is used to fetch the data from the db & cache that reference *other* tables
 
-	tableName string // defines the name of the table based off the struct name
+	// Audit writes an AuditEntry of each Insert, Update, Delete, & Restore to Config.AuditTable; see audit.go
+	Audit bool
+
+	// VersionField is the json field of an integer column (e.g. `version`) used for optimistic locking; see version.go
+	VersionField string
+
+	// SoftDeleteField is the json field of a time column (e.g. `deleted_at`) that's set instead of deleting the row; see softdelete.go
+	SoftDeleteField string
+
+	// hooks called by Storage & Tx with a pointer to the Struct; see HookFunc. A Tx's after hooks are only called once it's committed
+	BeforeInsert HookFunc // e.g. set defaults or validate; an error aborts the insert
+	AfterInsert  HookFunc // e.g. emit a domain event
+	BeforeUpdate HookFunc
+	AfterUpdate  HookFunc
+	AfterSelect  HookFunc // called on each row returned by Select & SelectAll whether it's from the cache or the db
+
+	pkFields      []string     // PrimaryKeyFields or just PrimaryKeyField
+	tableName     string       // defines the name of the table based off the struct name
+	structType    reflect.Type // the type of the Struct (not a pointer) that rows are scanned into
+	updateQuery   string       // the UpdateQuery with the VersionField's check & increment (if there is one)
+	updateColumns []string     // columns set by the updateQuery e.g. `update leads set notes=:notes` is []string{"notes"}
+	lockQuery     string       // the primary query FOR UPDATE if the table has Audit set; see validateAudit
 }
 
 type SelectOptions struct {
@@ -266,7 +381,10 @@ type SelectOptions struct {
 
 	cacheLimit int32 // the limit that is used for the cache
 
-	FetchAllData bool // FetchAll determines if you return all data or just a list of int32's
+	FetchAllData bool // FetchAll determines if you return all data or just the rows with their primary keys set
+
+	skipPageCache bool // don't read the cached page (i.e. the results of this offset & limit); used to refresh it
+	filled        bool // the list was just filled from the db so reading it isn't a cache hit
 }
 
 func (s *SelectOptions) validateAndParse() error {
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+stubDriver is a database/sql driver so Storage can be tested & benchmarked without a db. What the queries of a connection
+return is stubbed by its dsn (see stubConn) and can be changed while the connection is being used. Committing a tx runs the
+query "commit" so a stubFunc can fail it.
+*/
+type stubDriver struct{}
+
+// stubFunc returns the columns & rows of a query run against a stubbed connection
+type stubFunc func(query string, args []driver.Value) (columns []string, rows [][]driver.Value, err error)
+
+var stubs sync.Map // dsn -> stubFunc
+
+func init() {
+	sql.Register("storage_stub", stubDriver{})
+}
+
+// stubConn returns a connection whose queries are answered by fn until it's stubbed again with the same name
+func stubConn(tb testing.TB, name string, fn stubFunc) *sqlx.DB {
+	stubQuery(name, fn)
+	conn, err := sqlx.Open("storage_stub", name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		conn.Close()
+		stubs.Delete(name)
+	})
+	return conn
+}
+
+// stubQuery changes what the queries of the connections named name return
+func stubQuery(name string, fn stubFunc) {
+	stubs.Store(name, fn)
+}
+
+/*
+stubRow is a stubFunc where every query returns one row of values with the columns a, b, c, etc. A nil value is a NULL and
+no values at all is an error
+*/
+func stubRow(values ...driver.Value) stubFunc {
+	return func(string, []driver.Value) ([]string, [][]driver.Value, error) {
+		if len(values) == 0 {
+			return nil, nil, errors.New("stubbed to fail")
+		}
+
+		columns := make([]string, len(values))
+		for i := range columns {
+			columns[i] = string(rune('a' + i))
+		}
+		return columns, [][]driver.Value{values}, nil
+	}
+}
+
+func (stubDriver) Open(dsn string) (driver.Conn, error) {
+	return stubDriverConn(dsn), nil
+}
+
+type stubDriverConn string
+
+func (c stubDriverConn) Prepare(query string) (driver.Stmt, error) {
+	return stubStmt{dsn: string(c), query: query}, nil
+}
+func (stubDriverConn) Close() error                { return nil }
+func (c stubDriverConn) Begin() (driver.Tx, error) { return stubTx(c), nil }
+
+type stubTx string
+
+func (t stubTx) Commit() error {
+	_, _, err := stubRun(string(t), "commit", nil)
+	return err
+}
+func (stubTx) Rollback() error { return nil }
+
+type stubStmt struct {
+	dsn   string
+	query string
+}
+
+func (stubStmt) Close() error                                    { return nil }
+func (stubStmt) NumInput() int                                   { return -1 }
+func (stubStmt) Exec(args []driver.Value) (driver.Result, error) { return nil, driver.ErrSkip }
+func (s stubStmt) Query(args []driver.Value) (driver.Rows, error) {
+	columns, rows, err := stubRun(s.dsn, s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &stubResult{columns: columns, rows: rows}, nil
+}
+
+// stubRun runs a query with the stubFunc of the dsn
+func stubRun(dsn string, query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+	fn, ok := stubs.Load(dsn)
+	if !ok {
+		return nil, nil, errors.New("nothing is stubbed for " + dsn)
+	}
+	return fn.(stubFunc)(query, args)
+}
+
+type stubResult struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *stubResult) Columns() []string { return r.columns }
+func (*stubResult) Close() error        { return nil }
+func (r *stubResult) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// stubRedis returns a cluster client of a single node in memory
+func stubRedis(tb testing.TB) (*redis.ClusterClient, *miniredis.Miniredis) {
+	m, err := miniredis.Run()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		ClusterSlots: func(ctx context.Context) ([]redis.ClusterSlot, error) {
+			return []redis.ClusterSlot{{Start: 0, End: 16383, Nodes: []redis.ClusterNode{{Addr: m.Addr()}}}}, nil
+		},
+	})
+	tb.Cleanup(func() {
+		client.Close()
+		m.Close()
+	})
+	return client, m
+}
+
+// stubConfig returns the Config of a Storage of tables with redis in memory & a db whose queries are answered by fn
+func stubConfig(tb testing.TB, fn stubFunc, tables ...*Table) (*Config, *miniredis.Miniredis) {
+	client, m := stubRedis(tb)
+	conn := stubConn(tb, tb.Name(), fn)
+
+	return &Config{
+		ReadOnlyDbConn:  conn,
+		WriteOnlyDbConn: conn,
+		Redis:           client,
+		ServiceName:     "test",
+		Tables:          tables,
+	}, m
+}
+
+// stubStorage returns a Storage of tables with redis in memory & a db whose queries are answered by fn
+func stubStorage(tb testing.TB, fn stubFunc, tables ...*Table) (Storage, *miniredis.Miniredis) {
+	conf, m := stubConfig(tb, fn, tables...)
+	s, err := New(conf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { s.Close() })
+	return s, m
+}
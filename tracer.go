@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+	Tracer starts the spans around the library's cache & db operations (Config.Tracer) so a slow call can be broken down into
+	its Redis & Postgres parts. The span has to be in the returned ctx so the spans started with it are its children.
+	See the otel package for an OpenTelemetry Tracer
+*/
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Field) (context.Context, Span)
+}
+
+// Span is an operation started by a Tracer
+type Span interface {
+	SetAttributes(attrs ...Field)
+	RecordError(err error)
+	End()
+}
+
+// NopTracer doesn't trace anything; it's the default Config.Tracer
+type NopTracer struct{}
+
+func (NopTracer) Start(ctx context.Context, name string, attrs ...Field) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(attrs ...Field) {}
+func (nopSpan) RecordError(err error)        {}
+func (nopSpan) End()                         {}
+
+// the attributes the library sets on its spans (along with FieldService, FieldTable, FieldQuery & FieldCacheKey)
+const (
+	AttributeDBStatement = "db.statement"
+	AttributeRows        = "rows"
+)
+
+// tracerKey is the ctx key of the Tracer of the call
+type tracerKey struct{}
+
+func withTracer(ctx context.Context, tracer Tracer) context.Context {
+	if tracer == nil {
+		tracer = NopTracer{}
+	}
+	return context.WithValue(ctx, tracerKey{}, tracer)
+}
+
+/*
+	startSpan starts a span with the Tracer of the call. The service, table & query the ctx is tagged with (see withQuery) are
+	added to attrs
+*/
+func startSpan(ctx context.Context, name string, attrs ...Field) (context.Context, Span) {
+	tracer, ok := ctx.Value(tracerKey{}).(Tracer)
+	if !ok {
+		return ctx, nopSpan{}
+	}
+
+	if o, ok := ctx.Value(observerKey{}).(*observation); ok {
+		attrs = append(attrs, Field{Key: FieldService, Value: o.tags.Service})
+		if o.tags.Table != "" {
+			attrs = append(attrs, Field{Key: FieldTable, Value: o.tags.Table})
+		}
+		if o.tags.Query != "" {
+			attrs = append(attrs, Field{Key: FieldQuery, Value: o.tags.Query})
+		}
+	}
+	return tracer.Start(ctx, name, attrs...)
+}
+
+// endSpan records err (unless it's a miss i.e. redis.Nil or sql.ErrNoRows) on span & ends it
+func endSpan(span Span, err error) {
+	if err != nil && err != redis.Nil && err != sql.ErrNoRows {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+/*
+	startCall starts a public call named name (of queryName if it's a select): ctx gets the call's logger, observer & tracer and
+	the call's span is started. end ends the span & observes the call's error; it returns err so it can wrap the call's return
+*/
+func (s *storage) startCall(ctx context.Context, name string, queryName string) (context.Context, func(err error) error) {
+	ctx = s.withContext(ctx)
+
+	attrs := []Field{}
+	if queryName != "" {
+		attrs = append(attrs, Field{Key: FieldQuery, Value: queryName})
+	}
+	ctx, span := startSpan(ctx, "storage."+name, attrs...)
+
+	return ctx, func(err error) error {
+		endSpan(span, s.observeErr(ctx, queryName, err))
+		return err
+	}
+}
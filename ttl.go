@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// ttlPolicy is the bounds of every query's CacheTTL from the Config
+type ttlPolicy struct {
+	min           int // seconds; 0 = no minimum
+	max           int // seconds; 0 = no maximum
+	allowNoExpire bool
+}
+
+// validate makes sure the policy makes sense & the default TTL is within it
+func (p ttlPolicy) validate(defaultTTL int) error {
+	if p.min < 0 || p.max < 0 {
+		return fmt.Errorf("MinTTL (%d) & MaxTTL (%d) cannot be negative", p.min, p.max)
+	}
+	if p.max != 0 && p.min > p.max {
+		return fmt.Errorf("MinTTL (%d) cannot be greater than MaxTTL (%d)", p.min, p.max)
+	}
+	if defaultTTL < 0 {
+		return fmt.Errorf("DefaultTTL (%d) cannot be negative; set a query's CacheTTL to -1 to never expire it", defaultTTL)
+	}
+	if !p.allows(defaultTTL) {
+		return fmt.Errorf("DefaultTTL (%d) must be between MinTTL (%d) & MaxTTL (%d)", defaultTTL, p.min, p.max)
+	}
+	return nil
+}
+
+func (p ttlPolicy) allows(ttl int) bool {
+	if ttl == -1 {
+		return p.allowNoExpire
+	}
+	return ttl >= p.min && (p.max == 0 || ttl <= p.max)
+}
+
+var nullTimeType = reflect.TypeOf(sql.NullTime{})
+
+// validateTTL makes sure the query's CacheTTL (after it's defaulted) is allowed by the policy & the TTLField is a time column
+func (q *Query) validateTTL(policy ttlPolicy, objMap map[string]interface{}) error {
+	if q.CacheTTL < -1 {
+		return fmt.Errorf("query %s: CacheTTL %d must be -1 (never expire), 0 (the default), or the seconds to cache for", q.Name, q.CacheTTL)
+	}
+	if q.CacheTTL == -1 && !policy.allowNoExpire {
+		return fmt.Errorf("query %s: CacheTTL of -1 caches forever; set Config.AllowNoExpire to allow it", q.Name)
+	}
+	if !policy.allows(q.CacheTTL) {
+		return fmt.Errorf("query %s: CacheTTL %d must be between MinTTL (%d) & MaxTTL (%d)", q.Name, q.CacheTTL, policy.min, policy.max)
+	}
+
+	q.maxTTL = time.Duration(policy.max) * time.Second
+
+	err := q.validateSoftTTL()
+	if err != nil {
+		return err
+	}
+
+	if q.TTLField == "" {
+		return nil
+	}
+
+	// the TTLField is the expiration of a row so it's only for keys that are a single row
+	if q.cacheDataStructure != CacheDataStructureStruct && q.cacheDataStructure != CacheDataStructureHash {
+		return fmt.Errorf("query %s: TTLField can only be used with CacheSet or CacheHSet", q.Name)
+	}
+
+	column, ok := objMap[q.TTLField]
+	if !ok {
+		return fmt.Errorf("query %s: TTLField %s is not a json field of the table's struct", q.Name, q.TTLField)
+	}
+	t := reflect.TypeOf(column)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t != timeType && t != nullTimeType {
+		return fmt.Errorf("query %s: TTLField %s must be a time.Time, *time.Time, or sql.NullTime; is %T", q.Name, q.TTLField, column)
+	}
+	return nil
+}
+
+// validateSoftTTL makes sure the SoftTTL is for a query that's read from the cache & is shorter than the CacheTTL (the hard TTL)
+func (q *Query) validateSoftTTL() error {
+	if q.SoftTTL < 0 {
+		return fmt.Errorf("query %s: SoftTTL %d cannot be negative", q.Name, q.SoftTTL)
+	}
+	if q.SoftTTL == 0 {
+		return nil
+	}
+
+	switch q.cacheDataStructure {
+	case CacheDataStructureStruct, CacheDataStructureHash, CacheDataStructureList:
+	default:
+		return fmt.Errorf("query %s: SoftTTL can only be used with CacheSet, CacheHSet, or lists", q.Name)
+	}
+	if q.SelectAction == CacheNoAction || q.Bucket != BucketNone {
+		return fmt.Errorf("query %s: SoftTTL can only be used with queries that are cached on select", q.Name)
+	}
+	if q.CacheTTL != -1 && q.SoftTTL >= q.CacheTTL {
+		return fmt.Errorf("query %s: SoftTTL %d must be less than the CacheTTL %d", q.Name, q.SoftTTL, q.CacheTTL)
+	}
+	return nil
+}
+
+// ttl is the query's CacheTTL as a duration; -1 is cached forever
+func (q *Query) ttl() time.Duration {
+	return time.Duration(q.CacheTTL) * time.Second
+}
+
+/*
+	rowTTL returns how long the row in objMap should be cached for. With a TTLField it's until the row's TTLField (but no longer
+	than the MaxTTL) and if the TTLField is NULL then it's the CacheTTL. ok is false if the row has already expired so it
+	shouldn't be cached at all
+*/
+func (q *Query) rowTTL(objMap map[string]interface{}) (ttl time.Duration, ok bool) {
+	if q.TTLField == "" {
+		return q.ttl(), true
+	}
+
+	expiresAt, isTime := orderedValue(objMap[q.TTLField]).(time.Time)
+	if !isTime {
+		return q.ttl(), true
+	}
+
+	ttl = time.Until(expiresAt)
+	if ttl < time.Millisecond {
+		// redis expires in milliseconds at the smallest
+		return 0, false
+	}
+	if q.maxTTL > 0 && ttl > q.maxTTL {
+		ttl = q.maxTTL
+	}
+	return ttl, true
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestTTLPolicy(t *testing.T) {
+	cases := []struct {
+		name       string
+		policy     ttlPolicy
+		defaultTTL int
+		err        bool
+	}{
+		{name: "no bounds", policy: ttlPolicy{}, defaultTTL: 60},
+		{name: "within", policy: ttlPolicy{min: 60, max: 3600}, defaultTTL: 600},
+		{name: "no max", policy: ttlPolicy{min: 60}, defaultTTL: 1 << 30},
+		{name: "negative", policy: ttlPolicy{min: -1}, defaultTTL: 60, err: true},
+		{name: "min over max", policy: ttlPolicy{min: 3600, max: 60}, defaultTTL: 600, err: true},
+		{name: "default under min", policy: ttlPolicy{min: 60, max: 3600}, defaultTTL: 30, err: true},
+		{name: "default over max", policy: ttlPolicy{min: 60, max: 3600}, defaultTTL: 7200, err: true},
+		{name: "negative default", policy: ttlPolicy{allowNoExpire: true}, defaultTTL: -1, err: true},
+	}
+
+	for _, c := range cases {
+		err := c.policy.validate(c.defaultTTL)
+		if c.err && err == nil {
+			t.Errorf("%s: want an error", c.name)
+		}
+		if !c.err && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+type ttlInvite struct {
+	InviteID  int64        `json:"invite_id"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	EndsAt    *time.Time   `json:"ends_at"`
+	ClosedAt  sql.NullTime `json:"closed_at"`
+	Code      string       `json:"code"`
+}
+
+func TestValidateTTL(t *testing.T) {
+	objMap, err := structToMap(&ttlInvite{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := ttlPolicy{min: 60, max: 3600}
+
+	cases := []struct {
+		name   string
+		q      *Query
+		policy ttlPolicy
+		err    bool
+	}{
+		{name: "within", q: &Query{CacheTTL: 600}, policy: policy},
+		{name: "under min", q: &Query{CacheTTL: 30}, policy: policy, err: true},
+		{name: "over max", q: &Query{CacheTTL: 7200}, policy: policy, err: true},
+		{name: "never expire", q: &Query{CacheTTL: -1}, policy: ttlPolicy{allowNoExpire: true}},
+		{name: "never expire not allowed", q: &Query{CacheTTL: -1}, policy: policy, err: true},
+		{name: "under -1", q: &Query{CacheTTL: -2}, policy: ttlPolicy{allowNoExpire: true}, err: true},
+		{name: "time field", q: &Query{CacheTTL: 600, TTLField: "expires_at", cacheDataStructure: CacheDataStructureStruct}, policy: policy},
+		{name: "time pointer field", q: &Query{CacheTTL: 600, TTLField: "ends_at", cacheDataStructure: CacheDataStructureHash}, policy: policy},
+		{name: "null time field", q: &Query{CacheTTL: 600, TTLField: "closed_at", cacheDataStructure: CacheDataStructureStruct}, policy: policy},
+		{name: "not a time field", q: &Query{CacheTTL: 600, TTLField: "code", cacheDataStructure: CacheDataStructureStruct}, policy: policy, err: true},
+		{name: "not a field", q: &Query{CacheTTL: 600, TTLField: "nope", cacheDataStructure: CacheDataStructureStruct}, policy: policy, err: true},
+		{name: "list with a time field", q: &Query{CacheTTL: 600, TTLField: "expires_at", cacheDataStructure: CacheDataStructureList}, policy: policy, err: true},
+	}
+
+	for _, c := range cases {
+		err := c.q.validateTTL(c.policy, objMap)
+		if c.err && err == nil {
+			t.Errorf("%s: want an error", c.name)
+		}
+		if !c.err && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestRowTTL(t *testing.T) {
+	in := func(d time.Duration) time.Time {
+		return time.Now().Add(d)
+	}
+	inPtr := func(d time.Duration) *time.Time {
+		at := in(d)
+		return &at
+	}
+
+	q := &Query{CacheTTL: 600, TTLField: "ends_at", maxTTL: time.Hour}
+
+	cases := []struct {
+		name     string
+		endsAt   interface{}
+		min, max time.Duration
+		ok       bool
+	}{
+		{name: "until the field", endsAt: in(10 * time.Minute), min: 9 * time.Minute, max: 10 * time.Minute, ok: true},
+		{name: "pointer", endsAt: inPtr(10 * time.Minute), min: 9 * time.Minute, max: 10 * time.Minute, ok: true},
+		{name: "null time", endsAt: sql.NullTime{Time: in(10 * time.Minute), Valid: true}, min: 9 * time.Minute, max: 10 * time.Minute, ok: true},
+		{name: "clamped to the max", endsAt: in(48 * time.Hour), min: time.Hour, max: time.Hour, ok: true},
+		{name: "NULL is the CacheTTL", endsAt: (*time.Time)(nil), min: 10 * time.Minute, max: 10 * time.Minute, ok: true},
+		{name: "invalid null time is the CacheTTL", endsAt: sql.NullTime{}, min: 10 * time.Minute, max: 10 * time.Minute, ok: true},
+		{name: "expired", endsAt: in(-time.Minute)},
+		{name: "expires now", endsAt: in(0)},
+	}
+
+	for _, c := range cases {
+		ttl, ok := q.rowTTL(map[string]interface{}{"ends_at": c.endsAt})
+		if ok != c.ok {
+			t.Errorf("%s: ok = %v, want %v", c.name, ok, c.ok)
+			continue
+		}
+		if ok && (ttl < c.min || ttl > c.max) {
+			t.Errorf("%s: rowTTL = %v, want between %v & %v", c.name, ttl, c.min, c.max)
+		}
+	}
+
+	// no max is only bounded by the field
+	unbounded := &Query{CacheTTL: 600, TTLField: "ends_at"}
+	if ttl, ok := unbounded.rowTTL(map[string]interface{}{"ends_at": in(48 * time.Hour)}); !ok || ttl < 47*time.Hour {
+		t.Errorf("rowTTL without a max = %v, %v", ttl, ok)
+	}
+
+	// no TTLField is the CacheTTL
+	if ttl, ok := (&Query{CacheTTL: 600}).rowTTL(map[string]interface{}{}); !ok || ttl != 10*time.Minute {
+		t.Errorf("rowTTL without a TTLField = %v, %v", ttl, ok)
+	}
+}
+
+func TestDefaultTTL(t *testing.T) {
+	ctx := context.Background()
+	conf, m := stubConfig(t, benchLeads(3), benchLeadsTable())
+	conf.DefaultTTL = 120
+
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Select(ctx, &benchLead{LeadID: 1}, "LeadsGetByID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var leads []*benchLead
+	err = s.SelectAll(ctx, &benchLead{UserID: 2}, &leads, "LeadsByUser", &SelectOptions{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := m.Keys()
+	if len(keys) < 2 {
+		t.Fatalf("keys = %v; want the row & the list", keys)
+	}
+	for _, key := range keys {
+		if ttl := m.TTL(key); ttl != 2*time.Minute {
+			t.Errorf("TTL of %s = %v, want the DefaultTTL", key, ttl)
+		}
+	}
+}
+
+func TestValidateSoftTTL(t *testing.T) {
+	cases := []struct {
+		name string
+		q    *Query
+		err  bool
+	}{
+		{name: "off", q: &Query{}},
+		{name: "struct", q: &Query{SoftTTL: 60, CacheTTL: 600, SelectAction: CacheSet, cacheDataStructure: CacheDataStructureStruct}},
+		{name: "list", q: &Query{SoftTTL: 60, CacheTTL: 600, SelectAction: CacheRPush, cacheDataStructure: CacheDataStructureList}},
+		{name: "forever", q: &Query{SoftTTL: 60, CacheTTL: -1, SelectAction: CacheSet, cacheDataStructure: CacheDataStructureStruct}},
+		{name: "negative", q: &Query{SoftTTL: -1}, err: true},
+		{name: "counter", q: &Query{SoftTTL: 60, CacheTTL: 600, SelectAction: CacheSet, cacheDataStructure: CacheDataStructureCounter}, err: true},
+		{name: "not cached on select", q: &Query{SoftTTL: 60, CacheTTL: 600, SelectAction: CacheNoAction, cacheDataStructure: CacheDataStructureStruct}, err: true},
+		{name: "bucket", q: &Query{SoftTTL: 60, CacheTTL: 600, SelectAction: CacheSet, cacheDataStructure: CacheDataStructureStruct, Bucket: BucketHour}, err: true},
+		{name: "not less than the CacheTTL", q: &Query{SoftTTL: 600, CacheTTL: 600, SelectAction: CacheSet, cacheDataStructure: CacheDataStructureStruct}, err: true},
+	}
+
+	for _, c := range cases {
+		err := c.q.validateSoftTTL()
+		if c.err && err == nil {
+			t.Errorf("%s: want an error", c.name)
+		}
+		if !c.err && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package storage
 import (
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -17,7 +19,48 @@ func (q *Query) validate() error {
 		return err
 	}
 
-	return q.validateAndParseCacheDataStructure()
+	err = q.validateAndParseCacheDataStructure()
+	if err != nil {
+		return err
+	}
+
+	return q.validateBucket()
+}
+
+// validateBucket validates the fields of a bucket query that don't depend on other queries
+func (q *Query) validateBucket() error {
+	if q.Bucket == BucketNone {
+		if q.BucketField != "" || q.RollupOf != "" || q.Aggregate != nil {
+			return fmt.Errorf("query %s: BucketField, RollupOf, and Aggregate require a Bucket", q.Name)
+		}
+		return nil
+	}
+
+	if q.Bucket < BucketMinute || q.Bucket > BucketMonth {
+		return fmt.Errorf("query %s: unknown Bucket %d", q.Name, q.Bucket)
+	}
+
+	if q.cacheDataStructure != CacheDataStructureDefault && q.cacheDataStructure != CacheDataStructureStruct {
+		return fmt.Errorf("query %s: bucket queries can only be cached with CacheSet", q.Name)
+	}
+
+	if q.RollupOf == "" {
+		if q.BucketField == "" || q.Query == "" {
+			return fmt.Errorf("query %s: a leaf bucket query must have a BucketField & Query", q.Name)
+		}
+		if q.Aggregate != nil {
+			return fmt.Errorf("query %s: Aggregate can only be set with RollupOf", q.Name)
+		}
+		return nil
+	}
+
+	if q.Aggregate == nil {
+		return fmt.Errorf("query %s: Aggregate must be set with RollupOf", q.Name)
+	}
+	if q.BucketField != "" || q.Query != "" {
+		return fmt.Errorf("query %s: a rollup is built from %s so it can't have a BucketField or Query", q.Name, q.RollupOf)
+	}
+	return nil
 }
 
 func (q *Query) parseCacheListKey() {
@@ -49,6 +92,10 @@ func (q *Query) validateAndParseCacheDataStructure() error {
 	switch q.InsertAction {
 	case CacheLPush, CacheRPush:
 		m["insert"] = CacheDataStructureList
+	case CacheHSet:
+		m["insert"] = CacheDataStructureHash
+	case CacheIncr, CacheDecr:
+		m["insert"] = CacheDataStructureCounter
 	case CacheNoAction, CacheDel:
 		delete(m, "insert")
 	}
@@ -58,19 +105,47 @@ func (q *Query) validateAndParseCacheDataStructure() error {
 	switch q.UpdateAction {
 	case CacheLPush, CacheRPush:
 		m["update"] = CacheDataStructureList
+	case CacheHSet:
+		m["update"] = CacheDataStructureHash
+	case CacheIncr, CacheDecr:
+		m["update"] = CacheDataStructureCounter
 	case CacheNoAction, CacheDel:
 		delete(m, "update")
 	}
 
+	m["delete"] = CacheDataStructureCounter
+	// deletes can only decrement a counter or delete the key
+	switch q.DeleteAction {
+	case CacheIncr, CacheDecr:
+	case CacheDefault, CacheNoAction, CacheDel:
+		delete(m, "delete")
+	default:
+		return errors.New("DeleteAction can only be CacheDel, CacheNoAction, CacheIncr, or CacheDecr")
+	}
+
 	m["select"] = CacheDataStructureStruct
 	// check to see if it's a list
 	switch q.SelectAction {
 	case CacheLPush, CacheRPush:
 		m["select"] = CacheDataStructureList
+	case CacheHSet:
+		m["select"] = CacheDataStructureHash
+	case CacheIncr, CacheDecr:
+		return errors.New("SelectAction cannot be CacheIncr or CacheDecr; use CacheSet to fill a counter")
 	case CacheNoAction, CacheDel:
 		delete(m, "select")
 	}
 
+	// a counter is filled on select with a CacheSet of the count
+	if _, ok := m["select"]; ok && q.SelectAction == CacheSet {
+		for _, v := range m {
+			if v == CacheDataStructureCounter {
+				m["select"] = CacheDataStructureCounter
+				break
+			}
+		}
+	}
+
 	if len(m) == 0 {
 		// everything is CacheNoAction
 		return nil
@@ -104,47 +179,158 @@ func (q *Query) validateAndParseCacheFields() error {
 	fields := []cacheKeyField{}
 
 	for _, key := range keys {
+		field, ok, err := parseCacheKeyField(key)
+		if err != nil {
+			return fmt.Errorf("query %s: CacheKey %s: invalid segment `%s`: %s", q.Name, q.CacheKey, key, err)
+		}
+		if !ok {
+			// segment doens't have a placeholder value or a predicate; continue
+			continue
+		}
 
-		if strings.Contains(key, `!=%v`) {
-			return fmt.Errorf("CacheKey %s with `!=` operator must not end with `%v` but the value to not match agains", q.CacheKey)
+		if !field.isParameter() {
+			q.cacheKeyContainsValueOperator = true
 		}
 
-		if !strings.Contains(key, `=%v`) && !strings.Contains(key, `!=`) {
-			// field doens't have a placeholder value; continue
+		// append it
+		fields = append(fields, field)
+	}
+
+	q.cacheKeyFields = fields
+
+	return nil
+}
+
+// validateAndParseCacheKeyValues converts the values of the CacheKey's predicates (e.g. `5` in `status!=5`) to their column's type
+func (q *Query) validateAndParseCacheKeyValues(objMap map[string]interface{}) error {
+	for i, field := range q.cacheKeyFields {
+		if field.isParameter() {
 			continue
 		}
 
-		field := cacheKeyField{}
+		column, ok := objMap[field.columnName]
+		if !ok {
+			return fmt.Errorf("query %s: CacheKey %s: invalid segment `%s`: %s is not a column of the table", q.Name, q.CacheKey, field.segment, field.columnName)
+		}
 
-		parts := strings.Split(key, "!=")
-		if len(parts) == 2 {
-			field.columnName = parts[0]
-			field.operator = operatorNotEqual
-			field.value = parts[1]
+		err := q.cacheKeyFields[i].parseValues(column)
+		if err != nil {
+			return fmt.Errorf("query %s: CacheKey %s: invalid segment `%s`: %s", q.Name, q.CacheKey, field.segment, err)
+		}
+	}
+	return nil
+}
 
-			// append it
-			fields = append(fields, field)
+// validateAndParseHashFields makes sure the CacheFields are columns of the table & defaults them to every column
+func (q *Query) validateAndParseHashFields(objMap map[string]interface{}) error {
+	if q.cacheDataStructure != CacheDataStructureHash {
+		if len(q.CacheFields) != 0 {
+			return fmt.Errorf("query %s: CacheFields can only be used with CacheHSet", q.Name)
+		}
+		return nil
+	}
 
-			// set the operator
-			q.cacheKeyContainsNotEqualsOperator = true
+	if len(q.CacheFields) == 0 {
+		fields := []string{}
+		for column := range objMap {
+			if strings.HasPrefix(column, "_") {
+				// private keys e.g. objMapStructNameKey
+				continue
+			}
+			fields = append(fields, column)
+		}
+		sort.Strings(fields)
 
-			continue
+		q.cacheFields = fields
+		return nil
+	}
+
+	for _, field := range q.CacheFields {
+		if _, ok := objMap[field]; !ok {
+			return fmt.Errorf("query %s: CacheFields has %s which is not a field of the table's struct", q.Name, field)
 		}
+	}
+
+	q.cacheFields = q.CacheFields
+	return nil
+}
+
+// validateAndParseEncoder sets the query's encoder from the table's codec & the query's compression
+func (q *Query) validateAndParseEncoder(codec Codec, stats *compressionStats) error {
+	if codec != nil && (codec.Marker() == 0 || codec.Marker() >= compressorMarkerMin) {
+		return fmt.Errorf("query %s: codec marker %#x must be between 0x01 and 0x0f", q.Name, codec.Marker())
+	}
+
+	if q.CompressAbove < 0 {
+		return fmt.Errorf("query %s: CompressAbove must be >= 0", q.Name)
+	}
+
+	if q.Compressor == nil {
+		q.Compressor = GzipCompressor
+	}
+
+	if !isCompressorMarker(q.Compressor.Marker()) {
+		return fmt.Errorf("query %s: compressor marker %#x must be between 0x10 and 0x1f", q.Name, q.Compressor.Marker())
+	}
+
+	switch {
+	case codec != nil && isProtoCodec(codec) && q.cacheDataStructure == CacheDataStructureHash:
+		// a proto codec can only store the rows of the table
+		return fmt.Errorf("query %s: CacheHSet cannot be used with a proto codec", q.Name)
 
-		parts = strings.Split(key, "=")
-		if len(parts) == 2 {
-			field.columnName = parts[0]
-			field.operator = operatorEqual
+	case codec != nil && isProtoCodec(codec) && q.Bucket != BucketNone:
+		// buckets are aggregates, not rows of the table, so they're stored as json
+		q.encoder = newEncoder(JSONCodec)
 
-			// append it
-			fields = append(fields, field)
+	default:
+		q.encoder = newEncoder(codec)
+	}
+
+	if q.cacheDataStructure != CacheDataStructureHash {
+		// hash fields are small, individual columns so they aren't compressed
+		q.encoder.compressor = q.Compressor
+		q.encoder.compressAbove = q.CompressAbove
+		q.encoder.stats = stats
+	}
+
+	return nil
+}
+
+// validateCacheKeyInWhere makes sure the CacheKey's columns are in the query's WHERE e.g. `user_id=%v` needs `where user_id=:user_id`
+func (q *Query) validateCacheKeyInWhere() error {
+	where := ""
+	if m := whereClauseRegex.FindStringSubmatch(q.Query); m != nil {
+		where = m[1]
+	}
+
+	for _, field := range q.cacheKeyFields {
+		if field.isParameter() {
+			// the value in the key must be the value that's queried
+			if !regexp.MustCompile(`:` + regexp.QuoteMeta(field.columnName) + `\b`).MatchString(where) {
+				return fmt.Errorf("query %s: CacheKey %s: %s must be in the query's WHERE as :%s", q.Name, q.CacheKey, field.columnName, field.columnName)
+			}
 			continue
 		}
+
+		if !regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(field.columnName) + `\b`).MatchString(where) {
+			return fmt.Errorf("query %s: CacheKey %s: `%s` must be in the query's WHERE", q.Name, q.CacheKey, field.segment)
+		}
 	}
+	return nil
+}
 
-	q.cacheKeyFields = fields
+// keyFormats returns the formats of every key the query uses e.g. `user_id=%v` & `user_id=%v|metadata` for a list
+func (q *Query) keyFormats() []string {
+	if q.Bucket != BucketNone {
+		// bucket queries only use the key of each bucket
+		return []string{q.CacheKey + fmt.Sprintf(cacheKeyBucketModifier, q.Bucket, "%v")}
+	}
 
-	return nil
+	formats := []string{q.CacheKey}
+	if q.cacheDataStructure == CacheDataStructureList {
+		formats = append(formats, q.cacheListKey, q.cacheListMetadataKey)
+	}
+	return formats
 }
 
 func (q *Query) validateName() error {
@@ -160,6 +346,12 @@ func (q *Query) parseTTL(defaultTTL int) {
 	}
 }
 
+func (q *Query) parseDeleteAction() {
+	if q.DeleteAction == CacheDefault {
+		q.DeleteAction = CacheDel
+	}
+}
+
 func (q *Query) parseLimitOffsetQuery() {
 	q.queryLimitOffset = q.Query + " LIMIT :limit OFFSET :offset"
 }
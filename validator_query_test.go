@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestValidateAndParseCacheDataStructureHash(t *testing.T) {
+	cases := []struct {
+		name                         string
+		insert, update, selectAction CacheAction
+		want                         CacheDataStructure
+		err                          bool
+	}{
+		{name: "all hset", insert: CacheHSet, update: CacheHSet, selectAction: CacheHSet, want: CacheDataStructureHash},
+		{name: "hset select & del writes", insert: CacheDel, update: CacheDel, selectAction: CacheHSet, want: CacheDataStructureHash},
+		{name: "hset select & no action writes", insert: CacheNoAction, update: CacheNoAction, selectAction: CacheHSet, want: CacheDataStructureHash},
+		{name: "hset & set", insert: CacheSet, update: CacheHSet, selectAction: CacheHSet, err: true},
+		{name: "hset & push", insert: CacheRPush, update: CacheDel, selectAction: CacheHSet, err: true},
+	}
+
+	for _, c := range cases {
+		q := &Query{InsertAction: c.insert, UpdateAction: c.update, SelectAction: c.selectAction}
+		err := q.validateAndParseCacheDataStructure()
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: want an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if q.cacheDataStructure != c.want {
+			t.Errorf("%s: cacheDataStructure = %v, want %v", c.name, q.cacheDataStructure, c.want)
+		}
+	}
+}
+
+func TestValidateAndParseHashFields(t *testing.T) {
+	objMap := map[string]interface{}{
+		objMapStructNameKey: "Lead",
+		"lead_id":           int64(1),
+		"notes":             "",
+		"email":             "",
+	}
+
+	cases := []struct {
+		name   string
+		q      *Query
+		want   []string
+		errors bool
+	}{
+		{name: "defaults to every column", q: &Query{cacheDataStructure: CacheDataStructureHash}, want: []string{"email", "lead_id", "notes"}},
+		{name: "whitelist", q: &Query{cacheDataStructure: CacheDataStructureHash, CacheFields: []string{"lead_id", "email"}}, want: []string{"lead_id", "email"}},
+		{name: "not a column", q: &Query{cacheDataStructure: CacheDataStructureHash, CacheFields: []string{"lead_id", "nope"}}, errors: true},
+		{name: "not a hash", q: &Query{cacheDataStructure: CacheDataStructureStruct, CacheFields: []string{"lead_id"}}, errors: true},
+		{name: "not a hash & no fields", q: &Query{cacheDataStructure: CacheDataStructureStruct}},
+	}
+
+	for _, c := range cases {
+		err := c.q.validateAndParseHashFields(objMap)
+		if c.errors {
+			if err == nil {
+				t.Errorf("%s: want an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.q.cacheFields, c.want) {
+			t.Errorf("%s: cacheFields = %v, want %v", c.name, c.q.cacheFields, c.want)
+		}
+	}
+}
+
+func TestUpdatedHashFields(t *testing.T) {
+	q := &Query{cacheFields: []string{"email", "lead_id", "notes"}}
+
+	cases := []struct {
+		columns []string
+		want    []string
+	}{
+		// unknown columns are all of them
+		{columns: nil, want: []string{"email", "lead_id", "notes"}},
+		{columns: []string{"notes"}, want: []string{"notes"}},
+		{columns: []string{"notes", "email", "updated_at"}, want: []string{"email", "notes"}},
+		// nothing that's cached is updated
+		{columns: []string{"updated_at"}, want: []string{}},
+	}
+
+	for _, c := range cases {
+		got := q.updatedHashFields(c.columns)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("updatedHashFields(%v) = %v, want %v", c.columns, got, c.want)
+		}
+	}
+}
+
+func TestValidateAndParseCacheDataStructureCounter(t *testing.T) {
+	cases := []struct {
+		name string
+		q    *Query
+		want CacheDataStructure
+		err  bool
+	}{
+		{name: "incr & decr", q: &Query{InsertAction: CacheIncr, UpdateAction: CacheNoAction, DeleteAction: CacheDecr, SelectAction: CacheSet}, want: CacheDataStructureCounter},
+		{name: "set fills a counter", q: &Query{InsertAction: CacheIncr, UpdateAction: CacheDel, SelectAction: CacheSet}, want: CacheDataStructureCounter},
+		{name: "delete decr only", q: &Query{InsertAction: CacheNoAction, UpdateAction: CacheNoAction, DeleteAction: CacheDecr, SelectAction: CacheSet}, want: CacheDataStructureCounter},
+		{name: "set without a counter is a struct", q: &Query{InsertAction: CacheSet, DeleteAction: CacheDel, SelectAction: CacheSet}, want: CacheDataStructureStruct},
+		{name: "select incr", q: &Query{InsertAction: CacheIncr, SelectAction: CacheIncr}, err: true},
+		{name: "delete push", q: &Query{DeleteAction: CacheRPush, SelectAction: CacheSet}, err: true},
+		{name: "delete set", q: &Query{DeleteAction: CacheSet, SelectAction: CacheSet}, err: true},
+		{name: "incr & push", q: &Query{InsertAction: CacheIncr, UpdateAction: CacheRPush, SelectAction: CacheSet}, err: true},
+		{name: "incr & hset", q: &Query{InsertAction: CacheIncr, SelectAction: CacheHSet}, err: true},
+	}
+
+	for _, c := range cases {
+		err := c.q.validateAndParseCacheDataStructure()
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: want an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if c.q.cacheDataStructure != c.want {
+			t.Errorf("%s: cacheDataStructure = %v, want %v", c.name, c.q.cacheDataStructure, c.want)
+		}
+	}
+}
+
+func TestValidateBucket(t *testing.T) {
+	sum := func(children []map[string]interface{}) (map[string]interface{}, error) { return nil, nil }
+
+	cases := []struct {
+		name string
+		q    *Query
+		err  bool
+	}{
+		{name: "not a bucket", q: &Query{}},
+		{name: "leaf", q: &Query{Bucket: BucketHour, BucketField: "created_at", Query: "select count(*) from leads"}},
+		{name: "rollup", q: &Query{Bucket: BucketDay, RollupOf: "LeadsPerHour", Aggregate: sum}},
+		{name: "bucket field without a bucket", q: &Query{BucketField: "created_at"}, err: true},
+		{name: "rollup without a bucket", q: &Query{RollupOf: "LeadsPerHour", Aggregate: sum}, err: true},
+		{name: "unknown bucket", q: &Query{Bucket: BucketMonth + 1, BucketField: "created_at", Query: "select 1"}, err: true},
+		{name: "list", q: &Query{Bucket: BucketHour, BucketField: "created_at", Query: "select 1", cacheDataStructure: CacheDataStructureList}, err: true},
+		{name: "leaf without a bucket field", q: &Query{Bucket: BucketHour, Query: "select 1"}, err: true},
+		{name: "leaf without a query", q: &Query{Bucket: BucketHour, BucketField: "created_at"}, err: true},
+		{name: "leaf with an aggregate", q: &Query{Bucket: BucketHour, BucketField: "created_at", Query: "select 1", Aggregate: sum}, err: true},
+		{name: "rollup without an aggregate", q: &Query{Bucket: BucketDay, RollupOf: "LeadsPerHour"}, err: true},
+		{name: "rollup with a query", q: &Query{Bucket: BucketDay, RollupOf: "LeadsPerHour", Aggregate: sum, Query: "select 1"}, err: true},
+	}
+
+	for _, c := range cases {
+		err := c.q.validateBucket()
+		if c.err && err == nil {
+			t.Errorf("%s: want an error", c.name)
+		}
+		if !c.err && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+type valueMember struct {
+	GroupID int64  `json:"group_id"`
+	UserID  int64  `json:"user_id"`
+	Role    string `json:"role"`
+	Level   int32  `json:"level"`
+	Active  bool   `json:"active"`
+}
+
+func TestCacheKeyValues(t *testing.T) {
+	objMap, err := structToMap(&valueMember{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner := &valueMember{GroupID: 15, UserID: 2, Role: "OWNER", Level: 5, Active: true}
+	member := &valueMember{GroupID: 15, UserID: 3, Role: "MEMBER", Level: 1}
+
+	cases := []struct {
+		key           string
+		name          string
+		owner, member bool
+	}{
+		{key: "group_id=%v|role=OWNER", name: "group_id=15|role=OWNER", owner: true},
+		{key: "group_id=%v|role!=OWNER", name: "group_id=15|role!=OWNER", member: true},
+		{key: "group_id=%v|level=5", name: "group_id=15|level=5", owner: true},
+		{key: "group_id=%v|level!=5", name: "group_id=15|level!=5", member: true},
+		{key: "group_id=%v|active=true", name: "group_id=15|active=true", owner: true},
+		{key: "group_id=%v|active=f", name: "group_id=15|active=f", member: true},
+		{key: "group_id=%v", name: "group_id=15", owner: true, member: true},
+	}
+
+	for _, c := range cases {
+		q := &Query{CacheKey: c.key}
+		err := q.validateAndParseCacheFields()
+		if err == nil {
+			err = q.validateAndParseCacheKeyValues(objMap)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.key, err)
+			continue
+		}
+
+		ownerMap, _ := structToMap(owner)
+		memberMap, _ := structToMap(member)
+		if got := q.getKeyName(ownerMap); got != "|"+c.name {
+			t.Errorf("%s: getKeyName = %s, want |%s", c.key, got, c.name)
+		}
+		if got := q.isValidQuery(context.Background(), ownerMap); got != c.owner {
+			t.Errorf("%s: isValidQuery of the owner = %v, want %v", c.key, got, c.owner)
+		}
+		if got := q.isValidQuery(context.Background(), memberMap); got != c.member {
+			t.Errorf("%s: isValidQuery of the member = %v, want %v", c.key, got, c.member)
+		}
+	}
+
+	for _, key := range []string{"group_id=%v|level=five", "group_id=%v|active=maybe", "group_id=%v|nope=1", "group_id=%v|role=", "group_id=%v|=OWNER", "group_id=%v|role=%d"} {
+		q := &Query{CacheKey: key}
+		err := q.validateAndParseCacheFields()
+		if err == nil {
+			err = q.validateAndParseCacheKeyValues(objMap)
+		}
+		if err == nil {
+			t.Errorf("%s: want an error", key)
+		}
+	}
+}
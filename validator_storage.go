@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"time"
 )
 
 func (s *storage) validate() error {
@@ -15,6 +17,16 @@ func (s *storage) validate() error {
 		return err
 	}
 
+	err = s.validateAndParseRollups()
+	if err != nil {
+		return err
+	}
+
+	err = s.validateAudit()
+	if err != nil {
+		return err
+	}
+
 	return s.validateQueries()
 }
 
@@ -42,6 +54,39 @@ func (s *storage) validatePrimaryQueryStored() error {
 		if !ok || t.PrimaryQueryName != pkStored {
 			return errors.New("CachePrimaryQueryStored must be the primary query of a table in " + q.CacheKey)
 		}
+
+		// the list stores the primary keys of that table
+		if len(t.pkFields) == 0 {
+			return errors.New("CachePrimaryQueryStored must be the primary query of a table with a PrimaryKeyField in " + q.CacheKey)
+		}
+	}
+	return nil
+}
+
+// validateAndParseRollups makes sure each RollupOf is a bucket query of the same table with smaller buckets & maps the children to their rollups
+func (s *storage) validateAndParseRollups() error {
+	for _, q := range s.queries {
+		if q.Bucket == BucketNone {
+			continue
+		}
+
+		if q.RollupOf == "" {
+			if _, ok := s.queryToMap[q.Name][q.BucketField]; !ok {
+				return fmt.Errorf("query %s: BucketField %s is not a field of the table's struct", q.Name, q.BucketField)
+			}
+			continue
+		}
+
+		child, ok := s.queries[q.RollupOf]
+		if !ok || s.queryToTable[q.RollupOf] != s.queryToTable[q.Name] {
+			return fmt.Errorf("query %s: RollupOf %s must be a query of the same table", q.Name, q.RollupOf)
+		}
+
+		if child.Bucket == BucketNone || child.Bucket >= q.Bucket {
+			return fmt.Errorf("query %s: RollupOf %s must have a smaller Bucket than %s", q.Name, q.RollupOf, q.Bucket)
+		}
+
+		s.rollupParents[child.Name] = append(s.rollupParents[child.Name], q)
 	}
 	return nil
 }
@@ -49,20 +94,35 @@ func (s *storage) validatePrimaryQueryStored() error {
 func (s *storage) validateQueries() error {
 
 	for _, q := range s.queries {
-		if q.InsertAction == CacheNoAction && q.UpdateAction == CacheNoAction && q.SelectAction == CacheNoAction {
+		if !q.isCached() {
+			continue
+		}
+
+		if q.RollupOf != "" {
+			// rollups don't have a query of their own
 			continue
 		}
 
-		m := s.queryToMap[q.Name]
+		// a copy so the params aren't left in the table's objMap which the table's other queries share
+		m := make(map[string]interface{}, len(s.queryToMap[q.Name])+4)
+		for k, v := range s.queryToMap[q.Name] {
+			m[k] = v
+		}
 		m["limit"] = 0
 		m["offset"] = 0
 
+		if q.Bucket != BucketNone {
+			m[bucketStartParameter] = time.Time{}
+			m[bucketEndParameter] = time.Time{}
+		}
+
 		explainQuery := fmt.Sprintf("EXPLAIN %s", q.queryLimitOffset)
 
-		_, err := s.db.readConnection.NamedQuery(explainQuery, m)
+		rows, err := s.db.readConn(context.Background()).NamedQuery(explainQuery, namedArgs(m))
 		if err != nil {
 			return fmt.Errorf("error in query: %s. Query: %s", err.Error(), q.queryLimitOffset)
 		}
+		rows.Close()
 
 	}
 
@@ -0,0 +1,55 @@
+package storage
+
+import "testing"
+
+func TestValidateAndParseRollups(t *testing.T) {
+	sum := func(children []map[string]interface{}) (map[string]interface{}, error) { return nil, nil }
+
+	leads, users := &Table{}, &Table{}
+	newStorage := func(queries ...*Query) *storage {
+		s := &storage{
+			queries:       map[string]*Query{},
+			queryToMap:    map[string]map[string]interface{}{},
+			queryToTable:  map[string]*Table{},
+			rollupParents: map[string][]*Query{},
+		}
+		for _, q := range queries {
+			s.queries[q.Name] = q
+			s.queryToMap[q.Name] = map[string]interface{}{"lead_id": nil, "created_at": nil}
+			s.queryToTable[q.Name] = leads
+		}
+		return s
+	}
+	hour := func() *Query {
+		return &Query{Name: "LeadsPerHour", Bucket: BucketHour, BucketField: "created_at"}
+	}
+
+	s := newStorage(hour(), &Query{Name: "LeadsPerDay", Bucket: BucketDay, RollupOf: "LeadsPerHour", Aggregate: sum},
+		&Query{Name: "LeadsPerMonth", Bucket: BucketMonth, RollupOf: "LeadsPerDay", Aggregate: sum}, &Query{Name: "LeadsGetByID"})
+	if err := s.validateAndParseRollups(); err != nil {
+		t.Fatal(err)
+	}
+	if p := s.rollupParents["LeadsPerHour"]; len(p) != 1 || p[0].Name != "LeadsPerDay" {
+		t.Errorf("rollupParents of LeadsPerHour = %v", p)
+	}
+	if p := s.rollupParents["LeadsPerDay"]; len(p) != 1 || p[0].Name != "LeadsPerMonth" {
+		t.Errorf("rollupParents of LeadsPerDay = %v", p)
+	}
+
+	bad := map[string]*storage{
+		"bucket field isn't a column": newStorage(&Query{Name: "LeadsPerHour", Bucket: BucketHour, BucketField: "updated_at"}),
+		"rollup of a missing query":   newStorage(hour(), &Query{Name: "LeadsPerDay", Bucket: BucketDay, RollupOf: "Nope", Aggregate: sum}),
+		"rollup of a bigger bucket":   newStorage(hour(), &Query{Name: "LeadsPerMinute", Bucket: BucketMinute, RollupOf: "LeadsPerHour", Aggregate: sum}),
+		"rollup of the same bucket":   newStorage(hour(), &Query{Name: "LeadsPerHour2", Bucket: BucketHour, RollupOf: "LeadsPerHour", Aggregate: sum}),
+		"rollup of a non bucket":      newStorage(&Query{Name: "LeadsGetByID"}, &Query{Name: "LeadsPerDay", Bucket: BucketDay, RollupOf: "LeadsGetByID", Aggregate: sum}),
+	}
+	other := newStorage(hour(), &Query{Name: "UsersPerDay", Bucket: BucketDay, RollupOf: "LeadsPerHour", Aggregate: sum})
+	other.queryToTable["UsersPerDay"] = users
+	bad["rollup of another table"] = other
+
+	for name, s := range bad {
+		if err := s.validateAndParseRollups(); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+}
@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"database/sql/driver"
 	"errors"
 	"fmt"
 	"reflect"
+	"regexp"
 	"strings"
 )
 
@@ -14,9 +16,9 @@ func (t *Table) validate() error {
 
 	t.parseTableName()
 
-	// you can have no primary key only if you have no insert query
-	if t.PrimaryKeyField == "" && t.InsertQuery != "" {
-		return fmt.Errorf("Table: %s Err: PrimaryKeyField must be set", t.tableName)
+	err := t.validateAndParsePrimaryKey()
+	if err != nil {
+		return err
 	}
 
 	if t.PrimaryQueryName == "" {
@@ -27,7 +29,7 @@ func (t *Table) validate() error {
 		return fmt.Errorf("Table: %s Err: Queries must be set", t.tableName)
 	}
 
-	err := t.validateInsertAndUpdateQueries()
+	err = t.validateInsertAndUpdateQueries()
 	if err != nil {
 		return err
 	}
@@ -37,6 +39,18 @@ func (t *Table) validate() error {
 		return err
 	}
 
+	err = t.validateSoftDelete()
+	if err != nil {
+		return err
+	}
+
+	err = t.validateAndParseVersion()
+	if err != nil {
+		return err
+	}
+
+	t.parseUpdateColumns()
+
 	return t.parseSlicesInQueries()
 }
 
@@ -44,13 +58,36 @@ func (t *Table) parse() {
 	t.parseTableName()
 }
 
+func (t *Table) validateAndParsePrimaryKey() error {
+	if t.PrimaryKeyField != "" && len(t.PrimaryKeyFields) > 0 {
+		return fmt.Errorf("Table: %s Err: set PrimaryKeyField or PrimaryKeyFields, not both", t.tableName)
+	}
+
+	t.pkFields = t.PrimaryKeyFields
+	if t.PrimaryKeyField != "" {
+		t.pkFields = []string{t.PrimaryKeyField}
+	}
+
+	// you can have no primary key only if you have no insert query
+	if len(t.pkFields) == 0 && t.InsertQuery != "" {
+		return fmt.Errorf("Table: %s Err: PrimaryKeyField must be set", t.tableName)
+	}
+	return nil
+}
+
 func (t *Table) validateAndParseObjMap() error {
 	objMap, err := structToMap(t.Struct)
 	if err != nil {
 		return fmt.Errorf("error getting struct map for %s: %s", t.tableName, err)
 	}
 
-	objMap[objMapStructPrimaryKey] = t.PrimaryKeyField
+	for _, field := range t.pkFields {
+		if _, ok := objMap[field]; !ok {
+			return fmt.Errorf("Table: %s Err: primary key field %s is not a column of the struct", t.tableName, field)
+		}
+	}
+
+	objMap[objMapStructPrimaryKey] = t.pkFields
 
 	t.objMap = objMap
 	return nil
@@ -66,14 +103,151 @@ func (t *Table) validateInsertAndUpdateQueries() error {
 	if !strings.HasSuffix(strings.ToLower(t.UpdateQuery), "returning *") && t.UpdateQuery != "" {
 		return errors.New("UpdateQuery must end with `returning *`")
 	}
+
+	// the deleted row is returned so the cache actions have the whole row (e.g. the keys of the lists it's in)
+	if !strings.HasSuffix(strings.ToLower(t.DeleteQuery), "returning *") && t.DeleteQuery != "" {
+		return errors.New("DeleteQuery must end with `returning *`")
+	}
+
+	if !strings.HasSuffix(strings.ToLower(t.RestoreQuery), "returning *") && t.RestoreQuery != "" {
+		return errors.New("RestoreQuery must end with `returning *`")
+	}
+	return nil
+}
+
+var (
+	// updateSetClauseRegex matches the SET clause of an update query
+	updateSetClauseRegex = regexp.MustCompile(`(?is)\bset\b(.*?)\b(?:where|returning)\b`)
+	// updateSetColumnRegex matches the column being assigned in a SET clause e.g. `notes` in `notes=:notes`
+	updateSetColumnRegex = regexp.MustCompile(`(?:^|,)\s*"?(\w+)"?\s*=`)
+)
+
+// parseUpdateColumns takes the updateQuery e.g. `update leads set notes=:notes where lead_id=:lead_id RETURNING *`
+// and parses out the columns that are set e.g. []string{"notes"}
+func (t *Table) parseUpdateColumns() {
+	t.updateColumns = setColumns(t.updateQuery)
+}
+
+// setColumns returns the columns set by the SET clause of an update query; nil if there isn't one
+func setColumns(query string) []string {
+	setClause := updateSetClauseRegex.FindStringSubmatch(query)
+	if setClause == nil {
+		return nil
+	}
+
+	var columns []string
+	for _, match := range updateSetColumnRegex.FindAllStringSubmatch(setClause[1], -1) {
+		columns = append(columns, match[1])
+	}
+	return columns
+}
+
+var (
+	// namedParameterRegex matches the named parameters of a query e.g. `lead_id` in `lead_id=:lead_id` but not casts e.g. `::int`
+	namedParameterRegex = regexp.MustCompile(`(?:^|[^:\w]):(\w+)`)
+	// whereClauseRegex matches everything after the WHERE of a query
+	whereClauseRegex = regexp.MustCompile(`(?is)\bwhere\b(.*)`)
+	// orderByRegex matches the ORDER BY of a query
+	orderByRegex = regexp.MustCompile(`(?is)\border\s+by\b`)
+)
+
+// namedParametersNotInQuery are set by the library itself rather than being fields of the struct
+var namedParametersNotInQuery = map[string]bool{
+	"limit":              true,
+	"offset":             true,
+	bucketStartParameter: true,
+	bucketEndParameter:   true,
+}
+
+/*
+	validateQueries checks the table's queries (after they've been parsed) against the struct & each other:
+	- every `:param` of the queries is a field of the struct
+	- every CacheKey column is a field of the struct and is in the query's WHERE so the key is actually what's queried
+	- lists have an ORDER BY so the order of the cached list is the same every time it's filled
+	- no two queries have the same key e.g. two queries with a CacheKey of `user_id=%v`
+*/
+func (t *Table) validateQueries() error {
+	tableQueries := map[string]string{
+		"InsertQuery":  t.InsertQuery,
+		"UpdateQuery":  t.UpdateQuery,
+		"DeleteQuery":  t.DeleteQuery,
+		"RestoreQuery": t.RestoreQuery,
+	}
+	for name, query := range tableQueries {
+		err := t.validateNamedParameters(query)
+		if err != nil {
+			return fmt.Errorf("Table: %s Err: %s %s", t.tableName, name, err)
+		}
+	}
+
+	keyFormats := map[string]string{} // key format -> query.Name
+
+	for _, q := range t.Queries {
+		if q.RollupOf == "" {
+			err := t.validateNamedParameters(q.Query)
+			if err != nil {
+				return fmt.Errorf("query %s: %s", q.Name, err)
+			}
+		}
+
+		if !q.isCached() {
+			continue
+		}
+
+		for _, field := range q.cacheKeyFields {
+			if _, ok := t.objMap[field.columnName]; !ok {
+				return fmt.Errorf("query %s: CacheKey %s: %s is not a json field of %s", q.Name, q.CacheKey, field.columnName, t.tableName)
+			}
+		}
+
+		// a hash has to have the SoftDeleteField so a soft deleted row can be told apart when it's read from the cache
+		if t.SoftDeleteField != "" && q.cacheDataStructure == CacheDataStructureHash && !containsString(q.cacheFields, t.SoftDeleteField) {
+			return fmt.Errorf("query %s: CacheFields must include the SoftDeleteField %s", q.Name, t.SoftDeleteField)
+		}
+
+		if q.RollupOf == "" {
+			err := q.validateCacheKeyInWhere()
+			if err != nil {
+				return err
+			}
+		}
+
+		if q.cacheDataStructure == CacheDataStructureList && !orderByRegex.MatchString(q.Query) {
+			return fmt.Errorf("query %s: a list must have an ORDER BY so the cached list is always in the same order", q.Name)
+		}
+
+		for _, format := range q.keyFormats() {
+			if other, ok := keyFormats[format]; ok {
+				return fmt.Errorf("query %s: has the same cache key as query %s: %s", q.Name, other, format)
+			}
+			keyFormats[format] = q.Name
+		}
+	}
+	return nil
+}
+
+// validateNamedParameters makes sure every `:param` of the query is a field of the struct
+func (t *Table) validateNamedParameters(query string) error {
+	for _, match := range namedParameterRegex.FindAllStringSubmatch(query, -1) {
+		parameter := match[1]
+		if namedParametersNotInQuery[parameter] {
+			continue
+		}
+		if _, ok := t.objMap[parameter]; !ok {
+			return fmt.Errorf("named parameter :%s is not a json field of %s", parameter, t.tableName)
+		}
+	}
 	return nil
 }
 
 func (t *Table) parseTableName() {
 	// optimization but this is used so many times that it's worth it given it uses reflection
 	t.tableName = getStructName(t.Struct)
+	t.structType = reflect.Indirect(reflect.ValueOf(t.Struct)).Type()
 }
 
+var valuerType = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+
 // parseSlicesInSqlQuery takes in a query and parses out the slices in the query for use in the IN clause in postgres
 func (t *Table) parseSlicesInQueries() error {
 	if t.objMap == nil {
@@ -87,7 +261,8 @@ func (t *Table) parseSlicesInQueries() error {
 	for i := 0; i < val.Type().NumField(); i++ {
 		field := val.Type().Field(i)
 
-		if field.Type.Kind() == reflect.Slice {
+		// []byte (e.g. json.RawMessage) and driver.Valuers (e.g. pq.Int64Array for `= any(:ids)`) are sent to the db as is
+		if field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() != reflect.Uint8 && !field.Type.Implements(valuerType) {
 			s := strings.Split(field.Tag.Get("json"), ",") // in case there are options like omitempty
 			slices[s[0]] = field.Type
 		}
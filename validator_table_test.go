@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUpdateColumns(t *testing.T) {
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		{query: `update leads set notes=:notes where lead_id=:lead_id RETURNING *`, want: []string{"notes"}},
+		{query: `UPDATE leads SET email = :email, "notes" = :notes WHERE lead_id = :lead_id`, want: []string{"email", "notes"}},
+		{query: "update leads\n\tset email=:email,\n\tnotes=:notes\nreturning *", want: []string{"email", "notes"}},
+		{query: `update leads set updated_at=now(), notes=:notes where lead_id=:lead_id`, want: []string{"updated_at", "notes"}},
+		// not an update we can parse; every cached field is updated
+		{query: `select * from leads`},
+		{query: ``},
+	}
+
+	for _, c := range cases {
+		table := &Table{UpdateQuery: c.query}
+		err := table.validateAndParseVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		table.parseUpdateColumns()
+		if !reflect.DeepEqual(table.updateColumns, c.want) {
+			t.Errorf("parseUpdateColumns(%q) = %v, want %v", c.query, table.updateColumns, c.want)
+		}
+	}
+}
+
+func TestValidateAndParsePrimaryKey(t *testing.T) {
+	cases := []struct {
+		name  string
+		table *Table
+		want  []string
+		err   bool
+	}{
+		{name: "field", table: &Table{PrimaryKeyField: "lead_id"}, want: []string{"lead_id"}},
+		{name: "fields", table: &Table{PrimaryKeyFields: []string{"org_id", "user_id"}}, want: []string{"org_id", "user_id"}},
+		{name: "no primary key & no inserts", table: &Table{}},
+		{name: "no primary key", table: &Table{InsertQuery: "insert into leads (name) values (:name) returning *"}, err: true},
+		{name: "both", table: &Table{PrimaryKeyField: "lead_id", PrimaryKeyFields: []string{"lead_id"}}, err: true},
+	}
+
+	for _, c := range cases {
+		err := c.table.validateAndParsePrimaryKey()
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: want an error", c.name)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(c.table.pkFields, c.want) {
+			t.Errorf("%s: pkFields = %v, %v; want %v", c.name, c.table.pkFields, err, c.want)
+		}
+	}
+
+	// the primary key must be a column
+	table := &Table{Struct: &memberLead{}, PrimaryKeyField: "id", PrimaryQueryName: "GetByID", Queries: []*Query{{Name: "GetByID"}}}
+	if err := table.validate(); err == nil {
+		t.Error("a primary key that isn't a column: want an error")
+	}
+}
+
+func TestTableValidateQueries(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(table *Table)
+	}{
+		{name: "insert parameter isn't a field", change: func(table *Table) {
+			table.InsertQuery = "insert into leads (name, phone) values (:name, :phone) returning *"
+		}},
+		{name: "query parameter isn't a field", change: func(table *Table) {
+			table.Queries[0].Query = "select * from leads where lead_id=:id"
+		}},
+		{name: "key column isn't a field", change: func(table *Table) {
+			table.Queries[0].CacheKey = "id=%v"
+		}},
+		{name: "key parameter isn't in the where", change: func(table *Table) {
+			table.Queries[1].CacheKey = "user_id=%v|name=%v"
+		}},
+		{name: "key value isn't in the where", change: func(table *Table) {
+			table.Queries[1].CacheKey = "user_id=%v|email!=asdf@asdf.com"
+		}},
+		{name: "list without an order by", change: func(table *Table) {
+			table.Queries[1].Query = "select * from leads where user_id=:user_id"
+		}},
+		{name: "two queries with the same key", change: func(table *Table) {
+			table.Queries = append(table.Queries, &Query{
+				Name:         "LeadsGetByID2",
+				CacheKey:     "lead_id=%v",
+				Query:        "select lead_id from leads where lead_id=:lead_id",
+				InsertAction: CacheDel,
+				UpdateAction: CacheDel,
+				SelectAction: CacheSet,
+			})
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			table := benchLeadsTable()
+			c.change(table)
+
+			conf, _ := stubConfig(t, benchLeads(1), table)
+			if _, err := New(conf); err == nil {
+				t.Error("want an error")
+			}
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		table := benchLeadsTable()
+		// casts aren't named parameters & an uncached query's key doesn't need to be in its where
+		table.UpdateQuery = "update leads set notes=:notes, user_id=:user_id::bigint where lead_id=:lead_id returning *"
+		table.Queries = append(table.Queries, &Query{
+			Name:         "LeadsRecent",
+			CacheKey:     "user_id=%v",
+			Query:        "select * from leads order by created_at desc",
+			InsertAction: CacheNoAction,
+			UpdateAction: CacheNoAction,
+			SelectAction: CacheNoAction,
+		})
+
+		conf, _ := stubConfig(t, benchLeads(1), table)
+		if _, err := New(conf); err != nil {
+			t.Error(err)
+		}
+	})
+}
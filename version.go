@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+	A table with a VersionField (e.g. `version`) uses optimistic locking: its UpdateQuery is only run if the row's version is the
+	one that was read & the version is incremented. If someone else updated the row first then nothing is updated & Update returns
+	ErrConflict; read the row again & retry. The version is also kept next to each of the row's keys (see versionKey) so an older
+	row (e.g. a select that read the row before the update but cached it after) can't overwrite a newer one in the cache. A key
+	that's deleted by a write (e.g. an UpdateAction of CacheDel) keeps the row's new version; it's only deleted with the row.
+*/
+
+// ErrConflict is returned by Update when the row's version isn't the one that was read i.e. someone else updated it first
+var ErrConflict = errors.New("storage: the row was updated by someone else")
+
+// cacheKeyVersionModifier is added to a key for the version of the row cached in it
+const cacheKeyVersionModifier = "|version"
+
+// validateAndParseVersion checks the VersionField is an integer column & adds its check & increment to the UpdateQuery
+func (t *Table) validateAndParseVersion() error {
+	t.updateQuery = t.UpdateQuery
+	if t.VersionField == "" {
+		return nil
+	}
+
+	column, ok := t.objMap[t.VersionField]
+	if !ok {
+		return fmt.Errorf("Table: %s Err: VersionField %s is not a json field of the struct", t.tableName, t.VersionField)
+	}
+	switch reflect.TypeOf(column).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		return fmt.Errorf("Table: %s Err: VersionField %s must be an integer; is %T", t.tableName, t.VersionField, column)
+	}
+
+	if t.UpdateQuery == "" {
+		return nil
+	}
+	if containsString(setColumns(t.UpdateQuery), t.VersionField) {
+		return fmt.Errorf("Table: %s Err: UpdateQuery shouldn't set the VersionField %s; it's incremented for you", t.tableName, t.VersionField)
+	}
+
+	query, err := versionedUpdateQuery(t.UpdateQuery, t.VersionField)
+	if err != nil {
+		return fmt.Errorf("Table: %s Err: %s", t.tableName, err)
+	}
+	t.updateQuery = query
+	return nil
+}
+
+// versionedUpdateQuery adds the check & increment of the version column to an update query e.g. `update leads set notes=:notes
+// where lead_id=:lead_id returning *` is `update leads set version=version+1, notes=:notes where (lead_id=:lead_id) and version=:version returning *`
+func versionedUpdateQuery(query string, column string) (string, error) {
+	set := topLevelKeyword(query, "set")
+	if set < 0 {
+		return "", errors.New("UpdateQuery has no SET")
+	}
+	set += len("set")
+	query = fmt.Sprintf("%s %s=%s+1,%s", query[:set], column, column, query[set:])
+
+	returning := topLevelKeyword(query, "returning")
+	if returning < 0 {
+		return "", errors.New("UpdateQuery has no RETURNING")
+	}
+
+	check := fmt.Sprintf("%s=:%s", column, column)
+	if where := topLevelKeyword(query, "where"); where >= 0 && where < returning {
+		condition := strings.TrimSpace(query[where+len("where") : returning])
+		return fmt.Sprintf("%s where (%s) and %s %s", strings.TrimSpace(query[:where]), condition, check, query[returning:]), nil
+	}
+	return fmt.Sprintf("%s where %s %s", strings.TrimSpace(query[:returning]), check, query[returning:]), nil
+}
+
+/*
+	topLevelKeyword returns the index of the first keyword (e.g. `where`) of query that isn't in parens or quotes (i.e. not the
+	WHERE of a subquery in the SET) or -1 if there isn't one. It's matched as a whole word & case insensitively
+*/
+func topLevelKeyword(query string, keyword string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && isKeywordAt(query, i, keyword):
+			return i
+		}
+	}
+	return -1
+}
+
+func isKeywordAt(query string, i int, keyword string) bool {
+	end := i + len(keyword)
+	if end > len(query) || !strings.EqualFold(query[i:end], keyword) {
+		return false
+	}
+	return (i == 0 || !isWordByte(query[i-1])) && (end == len(query) || !isWordByte(query[end]))
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == ':' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// version returns the VersionField of the row in objMap; false if the table doesn't have one
+func (t *Table) version(objMap map[string]interface{}) (int64, bool) {
+	if t == nil || t.VersionField == "" {
+		return 0, false
+	}
+
+	switch v := orderedValue(objMap[t.VersionField]).(type) {
+	case int64:
+		return v, true
+	case uint64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+/*
+	versionKey is where the version of the row cached in key is kept. The key is the hash tag (i.e. `{key}`) so it's always in
+	the same slot of the cluster as key & both can be set by the same script. Keys with a `{` or `}` in them aren't versioned.
+*/
+func versionKey(key string) string {
+	return "{" + key + "}" + cacheKeyVersionModifier
+}
+
+// versionKeyTTL is how long the version of a row is kept if the row's key doesn't expire (i.e. a CacheTTL of -1)
+const versionKeyTTL = 24 * time.Hour
+
+// versionTTL is how long the version of a row cached for expiration is kept; it's never forever so deleted rows don't leave it behind
+func versionTTL(expiration time.Duration) time.Duration {
+	if expiration <= 0 {
+		return versionKeyTTL
+	}
+	return expiration
+}
+
+// setVersionedScript sets KEYS[1] to ARGV[4] only if ARGV[1] (the row's version) isn't older than the version kept in KEYS[2]
+var setVersionedScript = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[2]))
+if current and current > tonumber(ARGV[1]) then
+	return 0
+end
+local ttl = tonumber(ARGV[2])
+if ttl > 0 then
+	redis.call("SET", KEYS[1], ARGV[4], "PX", ttl)
+else
+	redis.call("SET", KEYS[1], ARGV[4])
+end
+redis.call("SET", KEYS[2], ARGV[1], "PX", ARGV[3])
+return 1
+`)
+
+// hsetVersionedScript HSETs the field & value pairs (ARGV[4:]) of KEYS[1] only if ARGV[1] (the row's version) isn't older than the version kept in KEYS[2]
+var hsetVersionedScript = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[2]))
+if current and current > tonumber(ARGV[1]) then
+	return 0
+end
+redis.call("HSET", KEYS[1], unpack(ARGV, 4))
+local ttl = tonumber(ARGV[2])
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+end
+redis.call("SET", KEYS[2], ARGV[1], "PX", ARGV[3])
+return 1
+`)
+
+// setRow is set for a row of t; if t has a VersionField then the row is only cached if it isn't older than the cached one
+func (c *cache) setRow(ctx context.Context, t *Table, key string, row interface{}, objMap map[string]interface{}, expiration time.Duration, enc *encoder) error {
+	version, ok := t.version(objMap)
+	if !ok || strings.ContainsAny(key, "{}") {
+		return c.set(ctx, key, row, expiration, enc)
+	}
+
+	b, err := enc.encode(row)
+	if err != nil {
+		return err
+	}
+	d(ctx, "setRow() key: %s version: %d\n value: %+v\n", key, version, row)
+
+	set, err := setVersionedScript.Run(ctx, c, []string{key, versionKey(key)}, version, expiration.Milliseconds(), versionTTL(expiration).Milliseconds(), b).Int()
+	if err == nil && set == 0 {
+		d(ctx, "setRow() key %s has a newer version than %d; not setting it", key, version)
+	}
+	return err
+}
+
+// hsetRow is hset for a row of t; if t has a VersionField then the row is only cached if it isn't older than the cached one
+func (c *cache) hsetRow(ctx context.Context, t *Table, key string, objMap map[string]interface{}, fields []string, expiration time.Duration, enc *encoder) error {
+	version, ok := t.version(objMap)
+	if !ok || strings.ContainsAny(key, "{}") {
+		return c.hset(ctx, key, objMap, fields, expiration, enc)
+	}
+
+	args := []interface{}{version, expiration.Milliseconds(), versionTTL(expiration).Milliseconds()}
+	for _, field := range fields {
+		v, ok := objMap[field]
+		if !ok {
+			continue
+		}
+
+		str, err := enc.encode(v)
+		if err != nil {
+			return err
+		}
+		args = append(args, field, str)
+	}
+	d(ctx, "hsetRow() key: %s version: %d\n values: %+v\n", key, version, args[3:])
+
+	if len(args) == 3 {
+		return nil
+	}
+
+	set, err := hsetVersionedScript.Run(ctx, c, []string{key, versionKey(key)}, args...).Int()
+	if err == nil && set == 0 {
+		d(ctx, "hsetRow() key %s has a newer version than %d; not setting it", key, version)
+	}
+	return err
+}
+
+// delRow deletes key of a row of t that was deleted along with its version since there's no newer row that could be cached in it
+func (c *cache) delRow(ctx context.Context, t *Table, key string) *redis.IntCmd {
+	if t == nil || t.VersionField == "" || strings.ContainsAny(key, "{}") {
+		return c.Del(ctx, key)
+	}
+	// they're in the same slot so they can be deleted together
+	return c.Del(ctx, key, versionKey(key))
+}
+
+// delVersionedScript deletes KEYS[1] & keeps ARGV[1] (the row's version) in KEYS[2] unless it already has a newer one
+var delVersionedScript = redis.NewScript(`
+redis.call("DEL", KEYS[1])
+local current = tonumber(redis.call("GET", KEYS[2]))
+if not current or current < tonumber(ARGV[1]) then
+	redis.call("SET", KEYS[2], ARGV[1], "PX", ARGV[2])
+end
+return 1
+`)
+
+/*
+	delRowKeepVersion deletes key of a row of t that still exists (e.g. it was updated & its UpdateAction is CacheDel) & writes
+	the row's version to the version key so a select that read the row before the write can't cache the older row afterwards
+*/
+func (c *cache) delRowKeepVersion(ctx context.Context, t *Table, key string, objMap map[string]interface{}, expiration time.Duration) error {
+	version, ok := t.version(objMap)
+	if !ok || strings.ContainsAny(key, "{}") {
+		return c.Del(ctx, key).Err()
+	}
+
+	d(ctx, "delRowKeepVersion() key: %s version: %d", key, version)
+	return delVersionedScript.Run(ctx, c, []string{key, versionKey(key)}, version, versionTTL(expiration).Milliseconds()).Err()
+}
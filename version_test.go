@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVersionedUpdateQuery(t *testing.T) {
+	cases := []struct {
+		name  string
+		query string
+		want  string
+		err   bool
+	}{
+		{
+			name:  "where",
+			query: "update leads set notes=:notes where lead_id=:lead_id returning *",
+			want:  "update leads set version=version+1, notes=:notes where (lead_id=:lead_id) and version=:version returning *",
+		},
+		{
+			name:  "where with parens",
+			query: "update leads set notes=:notes where (lead_id=:lead_id or user_id=:user_id) returning *",
+			want:  "update leads set version=version+1, notes=:notes where ((lead_id=:lead_id or user_id=:user_id)) and version=:version returning *",
+		},
+		{
+			name:  "no where",
+			query: "update leads set notes=:notes returning *",
+			want:  "update leads set version=version+1, notes=:notes where version=:version returning *",
+		},
+		{
+			name:  "uppercase",
+			query: "UPDATE leads SET notes=:notes WHERE lead_id=:lead_id RETURNING *",
+			want:  "UPDATE leads SET version=version+1, notes=:notes where (lead_id=:lead_id) and version=:version RETURNING *",
+		},
+		{
+			name:  "lowercase returning of some columns",
+			query: "update leads set notes=:notes where lead_id=:lead_id returning lead_id, notes",
+			want:  "update leads set version=version+1, notes=:notes where (lead_id=:lead_id) and version=:version returning lead_id, notes",
+		},
+		{
+			name:  "subquery in the set",
+			query: "update leads set owner_id=(select user_id from users where email=:email), notes=:notes where lead_id=:lead_id returning *",
+			want:  "update leads set version=version+1, owner_id=(select user_id from users where email=:email), notes=:notes where (lead_id=:lead_id) and version=:version returning *",
+		},
+		{
+			name:  "keywords in a string",
+			query: "update leads set notes='set where returning' where lead_id=:lead_id returning *",
+			want:  "update leads set version=version+1, notes='set where returning' where (lead_id=:lead_id) and version=:version returning *",
+		},
+		{name: "no set", query: "delete from leads where lead_id=:lead_id returning *", err: true},
+		{name: "no returning", query: "update leads set notes=:notes where lead_id=:lead_id", err: true},
+	}
+
+	for _, c := range cases {
+		got, err := versionedUpdateQuery(c.query, "version")
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: versionedUpdateQuery = %q, want an error", c.name, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("%s: versionedUpdateQuery =\n%q, %v\nwant\n%q", c.name, got, err, c.want)
+		}
+	}
+}
+
+type versionedLead struct {
+	LeadID  int64  `json:"lead_id"`
+	Notes   string `json:"notes"`
+	Version int64  `json:"version"`
+}
+
+func TestValidateAndParseVersion(t *testing.T) {
+	objMap, err := structToMap(&versionedLead{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		table Table
+		err   bool
+	}{
+		{name: "not versioned", table: Table{UpdateQuery: "update leads set notes=:notes where lead_id=:lead_id returning *"}},
+		{name: "not a field", table: Table{VersionField: "revision"}, err: true},
+		{name: "not an integer", table: Table{VersionField: "notes"}, err: true},
+		{name: "sets the version", table: Table{VersionField: "version", UpdateQuery: "update leads set version=:version where lead_id=:lead_id returning *"}, err: true},
+		{name: "valid", table: Table{VersionField: "version", UpdateQuery: "update leads set notes=:notes where lead_id=:lead_id returning *"}},
+	}
+
+	for _, c := range cases {
+		c.table.tableName = "Leads"
+		c.table.objMap = objMap
+		err := c.table.validateAndParseVersion()
+		if c.err != (err != nil) {
+			t.Errorf("%s: validateAndParseVersion = %v, want an error: %v", c.name, err, c.err)
+		}
+		if err == nil && c.table.VersionField == "" && c.table.updateQuery != c.table.UpdateQuery {
+			t.Errorf("%s: updateQuery = %q, want the UpdateQuery as is", c.name, c.table.updateQuery)
+		}
+	}
+}
+
+func TestSetRowVersioned(t *testing.T) {
+	ctx := context.Background()
+	client, m := stubRedis(t)
+	c := newCache(client)
+	enc := newEncoder(nil)
+	table := &Table{VersionField: "version"}
+	key := "service:test|versionedLead|lead_id=1"
+
+	set := func(version int64, notes string) {
+		lead := &versionedLead{LeadID: 1, Notes: notes, Version: version}
+		objMap, err := structToMap(lead)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.setRow(ctx, table, key, lead, objMap, time.Hour, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set(2, "second")
+	// e.g. a select that read the row before the update but cached it after
+	set(1, "first")
+
+	lead := &versionedLead{}
+	err := c.get(ctx, key, lead, enc)
+	if err != nil || lead.Version != 2 || lead.Notes != "second" {
+		t.Errorf("cached row = %+v, %v; want version 2", lead, err)
+	}
+	if got, _ := m.Get(versionKey(key)); got != "2" {
+		t.Errorf("version key = %s, want 2", got)
+	}
+	if m.TTL(versionKey(key)) <= 0 {
+		t.Error("the version key has no TTL")
+	}
+}
+
+func versionedLeadsTable() *Table {
+	return &Table{
+		Struct:           &versionedLead{},
+		PrimaryKeyField:  "lead_id",
+		PrimaryQueryName: "LeadsGetByID",
+		VersionField:     "version",
+		UpdateQuery:      "update leads set notes=:notes where lead_id=:lead_id returning *",
+		DeleteQuery:      "delete from leads where lead_id=:lead_id returning *",
+		Queries: []*Query{
+			{
+				Name:         "LeadsGetByID",
+				CacheKey:     "lead_id=%v",
+				Query:        "select * from leads where lead_id=:lead_id",
+				InsertAction: CacheSet,
+				UpdateAction: CacheDel,
+				SelectAction: CacheSet,
+			},
+		},
+	}
+}
+
+// an update that deletes the key keeps the new version so a select that read the older row can't cache it afterwards
+func TestUpdateKeepsTheVersion(t *testing.T) {
+	ctx := context.Background()
+
+	version := int64(1)
+	s, m := stubStorage(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		if strings.HasPrefix(query, "update") {
+			version++
+		}
+		return []string{"lead_id", "notes", "version"}, [][]driver.Value{{int64(1), []byte("notes"), version}}, nil
+	}, versionedLeadsTable())
+	key, _ := s.KeyName("LeadsGetByID", &versionedLead{LeadID: 1})
+
+	err := s.Select(ctx, &versionedLead{LeadID: 1}, "LeadsGetByID")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Update(ctx, &versionedLead{LeadID: 1, Notes: "notes", Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Exists(key) {
+		t.Errorf("%s is still cached after the update", key)
+	}
+	if got, _ := m.Get(versionKey(key)); got != "2" {
+		t.Errorf("version key = %q, want the updated version 2", got)
+	}
+	if m.TTL(versionKey(key)) <= 0 {
+		t.Error("the version key has no TTL")
+	}
+
+	// e.g. a select that read version 1 before the update
+	lead := &versionedLead{LeadID: 1, Notes: "stale", Version: 1}
+	objMap, _ := structToMap(lead)
+	table := versionedLeadsTable()
+	err = s.(*storage).cache.setRow(ctx, table, key, lead, objMap, time.Hour, newEncoder(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Exists(key) {
+		t.Errorf("the older row was cached in %s after the update", key)
+	}
+
+	// the version is only deleted with the row
+	err = s.Delete(ctx, &versionedLead{LeadID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Exists(versionKey(key)) {
+		t.Errorf("the version key is still there after the row was deleted")
+	}
+}